@@ -0,0 +1,93 @@
+Feature: Outlier Detection
+  As a system administrator,
+  I want backends that keep failing real traffic to be taken out for a while,
+  So that clients stop hitting a broken server before its health check notices.
+
+  Background:
+    Given outlier detection ejects after 3 consecutive failures for 200ms
+    And the following gRPC backends are running:
+      | server_id |
+      | server1   |
+      | server2   |
+      | server3   |
+
+  Scenario: Ejecting a backend that keeps failing
+    Given "server1" answers every call with UNAVAILABLE
+    When a client makes 9 gRPC calls
+    Then "server1" should be ejected
+    And 6 more gRPC calls should only reach:
+      | server  |
+      | server2 |
+      | server3 |
+
+  Scenario: Letting an ejected backend back in
+    Given "server1" answers every call with UNAVAILABLE
+    And a client makes 9 gRPC calls
+    When "server1" recovers
+    Then "server1" should be let back in within 1s
+    And 6 more gRPC calls should only reach:
+      | server  |
+      | server1 |
+      | server2 |
+      | server3 |
+
+  Scenario: Ejecting a backend again for longer
+    Given "server1" answers every call with UNAVAILABLE
+    And a client makes 9 gRPC calls
+    And "server1" should be let back in within 1s
+    When a client makes 9 gRPC calls
+    Then "server1" should be ejected
+    And "server1" should still be ejected after 300ms
+    And "server1" should be let back in within 1s
+
+  Scenario: Counting failed calls that were retried elsewhere
+    Given calls that fail with UNAVAILABLE are retried on another backend
+    And "server1" answers every call with UNAVAILABLE
+    When a client makes 9 gRPC calls
+    Then every call should have succeeded
+    And "server1" should be ejected
+    And 6 more gRPC calls should only reach:
+      | server  |
+      | server2 |
+      | server3 |
+
+  Scenario: Ejecting a backend that refuses connections
+    Given "server1" stops accepting connections
+    When a client makes 9 gRPC calls
+    Then "server1" should be ejected
+    And 6 more gRPC calls should only reach:
+      | server  |
+      | server2 |
+      | server3 |
+
+  Scenario: Successful calls reset the failure count
+    Given "server1" fails every other call with UNAVAILABLE
+    When a client makes 12 gRPC calls
+    Then "server1" should not be ejected
+
+  Scenario: Not ejecting a backend when it would cause panic mode
+    Given the panic threshold is 0.7
+    And "server1" answers every call with UNAVAILABLE
+    When a client makes 9 gRPC calls
+    Then "server1" should not be ejected
+
+  Scenario: Passing health checks don't end an ejection early
+    Given active health checks run every 20ms
+    And "server1" answers every call with UNAVAILABLE
+    When a client makes 9 gRPC calls
+    Then "server1" should be ejected
+    And "server1" should still be ejected after 100ms
+    And "server1" should still be healthy
+
+  Scenario: An ejection ending doesn't bring back an unhealthy backend
+    Given active health checks run every 20ms
+    And "server1" answers every call with UNAVAILABLE
+    And a client makes 9 gRPC calls
+    And "server1" should be ejected
+    When "server1" starts failing health checks
+    Then "server1" should be marked unhealthy within 1s
+    And "server1" should be let back in within 1s
+    And 6 more gRPC calls should only reach:
+      | server  |
+      | server2 |
+      | server3 |
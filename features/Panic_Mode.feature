@@ -0,0 +1,68 @@
+Feature: Panic Mode
+  As a system administrator,
+  I want the load balancer to ignore health status when too few backends are healthy,
+  So that a bad health check can't concentrate all traffic on a handful of servers.
+
+  Background:
+    Given the load balancer is running
+    And the following backend servers are configured:
+      | server_id | address      | port | max_connections |
+      | server1   | 192.168.1.10 | 8080 |            1000 |
+      | server2   | 192.168.1.11 | 8080 |            1000 |
+      | server3   | 192.168.1.12 | 8080 |            1000 |
+      | server4   | 192.168.1.13 | 8080 |            1000 |
+
+  Scenario: Panic mode is off by default
+    Given "server2" becomes unavailable
+    And "server3" becomes unavailable
+    And "server4" becomes unavailable
+    When a client makes 4 consecutive requests
+    Then the requests should only reach:
+      | server  |
+      | server1 |
+    And the load balancer should not be in panic mode
+
+  Scenario: Healthy fraction above the threshold
+    Given the panic threshold is 0.5
+    And "server4" becomes unavailable
+    When a client makes 6 consecutive requests
+    Then the requests should only reach:
+      | server  |
+      | server1 |
+      | server2 |
+      | server3 |
+    And the load balancer should not be in panic mode
+
+  Scenario: Healthy fraction below the threshold
+    Given the panic threshold is 0.5
+    And "server2" becomes unavailable
+    And "server3" becomes unavailable
+    And "server4" becomes unavailable
+    When a client makes 4 consecutive requests
+    Then the requests should only reach:
+      | server  |
+      | server1 |
+      | server2 |
+      | server3 |
+      | server4 |
+    And the load balancer should be in panic mode
+
+  Scenario: Leaving panic mode once servers recover
+    Given the panic threshold is 0.5
+    And "server2" becomes unavailable
+    And "server3" becomes unavailable
+    And "server4" becomes unavailable
+    And a client makes 4 consecutive requests
+    When "server2" becomes available
+    And "server3" becomes available
+    And a client makes 4 consecutive requests
+    Then the requests should only reach:
+      | server  |
+      | server1 |
+      | server2 |
+      | server3 |
+    And the load balancer should not be in panic mode
+
+  Scenario: Error Flow - Invalid panic threshold
+    When the panic threshold is set to 1.5
+    Then I should receive a panic threshold error
@@ -0,0 +1,700 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+var (
+	ErrUnknownStrategy      = errors.New("unknown load balancing strategy")
+	ErrUnknownAdaptiveLimit = errors.New("unknown adaptive limit algorithm")
+	ErrUnknownSameSite      = errors.New("unknown SameSite mode")
+	ErrStrategyChanged      = errors.New("changing a pool's strategy requires a restart")
+	ErrNoPools              = errors.New("config must define at least one pool")
+)
+
+const (
+	defaultAIMDTimeout       = time.Second
+	defaultStickyIdleTimeout = 30 * time.Minute
+
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierBaseEjectionTime    = 30 * time.Second
+	defaultOutlierMaxEjectionTime     = 300 * time.Second
+)
+
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyRandom             = "random"
+	StrategyIPHash             = "ip_hash"
+)
+
+type ServerConfig struct {
+	ID       string `json:"id"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	MaxConns int    `json:"max_conns,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+}
+
+type HealthCheckConfig struct {
+	Path               string        `json:"path,omitempty"`
+	GRPC               bool          `json:"grpc,omitempty"`
+	Service            string        `json:"service,omitempty"`
+	Interval           util.Duration `json:"interval"`
+	Timeout            util.Duration `json:"timeout"`
+	HealthyThreshold   int           `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int           `json:"unhealthy_threshold,omitempty"`
+}
+
+// AdaptiveLimitConfig bounds a pool's adaptive concurrency limiter. The
+// minimum defaults to 1 and the maximum to each server's max_conns, which
+// it keeps following when max_conns is changed. The limit starts at
+// InitialLimit, or the maximum without one. Timeout is the latency above
+// which aimd backs off, 1s by default.
+type AdaptiveLimitConfig struct {
+	MinLimit     int           `json:"min_limit,omitempty"`
+	InitialLimit int           `json:"initial_limit,omitempty"`
+	MaxLimit     int           `json:"max_limit,omitempty"`
+	Timeout      util.Duration `json:"timeout,omitempty"`
+}
+
+// OutlierDetectionConfig ejects servers that fail consecutive_failures
+// requests in a row, 5 by default, for base_ejection_time, 30s by default,
+// growing with each ejection in a row up to max_ejection_time, 300s by
+// default. gRPC calls count as failed on the same statuses that retries
+// treat as failures, and connections when their TLS handshake fails.
+type OutlierDetectionConfig struct {
+	ConsecutiveFailures int           `json:"consecutive_failures,omitempty"`
+	BaseEjectionTime    util.Duration `json:"base_ejection_time,omitempty"`
+	MaxEjectionTime     util.Duration `json:"max_ejection_time,omitempty"`
+}
+
+// StickyConfig pins clients to a server with a signed cookie. Sessions
+// unused for IdleTimeout, 30m unless set, are rebalanced; "0s" keeps them
+// for as long as the cookie lives.
+type StickyConfig struct {
+	CookieName  string         `json:"cookie_name,omitempty"`
+	Path        string         `json:"path,omitempty"`
+	Secure      bool           `json:"secure,omitempty"`
+	HttpOnly    bool           `json:"http_only,omitempty"`
+	SameSite    string         `json:"same_site,omitempty"`
+	TTL         util.Duration  `json:"ttl,omitempty"`
+	IdleTimeout *util.Duration `json:"idle_timeout,omitempty"`
+}
+
+type PoolConfig struct {
+	Name           string                  `json:"name"`
+	Strategy       string                  `json:"strategy"`
+	PanicThreshold float64                 `json:"panic_threshold"`
+	AdaptiveLimit  string                  `json:"adaptive_limit,omitempty"`
+	Limits         *AdaptiveLimitConfig    `json:"adaptive_limits,omitempty"`
+	MaxConns       int                     `json:"max_conns,omitempty"` // default for servers that don't set one
+	MaxUpgraded    int                     `json:"max_upgraded,omitempty"`
+	HealthCheck    *HealthCheckConfig      `json:"health_check,omitempty"`
+	Outliers       *OutlierDetectionConfig `json:"outlier_detection,omitempty"`
+	Sticky         *StickyConfig           `json:"sticky,omitempty"`
+	Upstream       *router.UpstreamPolicy  `json:"upstream,omitempty"`
+	Servers        []ServerConfig          `json:"servers"`
+}
+
+type Config struct {
+	StickySecret   string                        `json:"sticky_secret,omitempty"`
+	TrustedProxies []string                      `json:"trusted_proxies,omitempty"`
+	TLS            *servlets.TLSConfig           `json:"tls,omitempty"`            // read at startup only
+	ProxyProtocol  *servlets.ProxyProtocolConfig `json:"proxy_protocol,omitempty"` // read at startup only
+	TCP            []servlets.TcpListenerConfig  `json:"tcp,omitempty"`            // read at startup only
+	UDP            []servlets.UdpListenerConfig  `json:"udp,omitempty"`            // read at startup only
+	Pools          []PoolConfig                  `json:"pools"`
+	Routes         []router.Route                `json:"routes,omitempty"`
+	NotFound       *router.NotFoundResponse      `json:"not_found,omitempty"`
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	if len(cfg.Pools) == 0 {
+		return nil, ErrNoPools
+	}
+
+	if cfg.StickySecret == "" {
+		cfg.StickySecret = os.Getenv("GOOBERNETES_STICKY_SECRET")
+	}
+
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Strategy == "" {
+			cfg.Pools[i].Strategy = StrategyRoundRobin
+		}
+	}
+	return &cfg, nil
+}
+
+func NewLoadBalancer(strategy string) (loadbalancer.LoadBalancer, error) {
+	switch strategy {
+	case StrategyRoundRobin, "":
+		return loadbalancer.NewRoundRobinLoadBalancer(), nil
+	case StrategyWeightedRoundRobin:
+		return loadbalancer.NewWeightedRoundRobinLoadBalancer(), nil
+	case StrategyRandom:
+		return loadbalancer.NewRandomLoadBalancer(), nil
+	case StrategyIPHash:
+		return loadbalancer.NewIPHashLoadBalancer(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownStrategy, strategy)
+}
+
+func (c *Config) Build() (*loadbalancer.PoolManager, error) {
+	pm := loadbalancer.NewPoolManager()
+	if err := c.Apply(pm); err != nil {
+		return nil, err
+	}
+	return pm, nil
+}
+
+// poolUpdate is a pool change that has been fully built and validated, so
+// swapping it in can't fail halfway.
+type poolUpdate struct {
+	config   PoolConfig
+	pool     *loadbalancer.Pool
+	added    bool // pool is new and not yet registered
+	servers  map[string]loadbalancer.Server
+	health   *loadbalancer.HealthChecker
+	keep     bool // the running health checker's settings are unchanged
+	outliers *loadbalancer.OutlierDetector
+}
+
+// Apply reconciles the pool manager with the config: pools missing from the
+// config are removed, new ones are built and existing ones are reconciled in
+// place so in-flight connection counts survive a reload. Health checkers
+// whose settings are unchanged keep running, along with their streaks.
+// Everything is built
+// and validated before any pool is touched, so a bad config changes nothing,
+// including anything ApplyRoutes would go on to reject.
+func (c *Config) Apply(pm *loadbalancer.PoolManager) error {
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+
+	updates := make([]poolUpdate, 0, len(c.Pools))
+	wanted := make(map[string]bool, len(c.Pools))
+	for _, pc := range c.Pools {
+		if wanted[pc.Name] {
+			return fmt.Errorf("pool %s: %w", pc.Name, loadbalancer.ErrPoolAlreadyExists)
+		}
+		wanted[pc.Name] = true
+
+		pool, err := pm.GetPool(pc.Name)
+		if errors.Is(err, loadbalancer.ErrPoolNotFound) {
+			pool, err = c.buildPool(pc)
+			if err != nil {
+				return fmt.Errorf("pool %s: %w", pc.Name, err)
+			}
+			updates = append(updates, poolUpdate{config: pc, pool: pool, added: true})
+			continue
+		}
+
+		if pool.Strategy != pc.Strategy {
+			return fmt.Errorf("pool %s: %w", pc.Name, ErrStrategyChanged)
+		}
+
+		servers, err := pc.newServers()
+		if err != nil {
+			return fmt.Errorf("pool %s: %w", pc.Name, err)
+		}
+
+		update := poolUpdate{config: pc, pool: pool, servers: servers, keep: pool.HealthSettings == pc.healthSettings()}
+		if !update.keep {
+			if update.health, err = pc.newHealthChecker(pool); err != nil {
+				return fmt.Errorf("pool %s: %w", pc.Name, err)
+			}
+		}
+
+		update.outliers = pool.OutlierDetector()
+		if config, ok := pc.outlierConfig(); !ok || update.outliers == nil || update.outliers.Config() != config {
+			if update.outliers, err = pc.newOutlierDetector(pool); err != nil {
+				return fmt.Errorf("pool %s: %w", pc.Name, err)
+			}
+		}
+		updates = append(updates, update)
+	}
+
+	for _, update := range updates {
+		if update.added {
+			if err := pm.AddPool(update.pool); err != nil {
+				return fmt.Errorf("pool %s: %w", update.pool.Name, err)
+			}
+			continue
+		}
+
+		if err := update.config.apply(update.pool, update.servers); err != nil {
+			return fmt.Errorf("pool %s: %w", update.pool.Name, err)
+		}
+
+		if !update.keep {
+			update.pool.SetHealthChecker(update.health)
+			update.pool.HealthSettings = update.config.healthSettings()
+		}
+		update.pool.SetOutlierDetector(update.outliers)
+	}
+
+	for _, pool := range pm.GetPools() {
+		if !wanted[pool.Name] {
+			if err := pm.RemovePool(pool.Name); err != nil {
+				return fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyRoutes replaces the routing table, the trusted proxies and each
+// pool's upstream policy, dropping the upstreams of removed pools. Without
+// any configured routes every request goes to the first pool.
+func (c *Config) ApplyRoutes(r *router.Router, routes *router.RouteTable) error {
+	if err := c.validateRoutes(); err != nil {
+		return err
+	}
+
+	if c.NotFound != nil {
+		r.SetNotFoundResponse(*c.NotFound)
+	}
+
+	if err := r.SetTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+
+	for _, pc := range c.Pools {
+		if err := r.SetUpstreamPolicy(pc.Name, pc.upstreamPolicy()); err != nil {
+			return fmt.Errorf("pool %s: %w", pc.Name, err)
+		}
+	}
+	r.PruneUpstreams()
+
+	return routes.SetRoutes(c.routes())
+}
+
+// validateRoutes checks everything ApplyRoutes could reject, so it can be
+// refused before anything is changed.
+func (c *Config) validateRoutes() error {
+	if err := c.checkRouteTargets(); err != nil {
+		return err
+	}
+
+	if _, err := loadbalancer.NewTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+
+	for _, pc := range c.Pools {
+		if err := router.ValidateUpstreamPolicy(pc.upstreamPolicy()); err != nil {
+			return fmt.Errorf("pool %s: %w", pc.Name, err)
+		}
+	}
+	return router.ValidateRoutes(c.routes())
+}
+
+// routes are the configured routes, or without any a default route to the
+// first pool.
+func (c *Config) routes() []router.Route {
+	if len(c.Routes) == 0 {
+		return []router.Route{{Name: "default", Pool: c.Pools[0].Name}}
+	}
+	return c.Routes
+}
+
+// checkRouteTargets makes sure every pool a route or a TCP or UDP listener
+// sends traffic to is in the config.
+func (c *Config) checkRouteTargets() error {
+	pools := make(map[string]bool, len(c.Pools))
+	for _, pc := range c.Pools {
+		pools[pc.Name] = true
+	}
+
+	for _, route := range c.Routes {
+		for _, target := range route.Pools() {
+			if !pools[target] {
+				return fmt.Errorf("route %s: %w: %s", route.Name, loadbalancer.ErrPoolNotFound, target)
+			}
+		}
+	}
+
+	for _, tc := range c.TCP {
+		for _, target := range append([]string{tc.Pool}, slices.Collect(maps.Values(tc.SNIRoutes))...) {
+			if !pools[target] {
+				return fmt.Errorf("tcp listener on port %d: %w: %s", tc.Port, loadbalancer.ErrPoolNotFound, target)
+			}
+		}
+	}
+
+	for _, uc := range c.UDP {
+		if !pools[uc.Pool] {
+			return fmt.Errorf("udp listener on port %d: %w: %s", uc.Port, loadbalancer.ErrPoolNotFound, uc.Pool)
+		}
+	}
+	return nil
+}
+
+func (c *Config) buildPool(pc PoolConfig) (*loadbalancer.Pool, error) {
+	lb, err := NewLoadBalancer(pc.Strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.Sticky != nil {
+		lb, err = c.newStickySessionLoadBalancer(lb, pc.Name, pc.Sticky)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pool, err := loadbalancer.NewPool(pc.Name, lb)
+	if err != nil {
+		return nil, err
+	}
+	pool.Strategy = pc.Strategy
+
+	if err := pc.Apply(pool); err != nil {
+		return nil, err
+	}
+
+	health, err := pc.newHealthChecker(pool)
+	if err != nil {
+		return nil, err
+	}
+	pool.SetHealthChecker(health)
+	pool.HealthSettings = pc.healthSettings()
+
+	outliers, err := pc.newOutlierDetector(pool)
+	if err != nil {
+		return nil, err
+	}
+	pool.SetOutlierDetector(outliers)
+	return pool, nil
+}
+
+// Apply reconciles a running load balancer with the pool config: servers
+// missing from the config are removed, new ones are added and existing ones
+// have their limits and weights updated in place. The config is validated
+// first, so an error leaves the load balancer as it was.
+func (pc *PoolConfig) Apply(lb loadbalancer.LoadBalancer) error {
+	servers, err := pc.newServers()
+	if err != nil {
+		return err
+	}
+	return pc.apply(lb, servers)
+}
+
+// newServers validates the pool config, building every server it lists.
+// Only those missing from the load balancer are added by apply.
+func (pc *PoolConfig) newServers() (map[string]loadbalancer.Server, error) {
+	if err := loadbalancer.ValidatePanicThreshold(pc.PanicThreshold); err != nil {
+		return nil, err
+	}
+
+	servers := make(map[string]loadbalancer.Server, len(pc.Servers))
+	for _, sc := range pc.Servers {
+		if _, ok := servers[sc.ID]; ok {
+			return nil, fmt.Errorf("server %s: %w", sc.ID, loadbalancer.ErrServerAlreadyExists)
+		}
+
+		server, err := pc.newServer(sc, pc.maxConns(sc))
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", sc.ID, err)
+		}
+		servers[sc.ID] = server
+	}
+	return servers, nil
+}
+
+func (pc *PoolConfig) apply(lb loadbalancer.LoadBalancer, servers map[string]loadbalancer.Server) error {
+	if err := lb.SetPanicThreshold(pc.PanicThreshold); err != nil {
+		return err
+	}
+
+	existing := make(map[string]*loadbalancer.ServerInstance)
+	for _, server := range lb.GetServers() {
+		instance := loadbalancer.InstanceOf(server)
+		existing[instance.ID] = instance
+	}
+
+	wanted := make(map[string]bool, len(pc.Servers))
+	for _, sc := range pc.Servers {
+		wanted[sc.ID] = true
+		maxConns := pc.maxConns(sc)
+
+		if current, ok := existing[sc.ID]; ok && current.Host == sc.Host && current.Port == sc.Port {
+			if err := lb.UpdateServerMaxConn(sc.ID, maxConns); err != nil {
+				return fmt.Errorf("server %s: %w", sc.ID, err)
+			}
+
+			if err := current.SetMaxUpgraded(pc.MaxUpgraded); err != nil {
+				return fmt.Errorf("server %s: %w", sc.ID, err)
+			}
+			current.SetMultiplexed(pc.multiplexed())
+
+			if pc.Strategy == StrategyWeightedRoundRobin {
+				if err := lb.UpdateServerWeight(sc.ID, sc.Weight); err != nil {
+					return fmt.Errorf("server %s: %w", sc.ID, err)
+				}
+			}
+			continue
+		} else if ok {
+			// The address changed, so this is a different backend
+			if err := lb.RemoveServer(sc.ID); err != nil {
+				return fmt.Errorf("server %s: %w", sc.ID, err)
+			}
+		}
+
+		if err := lb.AddServer(servers[sc.ID]); err != nil {
+			return fmt.Errorf("server %s: %w", sc.ID, err)
+		}
+	}
+
+	for id := range existing {
+		if !wanted[id] {
+			if err := lb.RemoveServer(id); err != nil {
+				return fmt.Errorf("server %s: %w", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (pc *PoolConfig) upstreamPolicy() router.UpstreamPolicy {
+	if pc.Upstream == nil {
+		return router.UpstreamPolicy{}
+	}
+	return *pc.Upstream
+}
+
+func (pc *PoolConfig) multiplexed() bool {
+	return pc.Upstream != nil && pc.Upstream.Multiplexed()
+}
+
+func (pc *PoolConfig) maxConns(sc ServerConfig) int {
+	if sc.MaxConns != 0 {
+		return sc.MaxConns
+	}
+	return pc.MaxConns
+}
+
+func (pc *PoolConfig) newServer(sc ServerConfig, maxConns int) (loadbalancer.Server, error) {
+	var server loadbalancer.Server
+	var instance *loadbalancer.ServerInstance
+
+	if pc.Strategy == StrategyWeightedRoundRobin {
+		weighted, err := loadbalancer.NewWeightedServerInstance(sc.ID, sc.Host, sc.Port, maxConns, sc.Weight)
+		if err != nil {
+			return nil, err
+		}
+		server, instance = weighted, &weighted.ServerInstance
+	} else {
+		plain, err := loadbalancer.NewServerInstance(sc.ID, sc.Host, sc.Port, maxConns)
+		if err != nil {
+			return nil, err
+		}
+		server, instance = plain, plain
+	}
+
+	if err := instance.SetMaxUpgraded(pc.MaxUpgraded); err != nil {
+		return nil, err
+	}
+	instance.SetMultiplexed(pc.multiplexed())
+
+	limiter, err := newConcurrencyLimiter(pc.AdaptiveLimit, pc.Limits, maxConns)
+	if err != nil {
+		return nil, err
+	}
+
+	if limiter != nil {
+		instance.SetConcurrencyLimiter(limiter)
+	}
+	return server, nil
+}
+
+// healthSettings identifies everything the pool's health checker is built
+// from. Upstream TLS files are read again only when the policy changes, as
+// they are for proxied requests.
+func (pc *PoolConfig) healthSettings() string {
+	if pc.HealthCheck == nil {
+		return ""
+	}
+
+	settings := struct {
+		Check         *HealthCheckConfig
+		Protocol      string
+		ProxyProtocol string
+		TLS           *router.UpstreamTLSPolicy
+	}{Check: pc.HealthCheck}
+	if pc.Upstream != nil {
+		settings.Protocol = pc.Upstream.Protocol
+		settings.ProxyProtocol = pc.Upstream.ProxyProtocol
+		settings.TLS = pc.Upstream.TLS
+	}
+
+	data, _ := json.Marshal(settings)
+	return string(data)
+}
+
+func (pc *PoolConfig) newHealthChecker(lb loadbalancer.LoadBalancer) (*loadbalancer.HealthChecker, error) {
+	if pc.HealthCheck == nil {
+		return nil, nil
+	}
+
+	var tlsConfig *tls.Config
+	var proxyProtocol string
+	if pc.Upstream != nil {
+		var err error
+		if tlsConfig, err = pc.Upstream.ClientTLSConfig(); err != nil {
+			return nil, err
+		}
+		proxyProtocol = pc.Upstream.ProxyProtocol
+	}
+
+	return loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{
+		Path:               pc.HealthCheck.Path,
+		GRPC:               pc.HealthCheck.GRPC,
+		Service:            pc.HealthCheck.Service,
+		TLS:                tlsConfig,
+		ProxyProtocol:      proxyProtocol,
+		Interval:           time.Duration(pc.HealthCheck.Interval),
+		Timeout:            time.Duration(pc.HealthCheck.Timeout),
+		HealthyThreshold:   pc.HealthCheck.HealthyThreshold,
+		UnhealthyThreshold: pc.HealthCheck.UnhealthyThreshold,
+	})
+}
+
+// outlierConfig fills in the defaults, reporting false when the pool has no
+// outlier detection.
+func (pc *PoolConfig) outlierConfig() (loadbalancer.OutlierConfig, bool) {
+	if pc.Outliers == nil {
+		return loadbalancer.OutlierConfig{}, false
+	}
+
+	config := loadbalancer.OutlierConfig{
+		ConsecutiveFailures: pc.Outliers.ConsecutiveFailures,
+		BaseEjectionTime:    time.Duration(pc.Outliers.BaseEjectionTime),
+		MaxEjectionTime:     time.Duration(pc.Outliers.MaxEjectionTime),
+	}
+	if config.ConsecutiveFailures == 0 {
+		config.ConsecutiveFailures = defaultOutlierConsecutiveFailures
+	}
+	if config.BaseEjectionTime == 0 {
+		config.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if config.MaxEjectionTime == 0 {
+		config.MaxEjectionTime = max(defaultOutlierMaxEjectionTime, config.BaseEjectionTime)
+	}
+	return config, true
+}
+
+func (pc *PoolConfig) newOutlierDetector(pool *loadbalancer.Pool) (*loadbalancer.OutlierDetector, error) {
+	config, ok := pc.outlierConfig()
+	if !ok {
+		return nil, nil
+	}
+	return loadbalancer.NewOutlierDetector(pool, config)
+}
+
+// Sticky settings are only read when a pool is first built; changing them
+// takes a restart.
+func (c *Config) newStickySessionLoadBalancer(lb loadbalancer.LoadBalancer, poolName string, sc *StickyConfig) (loadbalancer.LoadBalancer, error) {
+	sameSite, err := parseSameSite(sc.SameSite)
+	if err != nil {
+		return nil, err
+	}
+
+	key := []byte(c.StickySecret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Printf("no sticky session secret configured for pool %s, sessions will not survive a restart", poolName)
+	}
+
+	cookieName := sc.CookieName
+	if cookieName == "" {
+		cookieName = "goobernetes_" + poolName
+	}
+
+	idleTimeout := defaultStickyIdleTimeout
+	if sc.IdleTimeout != nil {
+		idleTimeout = time.Duration(*sc.IdleTimeout)
+	}
+
+	return loadbalancer.NewStickySessionLoadBalancer(lb, loadbalancer.StickySessionConfig{
+		CookieName:  cookieName,
+		Path:        sc.Path,
+		Secure:      sc.Secure,
+		HttpOnly:    sc.HttpOnly,
+		SameSite:    sameSite,
+		TTL:         time.Duration(sc.TTL),
+		IdleTimeout: idleTimeout,
+		Secret:      key,
+	})
+}
+
+func parseSameSite(mode string) (http.SameSite, error) {
+	switch mode {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownSameSite, mode)
+}
+
+func newConcurrencyLimiter(algorithm string, limits *AdaptiveLimitConfig, maxConns int) (loadbalancer.ConcurrencyLimiter, error) {
+	bounds := AdaptiveLimitConfig{MinLimit: 1, MaxLimit: maxConns, Timeout: util.Duration(defaultAIMDTimeout)}
+	if limits != nil {
+		if limits.MinLimit != 0 {
+			bounds.MinLimit = limits.MinLimit
+		}
+		if limits.MaxLimit != 0 {
+			bounds.MaxLimit = limits.MaxLimit
+		}
+		if limits.Timeout != 0 {
+			bounds.Timeout = limits.Timeout
+		}
+		bounds.InitialLimit = limits.InitialLimit
+	}
+	if bounds.InitialLimit == 0 {
+		bounds.InitialLimit = bounds.MaxLimit
+	}
+
+	switch algorithm {
+	case "":
+		return nil, nil
+	case "aimd":
+		return loadbalancer.NewAIMDLimiter(bounds.MinLimit, bounds.MaxLimit, bounds.InitialLimit, time.Duration(bounds.Timeout))
+	case "gradient":
+		return loadbalancer.NewGradientLimiter(bounds.MinLimit, bounds.MaxLimit, bounds.InitialLimit)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownAdaptiveLimit, algorithm)
+}
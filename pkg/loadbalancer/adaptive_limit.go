@@ -0,0 +1,174 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var ErrInvalidLimitBounds = errors.New("invalid concurrency limit bounds")
+
+type ConcurrencyLimiter interface {
+	Limit() int
+	MaxLimit() int
+	SetMaxLimit(maxLimit int)
+	OnSample(latency time.Duration, inFlight int, failed bool)
+}
+
+// AIMDLimiter grows the limit by one while the backend keeps up and cuts it
+// multiplicatively on errors or latency above the timeout.
+type AIMDLimiter struct {
+	mu           sync.Mutex
+	limit        float64
+	minLimit     int
+	maxLimit     int
+	backoffRatio float64
+	timeout      time.Duration
+}
+
+var _ ConcurrencyLimiter = (*AIMDLimiter)(nil)
+
+func NewAIMDLimiter(minLimit int, maxLimit int, initialLimit int, timeout time.Duration) (*AIMDLimiter, error) {
+	if err := validateLimitBounds(minLimit, maxLimit, initialLimit); err != nil {
+		return nil, err
+	}
+
+	return &AIMDLimiter{
+		limit:        float64(initialLimit),
+		minLimit:     minLimit,
+		maxLimit:     maxLimit,
+		backoffRatio: 0.9,
+		timeout:      timeout,
+	}, nil
+}
+
+func (l *AIMDLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *AIMDLimiter) MaxLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxLimit
+}
+
+// SetMaxLimit moves the ceiling, which never drops below the minimum. The
+// limit is clamped straight away but otherwise has to grow into a raise.
+func (l *AIMDLimiter) SetMaxLimit(maxLimit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxLimit = max(l.minLimit, maxLimit)
+	l.limit = clampLimit(l.limit, l.minLimit, l.maxLimit)
+}
+
+func (l *AIMDLimiter) OnSample(latency time.Duration, inFlight int, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if failed || (l.timeout > 0 && latency > l.timeout) {
+		l.limit = l.limit * l.backoffRatio
+	} else if inFlight*2 >= int(l.limit) {
+		// Only grow when the current limit is actually being used
+		l.limit++
+	}
+	l.limit = clampLimit(l.limit, l.minLimit, l.maxLimit)
+}
+
+// GradientLimiter compares each sample against a long-term latency average
+// and scales the limit by the ratio, leaving headroom for a small queue.
+type GradientLimiter struct {
+	mu         sync.Mutex
+	limit      float64
+	minLimit   int
+	maxLimit   int
+	longRTT    float64
+	tolerance  float64
+	smoothing  float64
+	longWindow float64
+}
+
+var _ ConcurrencyLimiter = (*GradientLimiter)(nil)
+
+func NewGradientLimiter(minLimit int, maxLimit int, initialLimit int) (*GradientLimiter, error) {
+	if err := validateLimitBounds(minLimit, maxLimit, initialLimit); err != nil {
+		return nil, err
+	}
+
+	return &GradientLimiter{
+		limit:      float64(initialLimit),
+		minLimit:   minLimit,
+		maxLimit:   maxLimit,
+		tolerance:  1.5,
+		smoothing:  0.2,
+		longWindow: 600,
+	}, nil
+}
+
+func (l *GradientLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+func (l *GradientLimiter) MaxLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxLimit
+}
+
+// SetMaxLimit moves the ceiling, as AIMDLimiter.SetMaxLimit does.
+func (l *GradientLimiter) SetMaxLimit(maxLimit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxLimit = max(l.minLimit, maxLimit)
+	l.limit = clampLimit(l.limit, l.minLimit, l.maxLimit)
+}
+
+func (l *GradientLimiter) OnSample(latency time.Duration, inFlight int, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rtt := float64(latency)
+	if rtt <= 0 {
+		return
+	}
+
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	} else {
+		l.longRTT += (rtt - l.longRTT) * 2 / (l.longWindow + 1)
+	}
+
+	gradient := math.Max(0.5, math.Min(1.0, l.tolerance*l.longRTT/rtt))
+	if failed {
+		gradient = 0.5
+	}
+
+	// Don't grow the limit if the backend isn't being pushed
+	if gradient == 1.0 && float64(inFlight) < l.limit/2 {
+		return
+	}
+
+	queueSize := math.Sqrt(l.limit)
+	newLimit := l.limit*gradient + queueSize
+	l.limit = clampLimit(l.limit*(1-l.smoothing)+newLimit*l.smoothing, l.minLimit, l.maxLimit)
+}
+
+func validateLimitBounds(minLimit int, maxLimit int, initialLimit int) error {
+	if minLimit < 1 || maxLimit < minLimit {
+		return fmt.Errorf("%w: min %d, max %d", ErrInvalidLimitBounds, minLimit, maxLimit)
+	}
+
+	if initialLimit < minLimit || initialLimit > maxLimit {
+		return fmt.Errorf("%w: initial %d outside [%d, %d]", ErrInvalidLimitBounds, initialLimit, minLimit, maxLimit)
+	}
+	return nil
+}
+
+func clampLimit(limit float64, minLimit int, maxLimit int) float64 {
+	return math.Max(float64(minLimit), math.Min(float64(maxLimit), limit))
+}
@@ -0,0 +1,225 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const requestAttributesKey contextKey = "request_attributes"
+
+var ErrInvalidTrustedProxy = errors.New("invalid trusted proxy")
+
+// RequestAttributes is what strategies and routing get to see of the client
+// request. It is built once per request and travels in the context.
+type RequestAttributes struct {
+	ClientIP   string
+	ClientPort int // 0 when ClientIP came from X-Forwarded-For
+	Host       string
+	Path       string
+	Method     string
+	Headers    http.Header
+	Cookies    []*http.Cookie
+	Identity   *ClientIdentity // nil without a verified client certificate
+}
+
+func NewRequestAttributes(req *http.Request, proxies *TrustedProxies) *RequestAttributes {
+	clientIP := proxies.ClientIP(req)
+
+	var clientPort int
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil && host == clientIP {
+		clientPort, _ = strconv.Atoi(port)
+	}
+
+	return &RequestAttributes{
+		ClientIP:   clientIP,
+		ClientPort: clientPort,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Method:     req.Method,
+		Headers:    req.Header.Clone(),
+		Cookies:    req.Cookies(),
+		Identity:   clientIdentity(req),
+	}
+}
+
+// ClientIdentity is who a verified client certificate says the client is.
+type ClientIdentity struct {
+	CommonName string
+	URIs       []string // SAN URIs, such as SPIFFE IDs
+	DNSNames   []string
+}
+
+func clientIdentity(req *http.Request) *ClientIdentity {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	identity := &ClientIdentity{
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+// Matches reports whether the common name, a SAN URI or a SAN DNS name
+// matches pattern. A trailing * matches any suffix, so
+// "spiffe://example.org/*" takes a whole trust domain.
+func (i *ClientIdentity) Matches(pattern string) bool {
+	if i == nil {
+		return false
+	}
+
+	match := func(name string) bool { return name == pattern }
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		match = func(name string) bool { return strings.HasPrefix(name, prefix) }
+	}
+
+	if i.CommonName != "" && match(i.CommonName) {
+		return true
+	}
+
+	for _, name := range slices.Concat(i.URIs, i.DNSNames) {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ClientIdentity) MatchesAny(patterns []string) bool {
+	for _, pattern := range patterns {
+		if i.Matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *RequestAttributes) Cookie(name string) (*http.Cookie, bool) {
+	for _, cookie := range a.Cookies {
+		if cookie.Name == name {
+			return cookie, true
+		}
+	}
+	return nil, false
+}
+
+// WithRequestAttributes stores the attributes in ctx, and sets ClientIPKey
+// for code that only needs the client IP.
+func WithRequestAttributes(ctx context.Context, attrs *RequestAttributes) context.Context {
+	ctx = context.WithValue(ctx, requestAttributesKey, attrs)
+	if attrs.ClientIP != "" {
+		ctx = context.WithValue(ctx, ClientIPKey, attrs.ClientIP)
+	}
+	return ctx
+}
+
+func RequestAttributesFrom(ctx context.Context) (*RequestAttributes, bool) {
+	attrs, ok := ctx.Value(requestAttributesKey).(*RequestAttributes)
+	return attrs, ok
+}
+
+// TrustedProxies lists the networks whose X-Forwarded-For entries are
+// believed. It is safe to replace the list while requests are in flight.
+type TrustedProxies struct {
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	t := &TrustedProxies{}
+	if err := t.Set(cidrs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Set takes CIDRs or bare IPs.
+func (t *TrustedProxies) Set(cidrs []string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("%w: %q", ErrInvalidTrustedProxy, cidr)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidTrustedProxy, cidr)
+		}
+		nets = append(nets, network)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nets = nets
+	return nil
+}
+
+func (t *TrustedProxies) Trusts(addr string) bool {
+	if t == nil {
+		return false
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, network := range t.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the peer address, unless the peer is a trusted proxy. Then
+// X-Forwarded-For is walked from the right, and the first address that
+// isn't a trusted proxy is the client.
+func (t *TrustedProxies) ClientIP(req *http.Request) string {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+
+	if !t.Trusts(client) {
+		return client
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" || net.ParseIP(hop) == nil {
+			break
+		}
+
+		client = hop
+		if !t.Trusts(hop) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,309 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+)
+
+const maxHealthResponseBytes = 4096
+
+var (
+	ErrInvalidHealthInterval = errors.New("invalid health check interval: duration must be positive")
+	ErrInvalidHealthTimeout  = errors.New("invalid health check timeout: duration must be positive")
+)
+
+// HealthCheckConfig configures probes. With GRPC set servers are checked
+// with grpc.health.v1 over HTTP/2, for Service, instead of a GET of Path.
+// Probes use TLS when it is set, and open with a PROXY header of
+// ProxyProtocol's version when that is, so they reach servers the same way
+// proxied requests do.
+type HealthCheckConfig struct {
+	Path               string
+	GRPC               bool
+	Service            string
+	TLS                *tls.Config
+	ProxyProtocol      string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+// ProbeFunc checks a single server, returning nil if it is healthy.
+type ProbeFunc func(ctx context.Context, server Server) error
+
+type HealthChecker struct {
+	lb      LoadBalancer
+	config  HealthCheckConfig
+	probe   ProbeFunc
+	mu      sync.Mutex
+	streaks map[string]int // > 0 consecutive successes, < 0 consecutive failures
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewHealthChecker(lb LoadBalancer, config HealthCheckConfig) (*HealthChecker, error) {
+	if config.Interval <= 0 {
+		return nil, ErrInvalidHealthInterval
+	}
+
+	if config.Timeout <= 0 {
+		return nil, ErrInvalidHealthTimeout
+	}
+
+	if config.Path == "" {
+		config.Path = "/"
+	}
+
+	if config.HealthyThreshold < 1 {
+		config.HealthyThreshold = 1
+	}
+
+	if config.UnhealthyThreshold < 1 {
+		config.UnhealthyThreshold = 1
+	}
+
+	var dialer net.Dialer
+	dial := dialer.DialContext
+	if config.ProxyProtocol != "" {
+		// Probes come from the load balancer itself, so the header
+		// announces no client.
+		header, err := util.ProxyHeader(config.ProxyProtocol, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(header); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+
+	scheme, transport := "http", http.DefaultTransport
+	if config.TLS != nil || config.ProxyProtocol != "" {
+		custom := http.DefaultTransport.(*http.Transport).Clone()
+		if config.TLS != nil {
+			scheme, custom.TLSClientConfig = "https", config.TLS
+		}
+		custom.DialContext = dial
+		transport = custom
+	}
+
+	probe := HTTPProbe(scheme, config.Path, &http.Client{Transport: transport})
+	if config.GRPC {
+		probe = GRPCProbe(scheme, config.Service, &http.Client{Transport: newGRPCTransport(config.TLS, dial)})
+	}
+
+	return &HealthChecker{
+		lb:      lb,
+		config:  config,
+		probe:   probe,
+		streaks: make(map[string]int),
+	}, nil
+}
+
+func (h *HealthChecker) SetProbe(probe ProbeFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probe = probe
+}
+
+func (h *HealthChecker) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+
+	go h.run(h.stop, h.done)
+}
+
+func (h *HealthChecker) Stop() {
+	h.mu.Lock()
+	stop, done := h.stop, h.done
+	h.stop, h.done = nil, nil
+	h.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (h *HealthChecker) run(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	h.CheckAll()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.CheckAll()
+		}
+	}
+}
+
+// CheckAll probes every server once, concurrently, and flips server status
+// once a streak reaches the configured threshold.
+func (h *HealthChecker) CheckAll() {
+	h.mu.Lock()
+	probe := h.probe
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, server := range h.lb.GetServers() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+			defer cancel()
+
+			h.record(server, probe(ctx, server))
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *HealthChecker) record(server Server, err error) {
+	instance := InstanceOf(server)
+
+	h.mu.Lock()
+	streak := h.streaks[instance.ID]
+	if err == nil {
+		streak = max(streak, 0) + 1
+	} else {
+		streak = min(streak, 0) - 1
+	}
+	h.streaks[instance.ID] = streak
+	h.mu.Unlock()
+
+	active := instance.IsActive()
+	if !active && streak >= h.config.HealthyThreshold {
+		log.Printf("health check: server %s is healthy", instance.ID)
+		h.lb.SetServerStatus(instance.ID, true)
+	} else if active && -streak >= h.config.UnhealthyThreshold {
+		log.Printf("health check: server %s is unhealthy: %v", instance.ID, err)
+		h.lb.SetServerStatus(instance.ID, false)
+	}
+}
+
+func HTTPProbe(scheme string, path string, client *http.Client) ProbeFunc {
+	return func(ctx context.Context, server Server) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", scheme, server.GetHostPort(), path), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// GRPCProbe calls grpc.health.v1.Health/Check, treating anything but
+// SERVING as unhealthy.
+func GRPCProbe(scheme string, service string, client *http.Client) ProbeFunc {
+	return func(ctx context.Context, server Server) error {
+		var body bytes.Buffer
+		util.WriteGRPCFrame(&body, util.EncodeHealthCheckRequest(service))
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s/grpc.health.v1.Health/Check", scheme, server.GetHostPort()), &body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", util.GRPCContentType)
+		req.Header.Set("Te", "trailers")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		msg, readErr := util.ReadGRPCFrame(resp.Body, maxHealthResponseBytes)
+		io.Copy(io.Discard, resp.Body)
+		if code, ok := util.GRPCStatus(resp.Header, resp.Trailer); ok && code != util.GRPCOK {
+			return fmt.Errorf("unexpected grpc status %d", code)
+		}
+		if readErr != nil {
+			return readErr
+		}
+
+		status, err := util.DecodeHealthCheckResponse(msg)
+		if err != nil {
+			return err
+		}
+
+		if status != util.HealthServing {
+			return fmt.Errorf("service %q is not serving (status %d)", service, status)
+		}
+		return nil
+	}
+}
+
+// newGRPCTransport speaks HTTP/2 over TLS, or h2c without a config, on
+// connections opened by dial.
+func newGRPCTransport(config *tls.Config, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	if config == nil {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+	}
+
+	return &http2.Transport{
+		TLSClientConfig: config,
+		DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
@@ -29,8 +29,9 @@ func (ip *IPHashLoadBalancer) NextServer(ctx context.Context) (Server, error) {
 	if len(ip.servers) == 0 {
 		return nil, ErrNoServerAvailable
 	}
+	ip.refreshPanicMode()
 
-	clientIP, ok := ctx.Value(ClientIPKey).(string)
+	clientIP, ok := clientIPFrom(ctx)
 	if !ok {
 		return nil, ErrNoClientIP
 	}
@@ -41,8 +42,17 @@ func (ip *IPHashLoadBalancer) NextServer(ctx context.Context) (Server, error) {
 
 	selectedServer := ip.servers[hash%uint32(len(ip.servers))].(*ServerInstance)
 
-	if selectedServer.Active && selectedServer.AcquireConnection() {
+	if ip.selectable(selectedServer) && selectedServer.AcquireConnection() {
 		return selectedServer, nil
 	}
 	return nil, ErrServerNotAvailable
 }
+
+func clientIPFrom(ctx context.Context) (string, bool) {
+	if attrs, ok := RequestAttributesFrom(ctx); ok && attrs.ClientIP != "" {
+		return attrs.ClientIP, true
+	}
+
+	clientIP, ok := ctx.Value(ClientIPKey).(string)
+	return clientIP, ok
+}
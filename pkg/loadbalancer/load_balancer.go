@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"sync"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
 )
 
 type LoadBalancer interface {
@@ -14,6 +17,10 @@ type LoadBalancer interface {
 	SetServerStatus(serverID string, active bool) error
 	GetServers() []Server
 	UpdateServerMaxConn(serverID string, maxConn int) error
+	UpdateServerWeight(serverID string, weight int) error
+	SetPanicThreshold(threshold float64) error
+	PanicThreshold() float64
+	InPanicMode() bool
 	// UpdateServerMetrics(serverID string) error
 	// HealthCheck() error
 }
@@ -26,11 +33,30 @@ var (
 	ErrBadServerInterface  = errors.New("server is not a valid interface")
 )
 
+var ErrServerNotWeighted = errors.New("server does not have a weight")
+
+var ErrInvalidPanicThreshold = errors.New("invalid panic threshold (must be between 0 and 1 inclusive)")
+
 type contextKey string
 
 type BaseLoadBalancer struct {
 	servers []Server
 	*sync.RWMutex
+	pool           string // set by NewPool, for logs and metrics
+	panicThreshold float64
+	panicking      bool
+}
+
+// poolNamer is a balancer that labels its logs and metrics with the name of
+// the pool it serves.
+type poolNamer interface {
+	setPoolName(name string)
+}
+
+func (b *BaseLoadBalancer) setPoolName(name string) {
+	b.Lock()
+	defer b.Unlock()
+	b.pool = name
 }
 
 func NewBaseLoadBalancer() BaseLoadBalancer {
@@ -64,7 +90,7 @@ func (b *BaseLoadBalancer) RemoveServer(serverID string) error {
 	defer b.Unlock()
 
 	for i, s := range b.servers {
-		if s.(*ServerInstance).ID == serverID {
+		if InstanceOf(s).ID == serverID {
 			b.servers = append(b.servers[:i], b.servers[i+1:]...)
 			return nil
 		}
@@ -90,8 +116,8 @@ func (b *BaseLoadBalancer) SetServerStatus(serverID string, active bool) error {
 	defer b.Unlock()
 
 	for _, s := range b.servers {
-		if s.(*ServerInstance).ID == serverID {
-			s.(*ServerInstance).Active = active
+		if server := InstanceOf(s); server.ID == serverID {
+			server.SetActive(active)
 			return nil
 		}
 	}
@@ -107,27 +133,118 @@ func (b *BaseLoadBalancer) UpdateServerMaxConn(serverID string, maxConn int) err
 	}
 
 	for _, s := range b.servers {
-		fmt.Printf("%s, %s\n", s.(*ServerInstance).ID, serverID)
-		if s.(*ServerInstance).ID == serverID {
-			s.(*ServerInstance).MaxConns = maxConn
-			close(s.(*ServerInstance).connections)
-			newChan := resizeChannel(s.(*ServerInstance).connections, maxConn)
-			s.(*ServerInstance).connections = newChan
-			return nil
+		if server := InstanceOf(s); server.ID == serverID {
+			return server.SetMaxConns(maxConn)
 		}
 	}
 
 	return ErrServerNotFound
 }
 
-func resizeChannel(oldChan <-chan struct{}, newChanSize int) chan struct{} {
-	newChan := make(chan struct{}, newChanSize)
+// UpdateServerWeight changes a weighted server's weight in place, so the
+// cycle position of every other server is preserved.
+func (b *BaseLoadBalancer) UpdateServerWeight(serverID string, weight int) error {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, s := range b.servers {
+		if InstanceOf(s).ID != serverID {
+			continue
+		}
+
+		weighted, ok := s.(*WeightedServerInstance)
+		if !ok {
+			return ErrServerNotWeighted
+		}
+		return weighted.SetWeight(weight)
+	}
+
+	return ErrServerNotFound
+}
+
+// ValidatePanicThreshold reports whether SetPanicThreshold would accept the
+// threshold.
+func ValidatePanicThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return fmt.Errorf("%w: %v", ErrInvalidPanicThreshold, threshold)
+	}
+	return nil
+}
+
+func (b *BaseLoadBalancer) SetPanicThreshold(threshold float64) error {
+	if err := ValidatePanicThreshold(threshold); err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.panicThreshold = threshold
+	return nil
+}
+
+func (b *BaseLoadBalancer) PanicThreshold() float64 {
+	b.RLock()
+	defer b.RUnlock()
+	return b.panicThreshold
+}
 
-	go func() {
-		for val := range oldChan {
-			newChan <- val
+func (b *BaseLoadBalancer) InPanicMode() bool {
+	b.RLock()
+	defer b.RUnlock()
+	return b.panicking
+}
+
+// refreshPanicMode re-evaluates the healthy fraction of the pool before a
+// selection, where ejected servers don't count as healthy. A threshold of 0
+// disables panic mode. Callers must hold the lock.
+func (b *BaseLoadBalancer) refreshPanicMode() {
+	healthy := 0
+	for _, s := range b.servers {
+		if InstanceOf(s).IsAvailable() {
+			healthy++
 		}
-	}()
+	}
+
+	panicking := b.panicThreshold > 0 && len(b.servers) > 0 &&
+		float64(healthy)/float64(len(b.servers)) < b.panicThreshold
 
-	return newChan
+	if panicking && !b.panicking {
+		log.Printf("pool %s entering panic mode: %d/%d servers healthy (threshold %.2f)", b.pool, healthy, len(b.servers), b.panicThreshold)
+		metrics.GetCounter(fmt.Sprintf("loadbalancer_panic_mode_entered_total{pool=%q}", b.pool)).Inc()
+	} else if !panicking && b.panicking {
+		log.Printf("pool %s leaving panic mode: %d/%d servers healthy (threshold %.2f)", b.pool, healthy, len(b.servers), b.panicThreshold)
+		metrics.GetCounter(fmt.Sprintf("loadbalancer_panic_mode_exited_total{pool=%q}", b.pool)).Inc()
+	}
+	b.panicking = panicking
+}
+
+// selectable reports whether a strategy may route to the server. In panic
+// mode health status and ejections are ignored. Callers must hold the lock.
+func (b *BaseLoadBalancer) selectable(srv Server) bool {
+	return b.panicking || InstanceOf(srv).IsAvailable()
+}
+
+// selectableChecker is a balancer that can tell wrappers such as sticky
+// sessions whether it would route to a server right now.
+type selectableChecker interface {
+	isSelectable(srv Server) bool
+}
+
+func (b *BaseLoadBalancer) isSelectable(srv Server) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refreshPanicMode()
+	return b.selectable(srv)
+}
+
+func InstanceOf(srv Server) *ServerInstance {
+	switch s := srv.(type) {
+	case *ServerInstance:
+		return s
+	case *WeightedServerInstance:
+		return &s.ServerInstance
+	}
+	return nil
 }
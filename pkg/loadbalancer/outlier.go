@@ -0,0 +1,161 @@
+package loadbalancer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
+)
+
+var ErrInvalidOutlierConfig = errors.New("invalid outlier detection config")
+
+// OutlierConfig ejects a server once ConsecutiveFailures requests in a row
+// have failed. It is let back in after BaseEjectionTime times the number of
+// times in a row it has been ejected, up to MaxEjectionTime. A server that
+// stays in for MaxEjectionTime starts again from BaseEjectionTime.
+type OutlierConfig struct {
+	ConsecutiveFailures int
+	BaseEjectionTime    time.Duration
+	MaxEjectionTime     time.Duration
+}
+
+// OutlierDetector ejects servers that keep failing real traffic, alongside
+// the active HealthChecker. Ejection is kept apart from the health status,
+// so neither undoes the other. It won't eject a server while the pool is in
+// panic mode, when that would put the pool in panic mode, or when it is the
+// last available one, since the ejection would then be ignored or leave
+// nothing to route to.
+type OutlierDetector struct {
+	lb      LoadBalancer
+	pool    string
+	config  OutlierConfig
+	mu      sync.Mutex
+	servers map[string]*outlierServer
+	stopped bool
+}
+
+type outlierServer struct {
+	failures     int
+	ejections    int       // in a row, scaling the ejection time
+	ejectedUntil time.Time // when the last ejection ends
+}
+
+func NewOutlierDetector(pool *Pool, config OutlierConfig) (*OutlierDetector, error) {
+	if config.ConsecutiveFailures < 1 {
+		return nil, fmt.Errorf("%w: consecutive failures %d must be positive", ErrInvalidOutlierConfig, config.ConsecutiveFailures)
+	}
+
+	if config.BaseEjectionTime <= 0 || config.MaxEjectionTime < config.BaseEjectionTime {
+		return nil, fmt.Errorf("%w: ejection times %v to %v", ErrInvalidOutlierConfig, config.BaseEjectionTime, config.MaxEjectionTime)
+	}
+
+	return &OutlierDetector{
+		lb:      pool,
+		pool:    pool.Name,
+		config:  config,
+		servers: make(map[string]*outlierServer),
+	}, nil
+}
+
+func (d *OutlierDetector) Config() OutlierConfig {
+	return d.config
+}
+
+// Observe records the outcome of a request to a server. It is a no-op on a
+// nil detector, so callers needn't check whether a pool has one.
+func (d *OutlierDetector) Observe(server Server, failed bool) {
+	if d == nil {
+		return
+	}
+	d.observe(InstanceOf(server), failed)
+}
+
+// ObserveAddr is Observe for callers that only know the server's address,
+// such as a dialer.
+func (d *OutlierDetector) ObserveAddr(addr string, failed bool) {
+	if d == nil {
+		return
+	}
+
+	for _, server := range d.lb.GetServers() {
+		if server.GetHostPort() == addr {
+			d.observe(InstanceOf(server), failed)
+		}
+	}
+}
+
+func (d *OutlierDetector) observe(instance *ServerInstance, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	server, ok := d.servers[instance.ID]
+	if !ok {
+		server = &outlierServer{}
+		d.servers[instance.ID] = server
+	}
+
+	// Requests still in flight when the server was ejected don't count.
+	now := time.Now()
+	if d.stopped || now.Before(server.ejectedUntil) {
+		return
+	}
+
+	if !failed {
+		server.failures = 0
+		return
+	}
+
+	server.failures++
+	if server.failures < d.config.ConsecutiveFailures || !d.canEject(instance) {
+		return
+	}
+	server.failures = 0
+
+	if !server.ejectedUntil.IsZero() && now.Sub(server.ejectedUntil) >= d.config.MaxEjectionTime {
+		server.ejections = 0
+	}
+	server.ejections++
+	ejection := min(d.config.MaxEjectionTime, time.Duration(server.ejections)*d.config.BaseEjectionTime)
+
+	server.ejectedUntil = now.Add(ejection)
+	instance.Eject(server.ejectedUntil)
+	log.Printf("outlier detection: ejecting server %s from pool %s for %v after %d consecutive failures", instance.ID, d.pool, ejection, d.config.ConsecutiveFailures)
+	metrics.GetCounter(fmt.Sprintf("loadbalancer_outlier_ejections_total{pool=%q,server=%q}", d.pool, instance.ID)).Inc()
+}
+
+// canEject reports whether taking the server out leaves enough available
+// servers behind to stay out of panic mode. Callers must hold the lock.
+func (d *OutlierDetector) canEject(instance *ServerInstance) bool {
+	if d.lb.InPanicMode() || !instance.IsAvailable() {
+		return false
+	}
+
+	servers := d.lb.GetServers()
+	available := 0
+	for _, server := range servers {
+		if InstanceOf(server).IsAvailable() {
+			available++
+		}
+	}
+
+	remaining := available - 1
+	return remaining > 0 && float64(remaining)/float64(len(servers)) >= d.lb.PanicThreshold()
+}
+
+// Stop lets the servers it ejected back in, so replacing or removing the
+// detector doesn't strand them.
+func (d *OutlierDetector) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	for _, server := range d.lb.GetServers() {
+		instance := InstanceOf(server)
+		if state, ok := d.servers[instance.ID]; ok && time.Now().Before(state.ejectedUntil) {
+			instance.Eject(time.Time{})
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package loadbalancer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrPoolAlreadyExists = errors.New("pool already exists")
+	ErrPoolNotFound      = errors.New("pool not found")
+)
+
+type Pool struct {
+	Name           string
+	Strategy       string
+	HealthSettings string // what the health checker was built from, compared on reload
+	LoadBalancer
+	mu       sync.Mutex
+	health   *HealthChecker
+	outliers *OutlierDetector
+	running  bool
+}
+
+type PoolStatus struct {
+	Name      string         `json:"name"`
+	Strategy  string         `json:"strategy,omitempty"`
+	PanicMode bool           `json:"panic_mode"`
+	Healthy   int            `json:"healthy"`
+	Total     int            `json:"total"`
+	Servers   []ServerStatus `json:"servers"`
+}
+
+func NewPool(name string, lb LoadBalancer) (*Pool, error) {
+	if len(name) < 1 || len(name) > 64 {
+		return nil, ErrInvalidServerNameLength
+	}
+
+	if !serverNameRegex.MatchString(name) {
+		return nil, ErrInvalidCharInServerName
+	}
+
+	if named, ok := lb.(poolNamer); ok {
+		named.setPoolName(name)
+	}
+
+	return &Pool{
+		Name:         name,
+		LoadBalancer: lb,
+	}, nil
+}
+
+// SetHealthChecker attaches an active health checker, replacing any previous
+// one. It runs for as long as the pool is registered with a PoolManager.
+func (p *Pool) SetHealthChecker(health *HealthChecker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.health != nil && p.running {
+		p.health.Stop()
+	}
+
+	p.health = health
+	if p.health != nil && p.running {
+		p.health.Start()
+	}
+}
+
+// SetOutlierDetector attaches passive outlier detection, replacing and
+// stopping any previous detector.
+func (p *Pool) SetOutlierDetector(outliers *OutlierDetector) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.outliers != nil && p.outliers != outliers {
+		p.outliers.Stop()
+	}
+	p.outliers = outliers
+}
+
+// OutlierDetector returns the pool's detector, nil without one.
+func (p *Pool) OutlierDetector() *OutlierDetector {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.outliers
+}
+
+func (p *Pool) HealthChecker() *HealthChecker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+func (p *Pool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = true
+	if p.health != nil {
+		p.health.Start()
+	}
+}
+
+func (p *Pool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = false
+	if p.health != nil {
+		p.health.Stop()
+	}
+	if p.outliers != nil {
+		p.outliers.Stop()
+	}
+}
+
+func (p *Pool) Status() PoolStatus {
+	servers := p.GetServers()
+	status := PoolStatus{
+		Name:      p.Name,
+		Strategy:  p.Strategy,
+		PanicMode: p.InPanicMode(),
+		Total:     len(servers),
+		Servers:   make([]ServerStatus, 0, len(servers)),
+	}
+
+	for _, server := range servers {
+		serverStatus := server.Status()
+		if serverStatus.Active && !serverStatus.Ejected {
+			status.Healthy++
+		}
+		status.Servers = append(status.Servers, serverStatus)
+	}
+	return status
+}
+
+type PoolManager struct {
+	mu    sync.RWMutex
+	pools map[string]*Pool
+}
+
+func NewPoolManager() *PoolManager {
+	return &PoolManager{
+		pools: make(map[string]*Pool),
+	}
+}
+
+func (m *PoolManager) AddPool(pool *Pool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.pools[pool.Name]; ok {
+		return ErrPoolAlreadyExists
+	}
+
+	m.pools[pool.Name] = pool
+	pool.start()
+	return nil
+}
+
+func (m *PoolManager) RemovePool(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pool, ok := m.pools[name]
+	if !ok {
+		return ErrPoolNotFound
+	}
+
+	delete(m.pools, name)
+	pool.stop()
+	return nil
+}
+
+func (m *PoolManager) GetPool(name string) (*Pool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pool, ok := m.pools[name]
+	if !ok {
+		return nil, ErrPoolNotFound
+	}
+	return pool, nil
+}
+
+func (m *PoolManager) GetPools() []*Pool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pools := make([]*Pool, 0, len(m.pools))
+	for _, pool := range m.pools {
+		pools = append(pools, pool)
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
+
+func (m *PoolManager) Status() []PoolStatus {
+	pools := m.GetPools()
+	statuses := make([]PoolStatus, 0, len(pools))
+	for _, pool := range pools {
+		statuses = append(statuses, pool.Status())
+	}
+	return statuses
+}
@@ -28,11 +28,12 @@ func (r *RandomLoadBalancer) NextServer(ctx context.Context) (Server, error) {
 	if len(r.servers) == 0 {
 		return nil, ErrNoServerAvailable
 	}
+	r.refreshPanicMode()
 
 	for i := 0; i < r.attempts; i++ {
 		selectedServer := r.servers[r.random.IntN(len(r.servers))].(*ServerInstance)
 
-		if selectedServer.Active && selectedServer.AcquireConnection() {
+		if r.selectable(selectedServer) && selectedServer.AcquireConnection() {
 			return selectedServer, nil
 		}
 	}
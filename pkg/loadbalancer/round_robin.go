@@ -23,12 +23,13 @@ func (rr *RoundRobinLoadBalancer) NextServer(ctx context.Context) (Server, error
 	if len(rr.servers) == 0 {
 		return nil, ErrNoServerAvailable
 	}
+	rr.refreshPanicMode()
 
 	startIndex := rr.current
 	for i := 0; i < len(rr.servers); i++ {
 		currentIndex := (startIndex + i) % len(rr.servers)
 		server, _ := rr.servers[currentIndex].(*ServerInstance)
-		if server.Active && server.AcquireConnection() {
+		if rr.selectable(server) && server.AcquireConnection() {
 			rr.current = (currentIndex + 1) % len(rr.servers)
 			return server, nil
 		}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"sync"
+	"time"
 )
 
 var (
@@ -13,6 +15,7 @@ var (
 	ErrInvalidIP               = errors.New("Invalid IP address")
 	ErrInvalidPort             = errors.New("Invalid port number")
 	ErrInvalidMaxConns         = errors.New("Invalid max connections")
+	ErrInvalidMaxUpgraded      = errors.New("Invalid max upgraded connections")
 
 	serverNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
 )
@@ -21,15 +24,42 @@ type Server interface {
 	GetHostPort() string
 	AcquireConnection() bool
 	ReleaseConnection()
+	ObserveResult(latency time.Duration, failed bool)
+	Status() ServerStatus
 }
 
 type ServerInstance struct {
-	ID          string
-	Host        string
-	Port        int
-	Active      bool
-	MaxConns    int
-	connections chan struct{}
+	ID           string
+	Host         string
+	Port         int
+	Active       bool // guarded by mu, use IsActive and SetActive
+	MaxConns     int
+	MaxUpgraded  int         // cap on upgraded connections, 0 for none
+	mu           *sync.Mutex // guards Active, ejectedUntil, connections, MaxConns updates and limiter
+	ejectedUntil time.Time   // set by outlier detection, apart from Active
+	connections  int         // in-flight requests, which are streams on multiplexed backends
+	upgraded     int
+	multiplexed  bool
+	limiter      ConcurrencyLimiter
+}
+
+// ServerStatus is a snapshot of a server. Connections and Streams both count
+// the requests in flight to it, not sockets: on a multiplexed backend they
+// are reported as Streams, the request concurrency across all of its HTTP/2
+// connections, and Connections is left at 0 since the load balancer doesn't
+// see how many connections carry them.
+type ServerStatus struct {
+	ID               string `json:"id"`
+	Address          string `json:"address"`
+	Active           bool   `json:"active"`
+	Ejected          bool   `json:"ejected,omitempty"`
+	MaxConns         int    `json:"max_conns"`
+	ConcurrencyLimit int    `json:"concurrency_limit"`
+	Connections      int    `json:"connections"`       // in-flight requests, 0 when multiplexed
+	Streams          int    `json:"streams,omitempty"` // in-flight requests when multiplexed
+	MaxUpgraded      int    `json:"max_upgraded,omitempty"`
+	Upgraded         int    `json:"upgraded_connections"`
+	Weight           int    `json:"weight,omitempty"`
 }
 
 var _ Server = (*ServerInstance)(nil)
@@ -58,12 +88,12 @@ func NewServerInstance(id string, host string, port int, maxConns int) (*ServerI
 	}
 
 	return &ServerInstance{
-		ID:          id,
-		Host:        host,
-		Port:        port,
-		Active:      true,
-		MaxConns:    maxConns,
-		connections: make(chan struct{}, maxConns),
+		ID:       id,
+		Host:     host,
+		Port:     port,
+		Active:   true,
+		MaxConns: maxConns,
+		mu:       &sync.Mutex{},
 	}, nil
 }
 
@@ -71,24 +101,179 @@ func (s *ServerInstance) GetHostPort() string {
 	return fmt.Sprintf("%s:%d", s.Host, s.Port)
 }
 
+func (s *ServerInstance) IsActive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Active
+}
+
+// SetActive marks the server healthy or not. Load balancers should be told
+// through SetServerStatus instead, so a pool's panic mode sees the change.
+func (s *ServerInstance) SetActive(active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Active = active
+}
+
+// Eject keeps the server out of selection until the given time, the zero
+// time letting it back in. It is kept apart from the health status, so
+// outlier detection and health checks don't undo each other.
+func (s *ServerInstance) Eject(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ejectedUntil = until
+}
+
+func (s *ServerInstance) IsEjected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.ejectedUntil)
+}
+
+// IsAvailable reports whether the server is healthy and not ejected.
+func (s *ServerInstance) IsAvailable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Active && !time.Now().Before(s.ejectedUntil)
+}
+
+// AcquireConnection admits a request only while the in-flight count is
+// below the live limit. Lowering the limit never evicts in-flight requests;
+// new ones are refused until enough of them have been released.
 func (s *ServerInstance) AcquireConnection() bool {
-	success := false
-	select {
-	case s.connections <- struct{}{}:
-		success = true
-	default:
-		success = false
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connections >= s.concurrencyLimit() {
+		return false
 	}
-	return success
+	s.connections++
+	return true
 }
 
 func (s *ServerInstance) ReleaseConnection() {
-	select {
-	case <-s.connections:
-	default:
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connections > 0 {
+		s.connections--
 	}
 }
 
 func (s *ServerInstance) GetConnectionAmount() int {
-	return len(s.connections)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// SetMaxConns changes the server's connection cap. An adaptive limiter
+// whose maximum was the old cap follows it, so raising MaxConns gives the
+// limiter room to grow.
+func (s *ServerInstance) SetMaxConns(maxConns int) error {
+	if maxConns < 1 {
+		return fmt.Errorf("%w: %d", ErrInvalidMaxConns, maxConns)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.limiter != nil && s.limiter.MaxLimit() == s.MaxConns {
+		s.limiter.SetMaxLimit(maxConns)
+	}
+	s.MaxConns = maxConns
+	return nil
+}
+
+// AcquireUpgraded admits a long-lived upgraded connection, such as a
+// WebSocket. These are counted apart from MaxConns so they can't starve
+// ordinary requests.
+func (s *ServerInstance) AcquireUpgraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MaxUpgraded > 0 && s.upgraded >= s.MaxUpgraded {
+		return false
+	}
+	s.upgraded++
+	return true
+}
+
+func (s *ServerInstance) ReleaseUpgraded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.upgraded > 0 {
+		s.upgraded--
+	}
+}
+
+func (s *ServerInstance) SetMaxUpgraded(maxUpgraded int) error {
+	if maxUpgraded < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidMaxUpgraded, maxUpgraded)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.MaxUpgraded = maxUpgraded
+	return nil
+}
+
+// SetMultiplexed marks the server as speaking HTTP/2, where MaxConns caps
+// concurrent streams rather than TCP connections.
+func (s *ServerInstance) SetMultiplexed(multiplexed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.multiplexed = multiplexed
+}
+
+func (s *ServerInstance) SetConcurrencyLimiter(limiter ConcurrencyLimiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limiter = limiter
+}
+
+// ConcurrencyLimit is the live in-flight cap: MaxConns, lowered by the
+// adaptive limiter when one is configured.
+func (s *ServerInstance) ConcurrencyLimit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.concurrencyLimit()
+}
+
+func (s *ServerInstance) concurrencyLimit() int {
+	if s.limiter == nil {
+		return s.MaxConns
+	}
+	return min(s.MaxConns, s.limiter.Limit())
+}
+
+func (s *ServerInstance) ObserveResult(latency time.Duration, failed bool) {
+	s.mu.Lock()
+	limiter, inFlight := s.limiter, s.connections
+	s.mu.Unlock()
+
+	if limiter != nil {
+		limiter.OnSample(latency, inFlight, failed)
+	}
+}
+
+func (s *ServerInstance) Status() ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ServerStatus{
+		ID:               s.ID,
+		Address:          s.GetHostPort(),
+		Active:           s.Active,
+		Ejected:          time.Now().Before(s.ejectedUntil),
+		MaxConns:         s.MaxConns,
+		ConcurrencyLimit: s.concurrencyLimit(),
+		Connections:      s.connections,
+		MaxUpgraded:      s.MaxUpgraded,
+		Upgraded:         s.upgraded,
+	}
+
+	if s.multiplexed {
+		status.Connections, status.Streams = 0, s.connections
+	}
+	return status
 }
@@ -0,0 +1,190 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMissingStickySecret = errors.New("sticky sessions require a signing secret")
+	ErrInvalidStickyCookie = errors.New("invalid sticky session cookie")
+)
+
+type StickySessionConfig struct {
+	CookieName  string
+	Path        string
+	Secure      bool
+	HttpOnly    bool
+	SameSite    http.SameSite
+	TTL         time.Duration // cookie lifetime, 0 for a browser session cookie
+	IdleTimeout time.Duration // sessions unused for longer are rebalanced, 0 to disable
+	Secret      []byte
+	Clock       func() time.Time
+}
+
+// RequestSelector is implemented by load balancers that need the HTTP
+// request to pick a server and the response to keep the client on it, e.g.
+// to read and set cookies. Pin is given the server that answered, which
+// retries and hedging may have changed from the one selected.
+type RequestSelector interface {
+	SelectServer(ctx context.Context, req *http.Request) (Server, error)
+	Pin(header http.Header, server Server)
+}
+
+type StickySessionLoadBalancer struct {
+	LoadBalancer
+	config StickySessionConfig
+}
+
+var (
+	_ LoadBalancer    = (*StickySessionLoadBalancer)(nil)
+	_ RequestSelector = (*StickySessionLoadBalancer)(nil)
+)
+
+// selectable applies the wrapped strategy's own check, so a pinned server is
+// only used when the strategy could pick it too, panic mode included.
+func (s *StickySessionLoadBalancer) selectable(server Server) bool {
+	if checker, ok := s.LoadBalancer.(selectableChecker); ok {
+		return checker.isSelectable(server)
+	}
+	return InstanceOf(server).IsAvailable()
+}
+
+func (s *StickySessionLoadBalancer) setPoolName(name string) {
+	if named, ok := s.LoadBalancer.(poolNamer); ok {
+		named.setPoolName(name)
+	}
+}
+
+func NewStickySessionLoadBalancer(lb LoadBalancer, config StickySessionConfig) (*StickySessionLoadBalancer, error) {
+	if len(config.Secret) == 0 {
+		return nil, ErrMissingStickySecret
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = "goobernetes_session"
+	}
+
+	if config.Path == "" {
+		config.Path = "/"
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	return &StickySessionLoadBalancer{
+		LoadBalancer: lb,
+		config:       config,
+	}, nil
+}
+
+func (s *StickySessionLoadBalancer) SelectServer(ctx context.Context, req *http.Request) (Server, error) {
+	if server := s.pinnedServer(ctx, req); server != nil {
+		return server, nil
+	}
+	return s.NextServer(ctx)
+}
+
+// Pin sets the session cookie naming server, refreshing its last seen time.
+func (s *StickySessionLoadBalancer) Pin(header http.Header, server Server) {
+	cookie := &http.Cookie{
+		Name:     s.config.CookieName,
+		Value:    s.cookieValue(InstanceOf(server).ID, s.config.Clock()),
+		Path:     s.config.Path,
+		Secure:   s.config.Secure,
+		HttpOnly: s.config.HttpOnly,
+		SameSite: s.config.SameSite,
+	}
+
+	if s.config.TTL > 0 {
+		cookie.MaxAge = int(s.config.TTL.Seconds())
+	}
+
+	header.Add("Set-Cookie", cookie.String())
+}
+
+func (s *StickySessionLoadBalancer) sessionCookie(ctx context.Context, req *http.Request) (*http.Cookie, bool) {
+	if attrs, ok := RequestAttributesFrom(ctx); ok {
+		return attrs.Cookie(s.config.CookieName)
+	}
+
+	cookie, err := req.Cookie(s.config.CookieName)
+	return cookie, err == nil
+}
+
+// pinnedServer returns the server named by a valid, unexpired cookie with a
+// connection already acquired, or nil if the client needs a new session.
+func (s *StickySessionLoadBalancer) pinnedServer(ctx context.Context, req *http.Request) Server {
+	cookie, ok := s.sessionCookie(ctx, req)
+	if !ok {
+		return nil
+	}
+
+	serverID, lastSeen, err := s.parseCookieValue(cookie.Value)
+	if err != nil {
+		return nil
+	}
+
+	if s.config.IdleTimeout > 0 && s.config.Clock().Sub(lastSeen) > s.config.IdleTimeout {
+		return nil
+	}
+
+	for _, server := range s.GetServers() {
+		instance := InstanceOf(server)
+		if instance.ID != serverID {
+			continue
+		}
+
+		if s.selectable(server) && server.AcquireConnection() {
+			return server
+		}
+		return nil
+	}
+	return nil
+}
+
+// Cookie values are "<server id>.<last seen unix>.<signature>". Server IDs
+// can't contain dots, so the value splits unambiguously.
+func (s *StickySessionLoadBalancer) cookieValue(serverID string, lastSeen time.Time) string {
+	payload := fmt.Sprintf("%s.%d", serverID, lastSeen.Unix())
+	return payload + "." + s.sign(payload)
+}
+
+func (s *StickySessionLoadBalancer) parseCookieValue(value string) (string, time.Time, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", time.Time{}, ErrInvalidStickyCookie
+	}
+
+	payload, signature := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(payload))) {
+		return "", time.Time{}, ErrInvalidStickyCookie
+	}
+
+	serverID, lastSeenStr, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", time.Time{}, ErrInvalidStickyCookie
+	}
+
+	lastSeen, err := strconv.ParseInt(lastSeenStr, 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrInvalidStickyCookie
+	}
+
+	return serverID, time.Unix(lastSeen, 0), nil
+}
+
+func (s *StickySessionLoadBalancer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.config.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -10,7 +10,7 @@ var ErrInvalidWeight = errors.New("Invalid weight (must be between 1-100 inclusi
 
 type WeightedServerInstance struct {
 	ServerInstance
-	Weight int
+	Weight int // guarded by the instance's mutex once the server is in use
 }
 
 type WeightedRoundRobinLoadBalancer struct {
@@ -66,7 +66,7 @@ func (wrr *WeightedRoundRobinLoadBalancer) SetServerStatus(serverID string, acti
 
 	for _, s := range wrr.servers {
 		if s.(*WeightedServerInstance).ID == serverID {
-			s.(*WeightedServerInstance).Active = active
+			s.(*WeightedServerInstance).SetActive(active)
 			return nil
 		}
 	}
@@ -80,11 +80,17 @@ func (wrr *WeightedRoundRobinLoadBalancer) NextServer(ctx context.Context) (Serv
 	if len(wrr.servers) == 0 {
 		return nil, ErrNoServerAvailable
 	}
+	wrr.refreshPanicMode()
+
+	if wrr.current >= len(wrr.servers) {
+		wrr.current = 0
+		wrr.delivered = 0
+	}
 
 	for i := 0; i < len(wrr.servers); i++ {
 		server := wrr.servers[wrr.current].(*WeightedServerInstance)
-		if server.Active {
-			if wrr.delivered < server.Weight && server.AcquireConnection() {
+		if wrr.selectable(server) {
+			if wrr.delivered < server.GetWeight() && server.AcquireConnection() {
 				wrr.delivered++
 				return server, nil
 			}
@@ -105,8 +111,8 @@ func NewWeightedServerInstance(id string, host string, port int, maxConns int, w
 		return nil, err
 	}
 
-	if weight < 1 || weight > 100 {
-		return nil, fmt.Errorf("%w: %d", ErrInvalidWeight, weight)
+	if err := validateWeight(weight); err != nil {
+		return nil, err
 	}
 
 	return &WeightedServerInstance{
@@ -114,3 +120,34 @@ func NewWeightedServerInstance(id string, host string, port int, maxConns int, w
 		Weight:         weight,
 	}, nil
 }
+
+// SetWeight changes the server's share of the cycle.
+func (s *WeightedServerInstance) SetWeight(weight int) error {
+	if err := validateWeight(weight); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Weight = weight
+	return nil
+}
+
+func (s *WeightedServerInstance) GetWeight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Weight
+}
+
+func (s *WeightedServerInstance) Status() ServerStatus {
+	status := s.ServerInstance.Status()
+	status.Weight = s.GetWeight()
+	return status
+}
+
+func validateWeight(weight int) error {
+	if weight < 1 || weight > 100 {
+		return fmt.Errorf("%w: %d", ErrInvalidWeight, weight)
+	}
+	return nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	lbconfig "github.com/raydatray/goobernetes/pkg/config"
 	"github.com/raydatray/goobernetes/pkg/loadbalancer"
 	"github.com/raydatray/goobernetes/pkg/router"
 	"github.com/raydatray/goobernetes/pkg/servlets"
@@ -14,7 +17,25 @@ import (
 )
 
 type Config struct {
-	Port int
+	Port           int
+	AdminHost      string
+	AdminPort      int
+	ConfigFile     string
+	PanicThreshold float64
+	AdaptiveLimit  string
+	StickySession  bool
+	StickySecret   string
+	TLSCerts       []string
+	TLSKeys        []string
+	TLSMinVersion  string
+	TLSCiphers     []string
+	TLSClientCAs   []string
+	TLSAllow       []string
+	H2C            bool
+	HTTP3          bool
+	MaxStreams     uint32
+	ProxyProtocol  []string
+	GRPC           bool
 }
 
 func main() {
@@ -29,45 +50,85 @@ func main() {
 		Use:   "lb",
 		Short: "start a load balancer instance",
 		Run: func(cmd *cobra.Command, args []string) {
-			lb := loadbalancer.NewRoundRobinLoadBalancer()
+			cfg, err := loadConfig(config)
+			if err != nil {
+				log.Fatalf("invalid configuration: %v", err)
+			}
 
-			server1, _ := loadbalancer.NewServerInstance("mcschool", "192.0.0.1", 8081, 5)
-			server2, _ := loadbalancer.NewServerInstance("g1-home-router", "192.0.0.2", 8082, 5)
-			server3, _ := loadbalancer.NewServerInstance("herroshima", "192.0.0.3", 8083, 5)
+			pools, err := cfg.Build()
+			if err != nil {
+				log.Fatalf("invalid configuration: %v", err)
+			}
 
-			defaultBackends := []*loadbalancer.ServerInstance{
-				server1,
-				server2,
-				server3,
+			routes := router.NewRouteTable()
+			r := router.NewRouter(pools, routes)
+			if err := cfg.ApplyRoutes(r, routes); err != nil {
+				log.Fatalf("invalid configuration: %v", err)
 			}
 
-			for _, server := range defaultBackends {
-				if err := lb.AddServer(server); err != nil {
-					log.Printf("failed to add server: %v", err)
-				}
+			listener, err := listenerConfig(config, cfg)
+			if err != nil {
+				log.Fatalf("invalid configuration: %v", err)
 			}
 
-			r := router.NewRouter(lb)
-			srv := servlets.NewHttpServer(r, config.Port)
+			srv := servlets.NewHttpServer(r, config.Port, r.TrustedProxies(), listener)
+			admin := servlets.NewAdminServer(pools, routes, config.AdminHost, config.AdminPort)
+
+			var proxies []proxyServer
+			for _, tc := range cfg.TCP {
+				proxies = append(proxies, servlets.NewTcpServer(pools, r, tc))
+			}
+			for _, uc := range cfg.UDP {
+				proxies = append(proxies, servlets.NewUdpServer(pools, uc))
+			}
 
 			sigChan := make(chan os.Signal, 1)
-			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-			errChan := make(chan error, 1)
+			errChan := make(chan error, 2+len(proxies))
 			go func() {
 				errChan <- srv.Start()
 			}()
+			go func() {
+				errChan <- admin.Start()
+			}()
+			for _, proxy := range proxies {
+				go func() {
+					errChan <- proxy.Start()
+				}()
+			}
 
-			select {
-			case err := <-errChan:
-				if err != nil {
-					log.Fatalf("server error: %v", err)
-				}
-			case sig := <-sigChan:
-				log.Printf("received signal: %v", sig)
-				if err := srv.Stop(); err != nil {
-					log.Printf("error during shutdown: %v", err)
+			for {
+				select {
+				case err := <-errChan:
+					if err != nil {
+						log.Fatalf("server error: %v", err)
+					}
+				case sig := <-sigChan:
+					if sig == syscall.SIGHUP {
+						reloadConfig(config, cfg, pools, r, routes)
+						continue
+					}
+
+					log.Printf("received signal: %v", sig)
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					if err := r.DrainUpgrades(ctx); err != nil {
+						log.Printf("error draining upgraded connections: %v", err)
+					}
+					cancel()
+					if err := srv.Stop(); err != nil {
+						log.Printf("error during shutdown: %v", err)
+					}
+					if err := admin.Stop(); err != nil {
+						log.Printf("error during shutdown: %v", err)
+					}
+					for _, proxy := range proxies {
+						if err := proxy.Stop(); err != nil {
+							log.Printf("error during shutdown: %v", err)
+						}
+					}
 				}
+				return
 			}
 		},
 	}
@@ -76,7 +137,7 @@ func main() {
 		Use:   "backend",
 		Short: "start a mock backend server instance",
 		Run: func(cmd *cobra.Command, args []string) {
-			srv := servlets.NewBackendServer(config.Port)
+			srv := servlets.NewBackendServer(config.Port, config.GRPC)
 
 			sigChan := make(chan os.Signal, 1)
 			signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -104,6 +165,26 @@ func main() {
 		cmd.Flags().IntVarP(&config.Port, "port", "p", 8080, "port to run the server on")
 	}
 
+	backendCmd.Flags().BoolVar(&config.GRPC, "grpc", false, "serve gRPC over h2c: health checks and an echo for every other method")
+
+	lbCmd.Flags().StringVar(&config.AdminHost, "admin-host", "127.0.0.1", "address to bind the admin API to, empty for all interfaces")
+	lbCmd.Flags().IntVar(&config.AdminPort, "admin-port", 9090, "port to run the admin API on")
+	lbCmd.Flags().StringVarP(&config.ConfigFile, "config", "c", "", "path to a JSON backend config file, reloaded on SIGHUP")
+	lbCmd.Flags().StringVar(&config.AdaptiveLimit, "adaptive-limit", "", "adaptive concurrency limiter per backend (aimd, gradient)")
+	lbCmd.Flags().BoolVar(&config.StickySession, "sticky-sessions", false, "pin clients to a backend with a signed session cookie")
+	lbCmd.Flags().StringVar(&config.StickySecret, "sticky-secret", os.Getenv("GOOBERNETES_STICKY_SECRET"), "secret used to sign sticky session cookies")
+	lbCmd.Flags().StringArrayVar(&config.TLSCerts, "tls-cert", nil, "certificate file to serve HTTPS and HTTP/2 with, repeat for SNI")
+	lbCmd.Flags().StringArrayVar(&config.TLSKeys, "tls-key", nil, "private key file for the --tls-cert in the same position")
+	lbCmd.Flags().StringVar(&config.TLSMinVersion, "tls-min-version", "", "minimum TLS version (1.0, 1.1, 1.2, 1.3; default 1.2)")
+	lbCmd.Flags().StringSliceVar(&config.TLSCiphers, "tls-ciphers", nil, "TLS 1.2 cipher suites to allow, by Go name")
+	lbCmd.Flags().StringArrayVar(&config.TLSClientCAs, "tls-client-ca", nil, "require client certificates signed by this CA, repeatable")
+	lbCmd.Flags().StringSliceVar(&config.TLSAllow, "tls-allow", nil, "client certificate identities (CN or SAN URI, trailing * for a prefix) to let in")
+	lbCmd.Flags().BoolVar(&config.H2C, "h2c", false, "accept cleartext HTTP/2 on a plaintext listener")
+	lbCmd.Flags().BoolVar(&config.HTTP3, "http3", false, "also serve HTTP/3 over QUIC on the TLS listener's port")
+	lbCmd.Flags().Uint32Var(&config.MaxStreams, "max-concurrent-streams", 0, "HTTP/2 streams allowed per client connection (0 for the default)")
+	lbCmd.Flags().StringSliceVar(&config.ProxyProtocol, "proxy-protocol-from", nil, "accept PROXY protocol headers from these CIDRs")
+	lbCmd.Flags().Float64Var(&config.PanicThreshold, "panic-threshold", 0, "healthy fraction below which health status is ignored, e.g. 0.5 (0 disables)")
+
 	rootCmd.AddCommand(lbCmd, backendCmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -111,3 +192,112 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// proxyServer is a TCP or UDP listener from the config file.
+type proxyServer interface {
+	Start() error
+	Stop() error
+}
+
+// loadConfig reads the config file if one was given, otherwise it falls back
+// to the default backends and command line flags.
+func loadConfig(config Config) (*lbconfig.Config, error) {
+	if config.ConfigFile != "" {
+		return lbconfig.Load(config.ConfigFile)
+	}
+
+	pool := lbconfig.PoolConfig{
+		Name:           "default",
+		Strategy:       lbconfig.StrategyRoundRobin,
+		PanicThreshold: config.PanicThreshold,
+		AdaptiveLimit:  config.AdaptiveLimit,
+		MaxConns:       5,
+		Servers: []lbconfig.ServerConfig{
+			{ID: "mcschool", Host: "192.0.0.1", Port: 8081},
+			{ID: "g1-home-router", Host: "192.0.0.2", Port: 8082},
+			{ID: "herroshima", Host: "192.0.0.3", Port: 8083},
+		},
+	}
+
+	if config.StickySession {
+		pool.Sticky = &lbconfig.StickyConfig{
+			CookieName: "goobernetes_session",
+			HttpOnly:   true,
+			SameSite:   "lax",
+		}
+	}
+
+	return &lbconfig.Config{
+		StickySecret: config.StickySecret,
+		Pools:        []lbconfig.PoolConfig{pool},
+	}, nil
+}
+
+// listenerConfig takes TLS and PROXY protocol settings from the config
+// file, or failing that from the command line.
+func listenerConfig(config Config, cfg *lbconfig.Config) (servlets.ListenerConfig, error) {
+	listener := servlets.ListenerConfig{
+		TLS:                  cfg.TLS,
+		H2C:                  config.H2C,
+		HTTP3:                config.HTTP3,
+		MaxConcurrentStreams: config.MaxStreams,
+		ProxyProtocol:        cfg.ProxyProtocol,
+	}
+	if listener.ProxyProtocol == nil && len(config.ProxyProtocol) > 0 {
+		listener.ProxyProtocol = &servlets.ProxyProtocolConfig{TrustedCIDRs: config.ProxyProtocol}
+	}
+	if listener.TLS != nil || len(config.TLSCerts) == 0 {
+		return listener, nil
+	}
+
+	if len(config.TLSCerts) != len(config.TLSKeys) {
+		return listener, fmt.Errorf("got %d --tls-cert but %d --tls-key", len(config.TLSCerts), len(config.TLSKeys))
+	}
+
+	listener.TLS = &servlets.TLSConfig{
+		MinVersion:   config.TLSMinVersion,
+		CipherSuites: config.TLSCiphers,
+	}
+	if len(config.TLSClientCAs) > 0 {
+		listener.TLS.ClientAuth = &servlets.ClientAuthConfig{
+			CAFiles: config.TLSClientCAs,
+			Allow:   config.TLSAllow,
+		}
+	}
+
+	for i, cert := range config.TLSCerts {
+		listener.TLS.Certificates = append(listener.TLS.Certificates, servlets.CertificateConfig{
+			CertFile: cert,
+			KeyFile:  config.TLSKeys[i],
+		})
+	}
+	return listener, nil
+}
+
+// reloadConfig applies the config file again. TCP and UDP listeners are only
+// read at startup, so the running ones are kept and the reload is refused
+// if it removes a pool they send traffic to.
+func reloadConfig(config Config, running *lbconfig.Config, pools *loadbalancer.PoolManager, r *router.Router, routes *router.RouteTable) {
+	if config.ConfigFile == "" {
+		log.Printf("received SIGHUP but no config file is set, ignoring")
+		return
+	}
+
+	cfg, err := lbconfig.Load(config.ConfigFile)
+	if err != nil {
+		log.Printf("failed to reload config: %v", err)
+		return
+	}
+	cfg.TCP, cfg.UDP = running.TCP, running.UDP
+
+	if err := cfg.Apply(pools); err != nil {
+		log.Printf("failed to apply config: %v", err)
+		return
+	}
+
+	if err := cfg.ApplyRoutes(r, routes); err != nil {
+		log.Printf("failed to apply routes: %v", err)
+		return
+	}
+	log.Printf("reloaded config from %s", config.ConfigFile)
+}
@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(delta int64) {
+	c.value.Add(delta)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (g *Gauge) Set(value int64) {
+	g.value.Store(value)
+}
+
+func (g *Gauge) Add(delta int64) {
+	g.value.Add(delta)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+type Registry struct {
+	mu       sync.RWMutex
+	counters map[string]*Counter
+	gauges   map[string]*Gauge
+}
+
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+		gauges:   make(map[string]*Gauge),
+	}
+}
+
+func (r *Registry) Counter(name string) *Counter {
+	r.mu.RLock()
+	counter, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return counter
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if counter, ok := r.counters[name]; ok {
+		return counter
+	}
+	counter = &Counter{}
+	r.counters[name] = counter
+	return counter
+}
+
+func (r *Registry) Gauge(name string) *Gauge {
+	r.mu.RLock()
+	gauge, ok := r.gauges[name]
+	r.mu.RUnlock()
+	if ok {
+		return gauge
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gauge, ok := r.gauges[name]; ok {
+		return gauge
+	}
+	gauge = &Gauge{}
+	r.gauges[name] = gauge
+	return gauge
+}
+
+func (r *Registry) Snapshot() map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	snapshot := make(map[string]int64, len(r.counters)+len(r.gauges))
+	for name, counter := range r.counters {
+		snapshot[name] = counter.Value()
+	}
+	for name, gauge := range r.gauges {
+		snapshot[name] = gauge.Value()
+	}
+	return snapshot
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Snapshot())
+}
+
+func GetCounter(name string) *Counter {
+	return DefaultRegistry.Counter(name)
+}
+
+func GetGauge(name string) *Gauge {
+	return DefaultRegistry.Gauge(name)
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+// RequestAttributesMiddleware captures the client request as the router and
+// load balancers will see it, before other middleware rewrites headers.
+func RequestAttributesMiddleware(proxies *loadbalancer.TrustedProxies) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			attrs := loadbalancer.NewRequestAttributes(r, proxies)
+			next(w, r.WithContext(loadbalancer.WithRequestAttributes(r.Context(), attrs)))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+// StripIdentityHeadersMiddleware drops client-supplied copies of the
+// identity headers, so backends behind a listener without client
+// certificates can't be sent a forged identity either.
+func StripIdentityHeadersMiddleware(headers ...string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range headers {
+				r.Header.Del(header)
+			}
+			next(w, r)
+		}
+	}
+}
+
+// ClientIdentityMiddleware rejects clients whose certificate identity isn't
+// on allow, unless allow is empty, and forwards the identity to backends in
+// the given headers. It must run after RequestAttributesMiddleware and
+// StripIdentityHeadersMiddleware.
+func ClientIdentityMiddleware(allow []string, subjectHeader, uriHeader string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var identity *loadbalancer.ClientIdentity
+			if attrs, ok := loadbalancer.RequestAttributesFrom(r.Context()); ok {
+				identity = attrs.Identity
+			}
+
+			if identity == nil {
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+
+			if len(allow) > 0 && !identity.MatchesAny(allow) {
+				http.Error(w, "client identity not allowed", http.StatusForbidden)
+				return
+			}
+
+			if identity.CommonName != "" {
+				r.Header.Set(subjectHeader, identity.CommonName)
+			}
+			if len(identity.URIs) > 0 {
+				r.Header.Set(uriHeader, strings.Join(identity.URIs, ","))
+			}
+
+			next(w, r)
+		}
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
 )
 
 var (
@@ -207,7 +209,9 @@ func (ipLimiter *IPRateLimiter) GetLimiter(ipAddress string) (*RateLimiter, erro
 // Handles rate limiting based on IP address
 func handleIPRateLimiting(ipLimiter *IPRateLimiter, responseWriter http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
 	ipAddress := request.RemoteAddr
-	if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+	if attrs, ok := loadbalancer.RequestAttributesFrom(request.Context()); ok {
+		ipAddress = attrs.ClientIP
+	} else if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
 		ipAddress = strings.Split(forwardedFor, ",")[0]
 	}
 
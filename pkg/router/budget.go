@@ -0,0 +1,118 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
+)
+
+const (
+	defaultRetryBudgetRatio        = 0.2
+	defaultRetryBudgetMinPerSecond = 10
+
+	// Tokens are tracked in thousandths so fractional deposits add up.
+	retryTokenScale     = 1000
+	retryBudgetMinBurst = 100
+)
+
+// RetryBudget caps retries at Ratio of the pool's recent primary requests,
+// plus MinPerSecond so retries still work at low traffic.
+type RetryBudget struct {
+	Ratio        float64 `json:"ratio,omitempty"`
+	MinPerSecond float64 `json:"min_per_second,omitempty"`
+}
+
+func (b *RetryBudget) validate() error {
+	if b.Ratio < 0 || b.MinPerSecond < 0 {
+		return fmt.Errorf("%w: retry budget ratio %v and min_per_second %v must not be negative", ErrInvalidUpstreamPolicy, b.Ratio, b.MinPerSecond)
+	}
+
+	if b.Ratio == 0 {
+		b.Ratio = defaultRetryBudgetRatio
+	}
+
+	if b.MinPerSecond == 0 {
+		b.MinPerSecond = defaultRetryBudgetMinPerSecond
+	}
+	return nil
+}
+
+// retryBucket is a lock-free token bucket. Every primary request deposits
+// Ratio of a token, time tops it up at MinPerSecond, and every retry has to
+// withdraw a whole token. The bucket is capped, so only recent traffic earns
+// retries.
+type retryBucket struct {
+	pool       string
+	deposit    int64
+	refillRate float64 // tokens per nanosecond, scaled
+	capacity   int64
+	tokens     atomic.Int64
+	lastRefill atomic.Int64
+	exhausted  *metrics.Counter
+	empty      atomic.Bool // logged as exhausted and not yet as recovered
+}
+
+func newRetryBucket(pool string, budget RetryBudget) *retryBucket {
+	b := &retryBucket{
+		pool:       pool,
+		deposit:    int64(budget.Ratio * retryTokenScale),
+		refillRate: budget.MinPerSecond * retryTokenScale / float64(time.Second),
+		capacity:   int64(max(retryBudgetMinBurst, 10*budget.MinPerSecond) * retryTokenScale),
+		exhausted:  metrics.GetCounter(fmt.Sprintf("router_retry_budget_exhausted_total{pool=%q}", pool)),
+	}
+	b.tokens.Store(min(b.capacity, int64(budget.MinPerSecond*retryTokenScale)))
+	b.lastRefill.Store(time.Now().UnixNano())
+	return b
+}
+
+// recordRequest is called once per primary request.
+func (b *retryBucket) recordRequest() {
+	b.add(b.deposit)
+}
+
+// tryRetry takes a token for one retry attempt, and reports false once the
+// budget is spent. Every denied retry is counted, but only running out and
+// recovering are logged, so a retry storm doesn't flood the log.
+func (b *retryBucket) tryRetry() bool {
+	b.refill()
+
+	for {
+		tokens := b.tokens.Load()
+		if tokens < retryTokenScale {
+			b.exhausted.Inc()
+			if b.empty.CompareAndSwap(false, true) {
+				log.Printf("retry budget for pool %s exhausted, not retrying", b.pool)
+			}
+			return false
+		}
+
+		if b.tokens.CompareAndSwap(tokens, tokens-retryTokenScale) {
+			if b.empty.CompareAndSwap(true, false) {
+				log.Printf("retry budget for pool %s recovered, retrying again", b.pool)
+			}
+			return true
+		}
+	}
+}
+
+func (b *retryBucket) refill() {
+	now := time.Now().UnixNano()
+	last := b.lastRefill.Load()
+	if now <= last || !b.lastRefill.CompareAndSwap(last, now) {
+		return
+	}
+	b.add(int64(float64(now-last) * b.refillRate))
+}
+
+func (b *retryBucket) add(delta int64) {
+	for {
+		tokens := b.tokens.Load()
+		next := min(b.capacity, tokens+delta)
+		if next == tokens || b.tokens.CompareAndSwap(tokens, next) {
+			return
+		}
+	}
+}
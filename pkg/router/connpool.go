@@ -0,0 +1,270 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+)
+
+var ErrConnectionPoolExhausted = errors.New("connection pool exhausted")
+
+// ConnectionPoolPolicy sizes the pool of upstream connections kept for a
+// pool's servers. MaxPerHost caps connections in use per server, or
+// MaxConcurrentStreams the streams for HTTP/2 pools, and requests over the
+// cap fail instead of queueing; 0 means no cap.
+type ConnectionPoolPolicy struct {
+	MaxIdle              int           `json:"max_idle,omitempty"`
+	MaxIdlePerHost       int           `json:"max_idle_per_host,omitempty"`
+	MaxPerHost           int           `json:"max_per_host,omitempty"`
+	MaxConcurrentStreams int           `json:"max_concurrent_streams,omitempty"`
+	IdleTimeout          util.Duration `json:"idle_timeout,omitempty"`
+	KeepAlive            util.Duration `json:"keep_alive,omitempty"`
+}
+
+func (c *ConnectionPoolPolicy) validate() error {
+	if c.MaxIdle < 0 || c.MaxIdlePerHost < 0 || c.MaxPerHost < 0 || c.MaxConcurrentStreams < 0 || c.IdleTimeout < 0 || c.KeepAlive < 0 {
+		return fmt.Errorf("%w: connection pool settings must not be negative", ErrInvalidUpstreamPolicy)
+	}
+
+	if c.MaxIdle == 0 {
+		c.MaxIdle = defaultMaxIdleConns
+	}
+
+	if c.MaxIdlePerHost == 0 {
+		c.MaxIdlePerHost = defaultMaxIdleConnsPerHost
+	}
+
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = util.Duration(defaultIdleConnTimeout)
+	}
+
+	if c.KeepAlive == 0 {
+		c.KeepAlive = util.Duration(defaultKeepAlive)
+	}
+	return nil
+}
+
+// connectionPool wraps the pool's long-lived transport and keeps track of
+// how its connections are used. For HTTP/2 every request is a stream on a
+// shared connection, so the per-host cap counts streams instead.
+type connectionPool struct {
+	pool          string
+	protocol      string
+	transport     http.RoundTripper
+	closeIdle     func()
+	headerTimeout time.Duration // enforced here for HTTP/2, by the transport otherwise
+	maxPerHost    int64
+	inUse         sync.Map // host -> *atomic.Int64
+}
+
+// newConnectionPool dials servers with TLS when tlsConfig is set, which it
+// must be for h2, and reports failed handshakes to observeTLS. With
+// proxyProtocol set every connection is announced as one client's, so
+// connections aren't kept alive to be reused by others.
+func newConnectionPool(pool string, protocol string, proxyProtocol string, timeouts TimeoutPolicy, policy ConnectionPoolPolicy, tlsConfig *tls.Config, observeTLS func(addr string)) *connectionPool {
+	c := &connectionPool{
+		pool:       pool,
+		protocol:   protocol,
+		maxPerHost: int64(policy.MaxPerHost),
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(timeouts.Connect),
+		KeepAlive: time.Duration(policy.KeepAlive),
+	}
+	dialServer := dialer.DialContext
+	if proxyProtocol != "" {
+		dialServer = dialProxyProtocol(dialServer, proxyProtocol)
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialServer(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		metrics.GetCounter(fmt.Sprintf("router_connection_pool_dials_total{pool=%q}", pool)).Inc()
+		c.open().Add(1)
+		return &pooledConn{Conn: conn, closed: func() { c.open().Add(-1) }}, nil
+	}
+
+	if protocol == ProtocolHTTP1 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dial
+		transport.MaxIdleConns = policy.MaxIdle
+		transport.MaxIdleConnsPerHost = policy.MaxIdlePerHost
+		transport.IdleConnTimeout = time.Duration(policy.IdleTimeout)
+		transport.ResponseHeaderTimeout = time.Duration(timeouts.ResponseHeader)
+		transport.DisableKeepAlives = proxyProtocol != ""
+		if tlsConfig != nil {
+			transport.DialTLSContext = dialTLS(pool, dial, tlsConfig, protocol, observeTLS)
+		}
+		c.transport, c.closeIdle = transport, transport.CloseIdleConnections
+		return c
+	}
+
+	transport := &http2.Transport{
+		IdleConnTimeout: time.Duration(policy.IdleTimeout),
+		ReadIdleTimeout: time.Duration(policy.KeepAlive),
+	}
+	if protocol == ProtocolH2C {
+		transport.AllowHTTP = true
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		}
+	} else {
+		dialTLS := dialTLS(pool, dial, tlsConfig, protocol, observeTLS)
+		transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialTLS(ctx, network, addr)
+		}
+	}
+
+	if policy.MaxConcurrentStreams > 0 {
+		c.maxPerHost = int64(policy.MaxConcurrentStreams)
+	}
+	c.headerTimeout = time.Duration(timeouts.ResponseHeader)
+	c.transport, c.closeIdle = transport, transport.CloseIdleConnections
+	return c
+}
+
+func (c *connectionPool) open() *metrics.Gauge {
+	return metrics.GetGauge(fmt.Sprintf("router_connection_pool_open{pool=%q}", c.pool))
+}
+
+// RoundTrip sends one attempt to the host in req.URL, failing fast when the
+// host is already at its cap.
+func (c *connectionPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !c.acquire(host) {
+		metrics.GetCounter(fmt.Sprintf("router_connection_pool_exhausted_total{pool=%q}", c.pool)).Inc()
+		unit := "connections"
+		if c.protocol != ProtocolHTTP1 {
+			unit = "streams"
+		}
+		return nil, fmt.Errorf("%w: %d %s to %s in use", ErrConnectionPoolExhausted, c.maxPerHost, unit, host)
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				metrics.GetCounter(fmt.Sprintf("router_connection_pool_hits_total{pool=%q}", c.pool)).Inc()
+			} else {
+				metrics.GetCounter(fmt.Sprintf("router_connection_pool_misses_total{pool=%q}", c.pool)).Inc()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		c.release(host)
+		return nil, err
+	}
+	resp.Body = &closeHook{ReadCloser: resp.Body, hook: func() { c.release(host) }}
+	return resp, nil
+}
+
+// roundTrip applies the response header timeout for transports that don't
+// have one, without cutting off the body once headers are in.
+func (c *connectionPool) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.headerTimeout <= 0 {
+		return c.transport.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(c.headerTimeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+
+	resp, err := c.transport.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if timedOut.Load() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("timeout awaiting response headers: %w", context.DeadlineExceeded)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &closeHook{ReadCloser: resp.Body, hook: cancel}
+	return resp, nil
+}
+
+func (c *connectionPool) counter(host string) *atomic.Int64 {
+	counter, _ := c.inUse.LoadOrStore(host, &atomic.Int64{})
+	return counter.(*atomic.Int64)
+}
+
+func (c *connectionPool) acquire(host string) bool {
+	counter := c.counter(host)
+	if c.maxPerHost == 0 {
+		counter.Add(1)
+		return true
+	}
+
+	for {
+		n := counter.Load()
+		if n >= c.maxPerHost {
+			return false
+		}
+
+		if counter.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (c *connectionPool) release(host string) {
+	c.counter(host).Add(-1)
+}
+
+func (c *connectionPool) close() {
+	c.closeIdle()
+}
+
+type pooledConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// closeHook runs hook once, the first time the body is closed.
+type closeHook struct {
+	io.ReadCloser
+	once sync.Once
+	hook func()
+}
+
+func (c *closeHook) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(c.hook)
+	return err
+}
@@ -0,0 +1,136 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// retry_on conditions for gRPC calls, matched against the grpc-status of
+// trailers-only responses.
+var grpcRetryConditions = map[string]int{
+	"cancelled":          util.GRPCCancelled,
+	"deadline-exceeded":  util.GRPCDeadlineExceeded,
+	"resource-exhausted": util.GRPCResourceExhausted,
+	"internal":           util.GRPCInternal,
+	"unavailable":        util.GRPCUnavailable,
+}
+
+// grpcFailures are the statuses that count against a server, like a 5xx
+// does for plain HTTP.
+var grpcFailures = []int{util.GRPCUnknown, util.GRPCDeadlineExceeded, util.GRPCInternal, util.GRPCUnavailable, util.GRPCDataLoss}
+
+func isGRPC(req *http.Request) bool {
+	return util.IsGRPC(req.Header.Get("Content-Type"))
+}
+
+func (p *RetryPolicy) retriesGRPC() bool {
+	return p.MaxAttempts > 1 && slices.ContainsFunc(p.RetryOn, func(condition string) bool {
+		_, ok := grpcRetryConditions[condition]
+		return ok
+	})
+}
+
+// grpcRetryCondition names the retry_on condition a response matches, if
+// it is a trailers-only response with a status worth retrying.
+func grpcRetryCondition(resp *http.Response) string {
+	code, ok := util.GRPCStatus(resp.Header, nil)
+	if !ok {
+		return ""
+	}
+
+	for condition, c := range grpcRetryConditions {
+		if c == code {
+			return condition
+		}
+	}
+	return ""
+}
+
+// observeGRPC marks the attempt failed once the response's grpc-status is
+// known, which for streamed responses is only after the trailers arrive, and
+// reports the outcome to the pool's outlier detection.
+func (u *upstream) observeGRPC(resp *http.Response, attempt *attemptTransport) {
+	resp.Body = &closeHook{ReadCloser: resp.Body, hook: func() {
+		code, ok := util.GRPCStatus(resp.Header, resp.Trailer)
+		if !ok {
+			return
+		}
+
+		metrics.GetCounter(fmt.Sprintf("router_grpc_status_total{pool=%q,code=%q}", attempt.pool, strconv.Itoa(code))).Inc()
+		failed := slices.Contains(grpcFailures, code)
+		if failed {
+			attempt.failed = true
+		}
+		attempt.outliers.Observe(attempt.server, failed)
+	}}
+}
+
+// prepareGRPCRetries lets a gRPC call be retried when the policy opts in
+// with a gRPC retry_on condition. gRPC calls are always POSTs with a body
+// of unknown length, so rather than buffering up front the body is
+// recorded as the first attempt sends it.
+func prepareGRPCRetries(req *http.Request, policy RetryPolicy) (*replayBody, bool) {
+	if !policy.retriesGRPC() {
+		return nil, false
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	body := &replayBody{ReadCloser: req.Body}
+	req.Body = body
+	return body, true
+}
+
+// replayBody records a request body while it is read so a retry can send
+// it again. It can only be replayed once it has been read to the end
+// without going over maxRetryBodyBytes.
+type replayBody struct {
+	io.ReadCloser
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	done     bool
+	overflow bool
+}
+
+func (b *replayBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.overflow {
+		if b.buf.Len()+n > maxRetryBodyBytes {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF {
+		b.done = true
+	}
+	return n, err
+}
+
+func (b *replayBody) replayable() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.done && !b.overflow
+}
+
+func (b *replayBody) replay() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(b.buf.Bytes()))
+}
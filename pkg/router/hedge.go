@@ -0,0 +1,177 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	defaultMaxHedges = 1
+
+	latencyWindow     = 128
+	latencyMinSamples = 20
+)
+
+// HedgePolicy sends idempotent GETs to another server when the first hasn't
+// answered within Delay, or the pool's observed p95 when Delay is unset.
+// MaxHedges caps the extra requests per client request.
+type HedgePolicy struct {
+	Delay     util.Duration `json:"delay,omitempty"`
+	MaxHedges int           `json:"max_hedges,omitempty"`
+}
+
+func (h *HedgePolicy) validate() error {
+	if h.Delay < 0 || h.MaxHedges < 0 {
+		return fmt.Errorf("%w: hedge delay %v and max_hedges %d must not be negative", ErrInvalidUpstreamPolicy, h.Delay, h.MaxHedges)
+	}
+
+	if h.MaxHedges == 0 {
+		h.MaxHedges = defaultMaxHedges
+	}
+	return nil
+}
+
+// latencyTracker keeps a window of recent response header latencies and the
+// p95 over it, recomputed every few samples.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	p95     atomic.Int64
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, 0, latencyWindow)}
+}
+
+func (l *latencyTracker) observe(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, latency)
+	} else {
+		l.samples[l.next] = latency
+	}
+	l.next = (l.next + 1) % latencyWindow
+
+	if len(l.samples) >= latencyMinSamples && l.next%8 == 0 {
+		sorted := slices.Clone(l.samples)
+		slices.Sort(sorted)
+		l.p95.Store(int64(sorted[len(sorted)*95/100]))
+	}
+}
+
+// percentile95 returns 0 until enough samples have been seen.
+func (l *latencyTracker) percentile95() time.Duration {
+	return time.Duration(l.p95.Load())
+}
+
+type hedgeAttempt struct {
+	server loadbalancer.Server
+	start  time.Time
+	cancel context.CancelFunc
+	hedge  bool
+	resp   *http.Response
+	err    error
+}
+
+func (t *attemptTransport) hedgeDelay() time.Duration {
+	if t.hedge.Delay > 0 {
+		return time.Duration(t.hedge.Delay)
+	}
+	return t.latency.percentile95()
+}
+
+// sendHedged races the current server against up to MaxHedges others. The
+// first response wins and becomes the current server; every other attempt
+// is cancelled and its connection given back.
+func (t *attemptTransport) sendHedged(req *http.Request, tried map[string]bool) (*http.Response, error) {
+	delay := t.hedgeDelay()
+	if delay <= 0 {
+		return t.send(req, t.server)
+	}
+
+	results := make(chan *hedgeAttempt, t.hedge.MaxHedges+1)
+	pending := make(map[*hedgeAttempt]bool)
+	launch := func(server loadbalancer.Server, hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		attempt := &hedgeAttempt{server: server, start: time.Now(), cancel: cancel, hedge: hedge}
+		pending[attempt] = true
+		go func() {
+			attempt.resp, attempt.err = t.send(req.WithContext(ctx), server)
+			results <- attempt
+		}()
+	}
+
+	tried[loadbalancer.InstanceOf(t.server).ID] = true
+	launch(t.server, false)
+	hedges := 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if next, ok := t.nextServer(req.Context(), tried); ok {
+				tried[loadbalancer.InstanceOf(next).ID] = true
+				hedges++
+				metrics.GetCounter(fmt.Sprintf("router_hedges_total{pool=%q}", t.pool)).Inc()
+				launch(next, true)
+			}
+
+			if hedges < t.hedge.MaxHedges {
+				timer.Reset(delay)
+			}
+
+		case attempt := <-results:
+			delete(pending, attempt)
+			if attempt.err != nil && len(pending) > 0 {
+				attempt.cancel()
+				attempt.server.ObserveResult(time.Since(attempt.start), true)
+				attempt.server.ReleaseConnection()
+				continue
+			}
+
+			for loser := range pending {
+				loser.cancel()
+			}
+			go discardHedges(results, len(pending))
+
+			t.server = attempt.server
+			t.start = attempt.start
+			if attempt.err != nil {
+				attempt.cancel()
+				return nil, attempt.err
+			}
+
+			if attempt.hedge {
+				metrics.GetCounter(fmt.Sprintf("router_hedge_wins_total{pool=%q}", t.pool)).Inc()
+			}
+			// Keep the winner's context alive until the proxy is done with the body.
+			attempt.resp.Body = &closeHook{ReadCloser: attempt.resp.Body, hook: attempt.cancel}
+			return attempt.resp, nil
+		}
+	}
+}
+
+// discardHedges gives back the connections of attempts that lost the race.
+func discardHedges(results chan *hedgeAttempt, losers int) {
+	for range losers {
+		attempt := <-results
+		if attempt.resp != nil {
+			attempt.resp.Body.Close()
+		}
+		attempt.server.ReleaseConnection()
+	}
+}
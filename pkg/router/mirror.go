@@ -0,0 +1,263 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	defaultMirrorMaxBodyBytes  = 64 << 10
+	defaultMirrorTimeout       = time.Second
+	defaultMirrorMaxConcurrent = 16
+)
+
+// MirrorPolicy copies a percentage of a route's requests to a shadow pool.
+// Mirrored requests are sent after the primary request has been proxied and
+// their responses are discarded, so they never slow down the client.
+type MirrorPolicy struct {
+	Pool          string        `json:"pool"`
+	Percent       float64       `json:"percent"`
+	MaxBodyBytes  int64         `json:"max_body_bytes,omitempty"`
+	Timeout       util.Duration `json:"timeout,omitempty"`
+	MaxConcurrent int           `json:"max_concurrent,omitempty"`
+	slots         chan struct{}
+}
+
+func (m *MirrorPolicy) compile() error {
+	if m.Pool == "" {
+		return fmt.Errorf("%w: mirror has no pool", ErrInvalidRoute)
+	}
+
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("%w: mirror percent %v outside [0, 100]", ErrInvalidRoute, m.Percent)
+	}
+
+	if m.MaxBodyBytes <= 0 {
+		m.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+
+	if m.Timeout <= 0 {
+		m.Timeout = util.Duration(defaultMirrorTimeout)
+	}
+
+	if m.MaxConcurrent <= 0 {
+		m.MaxConcurrent = defaultMirrorMaxConcurrent
+	}
+
+	m.slots = make(chan struct{}, m.MaxConcurrent)
+	return nil
+}
+
+func (m *MirrorPolicy) sample() bool {
+	return m.Percent > 0 && rand.Float64()*100 < m.Percent
+}
+
+// mirrorBody records the request body as the primary proxy reads it, up to
+// a limit. The copy is only usable once the primary has read it to EOF.
+type mirrorBody struct {
+	io.ReadCloser
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	eof      bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf.Reset()
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *mirrorBody) captured() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflow || !b.eof {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+type mirrorRequest struct {
+	route  string
+	policy *MirrorPolicy
+	req    *http.Request
+	body   *mirrorBody
+	attrs  *loadbalancer.RequestAttributes
+}
+
+// prepareMirror snapshots the request before it is rewritten for the primary
+// backend, and starts capturing its body. It returns nil if the request
+// isn't sampled or is a protocol upgrade.
+func prepareMirror(route *Route, req *http.Request) *mirrorRequest {
+	if route.Mirror == nil || isUpgrade(req) || !route.Mirror.sample() {
+		return nil
+	}
+
+	mirror := &mirrorRequest{
+		route:  route.Name,
+		policy: route.Mirror,
+		req:    req.Clone(context.Background()),
+	}
+	mirror.attrs, _ = loadbalancer.RequestAttributesFrom(req.Context())
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > route.Mirror.MaxBodyBytes {
+			metrics.GetCounter(fmt.Sprintf("router_mirror_skipped_total{route=%q}", route.Name)).Inc()
+			return nil
+		}
+
+		mirror.body = &mirrorBody{ReadCloser: req.Body, limit: route.Mirror.MaxBodyBytes}
+		req.Body = mirror.body
+	}
+	return mirror
+}
+
+// dispatchMirror sends the shadow request in the background. It is dropped
+// if the route's mirror concurrency cap is reached.
+func (r *Router) dispatchMirror(mirror *mirrorRequest) {
+	var body []byte
+	if mirror.body != nil {
+		captured, ok := mirror.body.captured()
+		if !ok {
+			metrics.GetCounter(fmt.Sprintf("router_mirror_skipped_total{route=%q}", mirror.route)).Inc()
+			return
+		}
+		body = captured
+	}
+
+	select {
+	case mirror.policy.slots <- struct{}{}:
+	default:
+		metrics.GetCounter(fmt.Sprintf("router_mirror_dropped_total{route=%q}", mirror.route)).Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-mirror.policy.slots }()
+
+		metrics.GetCounter(fmt.Sprintf("router_mirror_requests_total{route=%q}", mirror.route)).Inc()
+		if err := r.sendMirror(mirror, body); err != nil {
+			metrics.GetCounter(fmt.Sprintf("router_mirror_errors_total{route=%q}", mirror.route)).Inc()
+			log.Printf("mirror to pool %s failed: %v", mirror.policy.Pool, err)
+		}
+	}()
+}
+
+func (r *Router) sendMirror(mirror *mirrorRequest, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(mirror.policy.Timeout))
+	defer cancel()
+
+	if mirror.attrs != nil {
+		ctx = loadbalancer.WithRequestAttributes(ctx, mirror.attrs)
+	}
+
+	pool, err := r.pools.GetPool(mirror.policy.Pool)
+	if err != nil {
+		return err
+	}
+
+	server, err := pool.NextServer(ctx)
+	if err != nil {
+		return err
+	}
+	defer server.ReleaseConnection()
+
+	upstream := r.upstream(pool.Name)
+	req := mirror.req.WithContext(ctx)
+	req.RequestURI = ""
+	upstream.directTo(req, server)
+	forwardHeaders(req)
+	req.Header.Set("X-Goobernetes-Mirror", "true")
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+
+	start := time.Now()
+	resp, err := upstream.conns.RoundTrip(req)
+	if err != nil {
+		server.ObserveResult(time.Since(start), true)
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, resp.Body)
+	server.ObserveResult(time.Since(start), resp.StatusCode >= http.StatusInternalServerError)
+	return nil
+}
+
+// hopHeaders are the headers httputil.ReverseProxy drops before proxying.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardHeaders rewrites a mirrored request's headers the way
+// httputil.ReverseProxy rewrites the primary one: hop-by-hop headers are
+// dropped and the client's address is appended to X-Forwarded-For.
+func forwardHeaders(req *http.Request) {
+	trailers := httpguts.HeaderValuesContainsToken(req.Header["Te"], "trailers")
+	for _, value := range req.Header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				req.Header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	if trailers {
+		req.Header.Set("Te", "trailers")
+	}
+
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	prior, ok := req.Header["X-Forwarded-For"]
+	if ok && prior == nil {
+		return // explicitly omitted, as ReverseProxy allows
+	}
+	if len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// dialProxyProtocol wraps dial so every new connection starts with a PROXY
+// header for the client of the request being dialled for. Dials made
+// without a client, such as for mirrors, announce none.
+func dialProxyProtocol(dial func(ctx context.Context, network, addr string) (net.Conn, error), version string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		var source net.Addr
+		if attrs, ok := loadbalancer.RequestAttributesFrom(ctx); ok {
+			if ip := net.ParseIP(attrs.ClientIP); ip != nil {
+				source = &net.TCPAddr{IP: ip, Port: attrs.ClientPort}
+			}
+		}
+		// The header names the address the client connected to, which is
+		// our own if the request didn't come through a listener.
+		destination, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok {
+			destination = conn.LocalAddr()
+		}
+
+		header, err := util.ProxyHeader(version, source, destination)
+		if err == nil {
+			_, err = conn.Write(header)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
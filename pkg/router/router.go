@@ -4,8 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/raydatray/goobernetes/pkg/loadbalancer"
@@ -15,38 +14,165 @@ type RequestRouter interface {
 	ServeRequest(w http.ResponseWriter, req *http.Request)
 }
 
+// NotFoundResponse is written when a request matches no route.
+type NotFoundResponse struct {
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
 type Router struct {
-	lb loadbalancer.LoadBalancer
+	pools     *loadbalancer.PoolManager
+	routes    *RouteTable
+	mu        sync.RWMutex
+	notFound  NotFoundResponse
+	upstreams map[string]*upstream
+	proxies   *loadbalancer.TrustedProxies
+
+	upgradesMu      sync.Mutex
+	upgrades        map[*upgradedConn]struct{}
+	upgradesDrained chan struct{}
 }
 
 var _ RequestRouter = (*Router)(nil)
 
-func NewRouter(lb loadbalancer.LoadBalancer) RequestRouter {
+func NewRouter(pools *loadbalancer.PoolManager, routes *RouteTable) *Router {
 	return &Router{
-		lb: lb,
+		pools:  pools,
+		routes: routes,
+		notFound: NotFoundResponse{
+			StatusCode:  http.StatusNotFound,
+			ContentType: "text/plain; charset=utf-8",
+			Body:        "no route matched the request\n",
+		},
+		upstreams: make(map[string]*upstream),
+		proxies:   &loadbalancer.TrustedProxies{},
+		upgrades:  make(map[*upgradedConn]struct{}),
 	}
 }
 
+func (r *Router) SetNotFoundResponse(resp NotFoundResponse) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notFound = resp
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For is believed when
+// working out the client IP.
+func (r *Router) SetTrustedProxies(cidrs []string) error {
+	return r.proxies.Set(cidrs)
+}
+
+func (r *Router) TrustedProxies() *loadbalancer.TrustedProxies {
+	return r.proxies
+}
+
 func (r *Router) ServeRequest(w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	if _, ok := loadbalancer.RequestAttributesFrom(req.Context()); !ok {
+		attrs := loadbalancer.NewRequestAttributes(req, r.proxies)
+		req = req.WithContext(loadbalancer.WithRequestAttributes(req.Context(), attrs))
+	}
+
+	route, ok := r.routes.Match(req)
+	if !ok {
+		r.writeNotFound(w)
+		return
+	}
+
+	poolName, variantHeader := route.Target(req)
+	if variantHeader != "" {
+		w.Header().Set(variantHeader, poolName)
+	}
+
+	pool, err := r.pools.GetPool(poolName)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", err.Error(), poolName), http.StatusBadGateway)
+		return
+	}
+
+	mirror := prepareMirror(route, req)
+	r.forward(w, req, pool)
+	if mirror != nil {
+		r.dispatchMirror(mirror)
+	}
+}
+
+// pin keeps the client on the server that answered, for pools with sticky
+// sessions.
+func pin(lb loadbalancer.LoadBalancer, header http.Header, server loadbalancer.Server) {
+	if selector, ok := lb.(loadbalancer.RequestSelector); ok {
+		selector.Pin(header, server)
+	}
+}
+
+func (r *Router) writeNotFound(w http.ResponseWriter) {
+	r.mu.RLock()
+	resp := r.notFound
+	r.mu.RUnlock()
+
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	fmt.Fprint(w, resp.Body)
+}
+
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, pool *loadbalancer.Pool) {
+	ctx, cancel := context.WithTimeout(req.Context(), 1*time.Second)
 	defer cancel()
 
-	server, err := r.lb.NextServer(ctx)
+	var server loadbalancer.Server
+	var err error
+	if selector, ok := pool.LoadBalancer.(loadbalancer.RequestSelector); ok {
+		server, err = selector.SelectServer(ctx, req)
+	} else {
+		server, err = pool.NextServer(ctx)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	defer server.ReleaseConnection()
 
-	targetURL := &url.URL{
-		Scheme: "http",
-		Host:   fmt.Sprintf("%s", server.GetHostPort()),
+	upstream := r.upstream(pool.Name)
+	if isUpgrade(req) {
+		r.forwardUpgrade(w, req, pool.Name, pool.LoadBalancer, server, upstream)
+		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	if total := time.Duration(upstream.policy.Timeouts.Total); total > 0 {
+		reqCtx, cancel := context.WithTimeout(req.Context(), total)
+		defer cancel()
+		req = req.WithContext(reqCtx)
+	}
 
-	req.URL.Host = targetURL.Host
-	req.URL.Scheme = targetURL.Scheme
+	var body []byte
+	var stream *replayBody
+	var retries bool
+	if isGRPC(req) {
+		stream, retries = prepareGRPCRetries(req, upstream.policy.Retry)
+	} else {
+		body, retries = prepareRetries(req, upstream.policy.Retry)
+	}
+	if upstream.budget != nil {
+		upstream.budget.recordRequest()
+	}
+	attempt := &attemptTransport{
+		base:     upstream.conns,
+		lb:       pool.LoadBalancer,
+		pool:     pool.Name,
+		policy:   upstream.policy.Retry,
+		budget:   upstream.budget,
+		hedge:    upstream.policy.Hedge,
+		latency:  upstream.latency,
+		outliers: pool.OutlierDetector(),
+		server:   server,
+		body:     body,
+		stream:   stream,
+		retries:  retries,
+		start:    time.Now(),
+	}
+	defer func() { attempt.server.ReleaseConnection() }()
 
-	proxy.ServeHTTP(w, req)
+	upstream.proxy.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), attemptKey{}, attempt)))
+	attempt.server.ObserveResult(time.Since(attempt.start), attempt.failed)
 }
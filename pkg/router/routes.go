@@ -0,0 +1,322 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+var (
+	ErrRouteAlreadyExists = errors.New("route already exists")
+	ErrRouteNotFound      = errors.New("route not found")
+	ErrInvalidRoute       = errors.New("invalid route")
+)
+
+// Route sends matching requests to a named pool. Every non-empty condition
+// must match. Hosts may be exact ("api.example.com") or a wildcard
+// ("*.example.com") matching any subdomain. Header values must match exactly;
+// an empty value only requires the header to be present. Identities match
+// the verified client certificate, as loadbalancer.ClientIdentity.Matches
+// does. A route targets either a single Pool or a weighted Split across
+// pools, and may mirror a sample of its traffic to a shadow pool.
+type Route struct {
+	Name       string            `json:"name"`
+	Priority   int               `json:"priority,omitempty"`
+	Hosts      []string          `json:"hosts,omitempty"`
+	PathPrefix string            `json:"path_prefix,omitempty"`
+	PathRegex  string            `json:"path_regex,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Identities []string          `json:"identities,omitempty"`
+	Pool       string            `json:"pool,omitempty"`
+	Split      *TrafficSplit     `json:"split,omitempty"`
+	Mirror     *MirrorPolicy     `json:"mirror,omitempty"`
+	pathRegex  *regexp.Regexp
+}
+
+func (r *Route) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrInvalidRoute)
+	}
+
+	if (r.Pool == "") == (r.Split == nil) {
+		return fmt.Errorf("%w: route %s needs exactly one of pool or split", ErrInvalidRoute, r.Name)
+	}
+
+	if r.Split != nil {
+		if err := r.Split.validate(); err != nil {
+			return fmt.Errorf("route %s: %w", r.Name, err)
+		}
+	}
+
+	if r.Mirror != nil {
+		mirror := *r.Mirror
+		if err := mirror.compile(); err != nil {
+			return fmt.Errorf("route %s: %w", r.Name, err)
+		}
+		r.Mirror = &mirror
+	}
+
+	if r.PathRegex != "" {
+		re, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return fmt.Errorf("%w: route %s: %v", ErrInvalidRoute, r.Name, err)
+		}
+		r.pathRegex = re
+	}
+
+	hosts := make([]string, 0, len(r.Hosts))
+	for _, host := range r.Hosts {
+		hosts = append(hosts, strings.ToLower(host))
+	}
+	r.Hosts = hosts
+	return nil
+}
+
+func (r *Route) Matches(req *http.Request) bool {
+	if len(r.Hosts) > 0 && !matchHost(r.Hosts, req.Host) {
+		return false
+	}
+
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(r.Methods) > 0 && !containsFold(r.Methods, req.Method) {
+		return false
+	}
+
+	for name, value := range r.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !contains(values, value)) {
+			return false
+		}
+	}
+
+	if len(r.Identities) > 0 {
+		attrs, ok := loadbalancer.RequestAttributesFrom(req.Context())
+		if !ok || !attrs.Identity.MatchesAny(r.Identities) {
+			return false
+		}
+	}
+	return true
+}
+
+// Target picks the pool for a matched request, returning the variant header
+// to set on the response, if any.
+func (r *Route) Target(req *http.Request) (pool string, variantHeader string) {
+	if r.Split == nil {
+		return r.Pool, ""
+	}
+	return r.Split.choose(req), r.Split.VariantHeader
+}
+
+// Pools lists every pool the route sends traffic to, mirrors included.
+func (r *Route) Pools() []string {
+	var pools []string
+	if r.Pool != "" {
+		pools = append(pools, r.Pool)
+	}
+
+	if r.Split != nil {
+		for _, backend := range r.Split.Backends {
+			if backend.Pool != "" {
+				pools = append(pools, backend.Pool)
+			}
+		}
+	}
+
+	if r.Mirror != nil && r.Mirror.Pool != "" {
+		pools = append(pools, r.Mirror.Pool)
+	}
+	return pools
+}
+
+func matchHost(hosts []string, requestHost string) bool {
+	host := strings.ToLower(requestHost)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, pattern := range hosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteTable evaluates routes by descending priority, then in the order they
+// were added.
+type RouteTable struct {
+	mu     sync.RWMutex
+	routes []*Route
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes: make([]*Route, 0),
+	}
+}
+
+func (t *RouteTable) AddRoute(route Route) error {
+	if err := route.compile(); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, r := range t.routes {
+		if r.Name == route.Name {
+			return ErrRouteAlreadyExists
+		}
+	}
+
+	t.routes = append(t.routes, &route)
+	sortRoutes(t.routes)
+	return nil
+}
+
+func (t *RouteTable) RemoveRoute(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, r := range t.routes {
+		if r.Name == name {
+			t.routes = append(t.routes[:i], t.routes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRouteNotFound
+}
+
+// SetRoutes replaces the whole table, leaving it untouched if any route is
+// invalid.
+func (t *RouteTable) SetRoutes(routes []Route) error {
+	compiled, err := compileRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes = compiled
+	return nil
+}
+
+// ValidateRoutes reports whether SetRoutes would accept the routes.
+func ValidateRoutes(routes []Route) error {
+	_, err := compileRoutes(routes)
+	return err
+}
+
+func compileRoutes(routes []Route) ([]*Route, error) {
+	compiled := make([]*Route, 0, len(routes))
+	names := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		if err := route.compile(); err != nil {
+			return nil, err
+		}
+
+		if names[route.Name] {
+			return nil, fmt.Errorf("%w: %s", ErrRouteAlreadyExists, route.Name)
+		}
+		names[route.Name] = true
+		compiled = append(compiled, &route)
+	}
+	sortRoutes(compiled)
+	return compiled, nil
+}
+
+// UpdateSplitWeights swaps in new split backends for a route. The route is
+// replaced rather than modified so concurrent matches never see a partial
+// update.
+func (t *RouteTable) UpdateSplitWeights(name string, backends []SplitBackend) error {
+	if err := validateSplitBackends(backends); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, r := range t.routes {
+		if r.Name != name {
+			continue
+		}
+
+		if r.Split == nil {
+			return fmt.Errorf("%w: route %s has no split", ErrInvalidRoute, name)
+		}
+
+		updated := *r
+		split := *r.Split
+		split.Backends = append([]SplitBackend(nil), backends...)
+		updated.Split = &split
+		t.routes[i] = &updated
+		return nil
+	}
+	return ErrRouteNotFound
+}
+
+func (t *RouteTable) GetRoutes() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	routes := make([]Route, 0, len(t.routes))
+	for _, r := range t.routes {
+		routes = append(routes, *r)
+	}
+	return routes
+}
+
+func (t *RouteTable) Match(req *http.Request) (*Route, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, r := range t.routes {
+		if r.Matches(req) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+func sortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].Priority > routes[j].Priority
+	})
+}
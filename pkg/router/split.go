@@ -0,0 +1,117 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/http"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+const (
+	HashOnRandom   = ""
+	HashOnCookie   = "cookie"
+	HashOnHeader   = "header"
+	HashOnClientIP = "client_ip"
+)
+
+type SplitBackend struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+// TrafficSplit spreads a route's traffic across pools by weight. Requests are
+// bucketed randomly, or consistently from a hashed key so a client stays on
+// the same variant. Requests without the key fall back to a random bucket.
+type TrafficSplit struct {
+	Backends      []SplitBackend `json:"backends"`
+	HashOn        string         `json:"hash_on,omitempty"`
+	HashKey       string         `json:"hash_key,omitempty"` // cookie or header name
+	VariantHeader string         `json:"variant_header,omitempty"`
+}
+
+func (s *TrafficSplit) validate() error {
+	if err := validateSplitBackends(s.Backends); err != nil {
+		return err
+	}
+
+	switch s.HashOn {
+	case HashOnRandom, HashOnClientIP:
+	case HashOnCookie, HashOnHeader:
+		if s.HashKey == "" {
+			return fmt.Errorf("%w: hashing on %s needs a hash_key", ErrInvalidRoute, s.HashOn)
+		}
+	default:
+		return fmt.Errorf("%w: unknown hash_on %q", ErrInvalidRoute, s.HashOn)
+	}
+	return nil
+}
+
+func validateSplitBackends(backends []SplitBackend) error {
+	if len(backends) < 2 {
+		return fmt.Errorf("%w: a split needs at least two backends", ErrInvalidRoute)
+	}
+
+	total := 0
+	for _, b := range backends {
+		if b.Pool == "" || b.Weight < 0 {
+			return fmt.Errorf("%w: split backend %q with weight %d", ErrInvalidRoute, b.Pool, b.Weight)
+		}
+		total += b.Weight
+	}
+
+	if total == 0 {
+		return fmt.Errorf("%w: split weights add up to 0", ErrInvalidRoute)
+	}
+	return nil
+}
+
+func (s *TrafficSplit) choose(req *http.Request) string {
+	total := 0
+	for _, b := range s.Backends {
+		total += b.Weight
+	}
+
+	var bucket int
+	if key, ok := s.hashKey(req); ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		bucket = int(h.Sum32() % uint32(total))
+	} else {
+		bucket = rand.IntN(total)
+	}
+
+	for _, b := range s.Backends {
+		if bucket < b.Weight {
+			return b.Pool
+		}
+		bucket -= b.Weight
+	}
+	return s.Backends[len(s.Backends)-1].Pool
+}
+
+func (s *TrafficSplit) hashKey(req *http.Request) (string, bool) {
+	switch s.HashOn {
+	case HashOnCookie:
+		if cookie, err := req.Cookie(s.HashKey); err == nil {
+			return cookie.Value, true
+		}
+	case HashOnHeader:
+		if value := req.Header.Get(s.HashKey); value != "" {
+			return value, true
+		}
+	case HashOnClientIP:
+		if attrs, ok := loadbalancer.RequestAttributesFrom(req.Context()); ok {
+			return attrs.ClientIP, attrs.ClientIP != ""
+		}
+
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		return host, host != ""
+	}
+	return "", false
+}
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+
+	"github.com/raydatray/goobernetes/pkg/metrics"
+)
+
+var ErrCertificatePinMismatch = errors.New("upstream certificate does not match any pin")
+
+// UpstreamTLSPolicy turns on TLS to a pool's servers. Certificates are
+// checked against CAFile, or the system roots without one, and the name in
+// ServerName, or the server's host without one. PinnedSHA256 holds base64
+// SHA-256 hashes of accepted public keys, checked on top of the usual
+// verification, or instead of it when InsecureSkipVerify is set.
+type UpstreamTLSPolicy struct {
+	CAFile             string   `json:"ca_file,omitempty"`
+	ServerName         string   `json:"server_name,omitempty"`
+	CertFile           string   `json:"cert_file,omitempty"`
+	KeyFile            string   `json:"key_file,omitempty"`
+	PinnedSHA256       []string `json:"pinned_sha256,omitempty"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify,omitempty"`
+
+	config *tls.Config
+}
+
+func (p *UpstreamTLSPolicy) validate() error {
+	config, err := p.ClientConfig()
+	if err != nil {
+		return err
+	}
+	p.config = config
+	return nil
+}
+
+// ClientConfig loads the policy's files into a tls.Config for connections
+// to the pool's servers, which health checks share.
+func (p *UpstreamTLSPolicy) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         p.ServerName,
+		InsecureSkipVerify: p.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if p.CAFile != "" {
+		pem, err := os.ReadFile(p.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidUpstreamPolicy, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in ca_file %s", ErrInvalidUpstreamPolicy, p.CAFile)
+		}
+	}
+
+	if (p.CertFile == "") != (p.KeyFile == "") {
+		return nil, fmt.Errorf("%w: cert_file and key_file must be set together", ErrInvalidUpstreamPolicy)
+	}
+
+	if p.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: client certificate: %v", ErrInvalidUpstreamPolicy, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	for _, pin := range p.PinnedSHA256 {
+		if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%w: pinned_sha256 %q is not a base64 SHA-256 hash", ErrInvalidUpstreamPolicy, pin)
+		}
+	}
+
+	if len(p.PinnedSHA256) > 0 {
+		pins := p.PinnedSHA256
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrCertificatePinMismatch
+			}
+
+			hash := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !slices.Contains(pins, base64.StdEncoding.EncodeToString(hash[:])) {
+				return ErrCertificatePinMismatch
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// handshakeError is a failed upstream TLS handshake, which dialTLS has
+// already reported to outlier detection.
+type handshakeError struct {
+	addr string
+	err  error
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("tls handshake with %s: %s", e.addr, e.err)
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// dialTLS wraps dial with a TLS handshake, counting failed handshakes so
+// they show up next to the errors they cause. Failed handshakes are reported
+// to observe, so failed verification and pinning count against the server.
+// Successful ones aren't, since a new connection says nothing about whether
+// the calls failing on the existing ones have stopped.
+func dialTLS(pool string, dial func(ctx context.Context, network, addr string) (net.Conn, error), config *tls.Config, protocol string, observe func(addr string)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := config.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		config.NextProtos = []string{"http/1.1"}
+		if protocol == ProtocolH2 {
+			config.NextProtos = []string{"h2"}
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			metrics.GetCounter(fmt.Sprintf("router_upstream_tls_errors_total{pool=%q}", pool)).Inc()
+			observe(addr)
+			return nil, &handshakeError{addr: addr, err: err}
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,460 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	defaultUpgradeIdleTimeout  = 5 * time.Minute
+	defaultUpgradeDrainTimeout = 5 * time.Second
+
+	wsOpClose        = 0x8
+	wsCloseGoingAway = 1001
+)
+
+var (
+	ErrUpgradeLimit       = errors.New("upgraded connection limit reached")
+	ErrUpgradeUnsupported = errors.New("connection can't be upgraded")
+)
+
+// UpgradePolicy applies to connections that switch protocols, like
+// WebSockets. An upgraded connection is closed after IdleTimeout without
+// traffic either way. When it is drained, WebSocket peers get a close frame
+// and DrainTimeout to finish the closing handshake.
+type UpgradePolicy struct {
+	IdleTimeout  util.Duration `json:"idle_timeout,omitempty"`
+	DrainTimeout util.Duration `json:"drain_timeout,omitempty"`
+}
+
+func (u *UpgradePolicy) validate() error {
+	if u.IdleTimeout < 0 || u.DrainTimeout < 0 {
+		return fmt.Errorf("%w: upgrade timeouts must not be negative", ErrInvalidUpstreamPolicy)
+	}
+
+	if u.IdleTimeout == 0 {
+		u.IdleTimeout = util.Duration(defaultUpgradeIdleTimeout)
+	}
+
+	if u.DrainTimeout == 0 {
+		u.DrainTimeout = util.Duration(defaultUpgradeDrainTimeout)
+	}
+	return nil
+}
+
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardUpgrade proxies a protocol upgrade to server. The server's request
+// slot is only held for the handshake; after that the connection counts
+// against its upgraded connections instead.
+func (r *Router) forwardUpgrade(w http.ResponseWriter, req *http.Request, pool string, lb loadbalancer.LoadBalancer, server loadbalancer.Server, upstream *upstream) {
+	instance := loadbalancer.InstanceOf(server)
+	if !instance.AcquireUpgraded() {
+		server.ReleaseConnection()
+		metrics.GetCounter(fmt.Sprintf("router_upgrades_rejected_total{pool=%q}", pool)).Inc()
+		http.Error(w, fmt.Sprintf("%s: %s", ErrUpgradeLimit.Error(), instance.ID), http.StatusServiceUnavailable)
+		return
+	}
+
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			instance.ReleaseUpgraded()
+		}
+	}()
+
+	start := time.Now()
+	backend, backendReader, resp, err := dialUpgrade(req, pool, server, upstream.policy, upstream.observeTLS)
+	server.ObserveResult(time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	server.ReleaseConnection()
+	if err != nil {
+		status := http.StatusBadGateway
+		if isTimeout(err) {
+			status = http.StatusGatewayTimeout
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	pin(lb, resp.Header, server)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer backend.Close()
+		defer resp.Body.Close()
+
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		backend.Close()
+		http.Error(w, ErrUpgradeUnsupported.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	client, clientRW, err := hijacker.Hijack()
+	if err != nil {
+		backend.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := resp.Write(clientRW); err != nil || clientRW.Flush() != nil {
+		backend.Close()
+		client.Close()
+		return
+	}
+
+	upgraded = true
+	conn := &upgradedConn{
+		pool:          pool,
+		instance:      instance,
+		policy:        upstream.policy.Upgrades,
+		websocket:     strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"),
+		client:        client,
+		clientReader:  clientRW.Reader,
+		backend:       backend,
+		backendReader: backendReader,
+		done:          make(chan struct{}),
+	}
+
+	r.trackUpgrade(conn, true)
+	defer r.trackUpgrade(conn, false)
+	conn.serve()
+}
+
+// dialUpgrade opens a dedicated connection to the server, since upgraded
+// connections never go back to the pool, and sends the handshake. It is
+// always HTTP/1.1, over TLS if the pool uses it.
+func dialUpgrade(req *http.Request, pool string, server loadbalancer.Server, policy UpstreamPolicy, observeTLS func(addr string)) (net.Conn, *bufio.Reader, *http.Response, error) {
+	timeouts := policy.Timeouts
+	dialer := &net.Dialer{Timeout: time.Duration(timeouts.Connect)}
+	dial := dialer.DialContext
+	if policy.ProxyProtocol != "" {
+		dial = dialProxyProtocol(dial, policy.ProxyProtocol)
+	}
+	if config := policy.tlsConfig(); config != nil {
+		dial = dialTLS(pool, dial, config, ProtocolHTTP1, observeTLS)
+	}
+
+	backend, err := dial(req.Context(), "tcp", server.GetHostPort())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = "http"
+	out.URL.Host = server.GetHostPort()
+	out.RequestURI = ""
+	if attrs, ok := loadbalancer.RequestAttributesFrom(req.Context()); ok && attrs.ClientIP != "" {
+		if prior := out.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			out.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+attrs.ClientIP)
+		} else {
+			out.Header.Set("X-Forwarded-For", attrs.ClientIP)
+		}
+	}
+
+	if timeout := time.Duration(timeouts.ResponseHeader); timeout > 0 {
+		backend.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if err := out.Write(backend); err != nil {
+		backend.Close()
+		return nil, nil, nil, err
+	}
+
+	reader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(reader, out)
+	if err != nil {
+		backend.Close()
+		return nil, nil, nil, err
+	}
+	backend.SetDeadline(time.Time{})
+	return backend, reader, resp, nil
+}
+
+func (r *Router) trackUpgrade(conn *upgradedConn, open bool) {
+	r.upgradesMu.Lock()
+	defer r.upgradesMu.Unlock()
+
+	gauge := metrics.GetGauge(fmt.Sprintf("router_upgraded_connections{pool=%q}", conn.pool))
+	if open {
+		r.upgrades[conn] = struct{}{}
+		gauge.Add(1)
+		metrics.GetCounter(fmt.Sprintf("router_upgrades_total{pool=%q}", conn.pool)).Inc()
+		return
+	}
+
+	delete(r.upgrades, conn)
+	gauge.Add(-1)
+	if len(r.upgrades) == 0 && r.upgradesDrained != nil {
+		close(r.upgradesDrained)
+		r.upgradesDrained = nil
+	}
+}
+
+// DrainUpgrades gracefully closes every upgraded connection, and waits for
+// them to finish or ctx to expire.
+func (r *Router) DrainUpgrades(ctx context.Context) error {
+	r.upgradesMu.Lock()
+	if len(r.upgrades) == 0 {
+		r.upgradesMu.Unlock()
+		return nil
+	}
+
+	if r.upgradesDrained == nil {
+		r.upgradesDrained = make(chan struct{})
+	}
+	drained := r.upgradesDrained
+	for conn := range r.upgrades {
+		go conn.drain()
+	}
+	r.upgradesMu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type upgradedConn struct {
+	pool          string
+	instance      *loadbalancer.ServerInstance
+	policy        UpgradePolicy
+	websocket     bool
+	client        net.Conn
+	clientReader  *bufio.Reader
+	clientMu      sync.Mutex // held while writing a frame to the client
+	backend       net.Conn
+	backendReader *bufio.Reader
+	backendMu     sync.Mutex // held while writing a frame to the backend
+	lastActive    atomic.Int64
+	draining      atomic.Bool
+	closeOnce     sync.Once
+	done          chan struct{}
+}
+
+func (c *upgradedConn) serve() {
+	defer c.instance.ReleaseUpgraded()
+	c.touch()
+
+	copied := make(chan struct{}, 2)
+	go func() {
+		c.copy(c.backend, &c.backendMu, c.clientReader)
+		copied <- struct{}{}
+	}()
+	go func() {
+		c.copy(c.client, &c.clientMu, c.backendReader)
+		copied <- struct{}{}
+	}()
+
+	interval := min(time.Duration(c.policy.IdleTimeout)/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-copied:
+			// One side is gone, so the other can't be used either.
+			c.close()
+			<-copied
+			return
+		case <-c.done:
+			<-copied
+			<-copied
+			return
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, c.lastActive.Load()))
+			if idle > time.Duration(c.policy.IdleTimeout) {
+				metrics.GetCounter(fmt.Sprintf("router_upgrades_idle_closed_total{pool=%q}", c.pool)).Inc()
+				go c.drain()
+			} else if !c.instance.IsActive() {
+				go c.drain()
+			}
+		}
+	}
+}
+
+func (c *upgradedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *upgradedConn) close() {
+	c.closeOnce.Do(func() {
+		c.client.Close()
+		c.backend.Close()
+		close(c.done)
+	})
+}
+
+// drain sends both WebSocket peers a going-away close frame and gives them
+// DrainTimeout to hang up. Anything else is closed straight away.
+func (c *upgradedConn) drain() {
+	if !c.websocket {
+		c.close()
+		return
+	}
+
+	if c.draining.Swap(true) {
+		return
+	}
+
+	c.clientMu.Lock()
+	_, err := c.client.Write(closeFrame(wsCloseGoingAway, false))
+	c.clientMu.Unlock()
+	if err != nil {
+		log.Printf("failed to send close frame to client: %v", err)
+	}
+
+	c.backendMu.Lock()
+	_, err = c.backend.Write(closeFrame(wsCloseGoingAway, true))
+	c.backendMu.Unlock()
+	if err != nil {
+		log.Printf("failed to send close frame to %s: %v", c.instance.ID, err)
+	}
+
+	timer := time.NewTimer(time.Duration(c.policy.DrainTimeout))
+	defer timer.Stop()
+
+	select {
+	case <-c.done:
+	case <-timer.C:
+		c.close()
+	}
+}
+
+// copy forwards src to dst. WebSocket traffic is copied a frame at a time
+// under mu, so a close frame can be slipped in between frames; once the
+// connection is draining, frames are read but no longer forwarded.
+func (c *upgradedConn) copy(dst net.Conn, mu *sync.Mutex, src *bufio.Reader) {
+	if !c.websocket {
+		io.Copy(dst, &activityReader{Reader: src, touch: c.touch})
+		return
+	}
+
+	for {
+		header, length, err := readFrameHeader(src)
+		if err != nil {
+			return
+		}
+		c.touch()
+
+		if c.draining.Load() {
+			if _, err := io.CopyN(io.Discard, src, length); err != nil {
+				return
+			}
+			continue
+		}
+
+		mu.Lock()
+		_, err = dst.Write(header)
+		if err == nil {
+			_, err = io.CopyN(dst, &activityReader{Reader: src, touch: c.touch}, length)
+		}
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+type activityReader struct {
+	io.Reader
+	touch func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.Reader.Read(p)
+	if n > 0 {
+		a.touch()
+	}
+	return n, err
+}
+
+// readFrameHeader reads a WebSocket frame header as-is, and returns it with
+// the payload length that follows.
+func readFrameHeader(r *bufio.Reader) ([]byte, int64, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := int64(header[1] & 0x7f)
+	extended := 0
+	switch length {
+	case 126:
+		extended = 2
+	case 127:
+		extended = 8
+	}
+
+	if header[1]&0x80 != 0 {
+		extended += 4 // masking key
+	}
+
+	header = header[:2+extended]
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, 0, err
+	}
+
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		length = int64(binary.BigEndian.Uint64(header[2:10]) & (1<<63 - 1))
+	}
+	return header, length, nil
+}
+
+// closeFrame builds a close frame with a status code. Frames sent to a
+// server have to be masked.
+func closeFrame(code uint16, masked bool) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	if !masked {
+		return append([]byte{0x80 | wsOpClose, byte(len(payload))}, payload...)
+	}
+
+	frame := []byte{0x80 | wsOpClose, 0x80 | byte(len(payload))}
+	key := make([]byte, 4)
+	rand.Read(key)
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
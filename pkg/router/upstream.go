@@ -0,0 +1,568 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolH2    = "h2"
+	ProtocolH2C   = "h2c"
+
+	RetryOnConnectFailure = "connect-failure"
+	RetryOnTimeout        = "timeout"
+
+	defaultBaseBackoff = 25 * time.Millisecond
+	defaultMaxBackoff  = 250 * time.Millisecond
+	maxRetryBodyBytes  = 1 << 20
+)
+
+var (
+	ErrInvalidUpstreamPolicy = errors.New("invalid upstream policy")
+
+	defaultRetryOn      = []string{RetryOnConnectFailure, RetryOnTimeout}
+	idempotentMethods   = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete}
+	retryableConditions = []string{RetryOnConnectFailure, RetryOnTimeout, "502", "503", "504"}
+)
+
+type TimeoutPolicy struct {
+	Connect        util.Duration `json:"connect,omitempty"`
+	ResponseHeader util.Duration `json:"response_header,omitempty"` // per attempt
+	Total          util.Duration `json:"total,omitempty"`           // across all attempts
+}
+
+// RetryPolicy retries failed attempts on a different server. MaxAttempts
+// counts the first attempt, so 1 disables retries. gRPC calls are only
+// retried when RetryOn names a gRPC status, such as unavailable.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"max_attempts,omitempty"`
+	RetryOn     []string      `json:"retry_on,omitempty"`
+	Methods     []string      `json:"methods,omitempty"`
+	BaseBackoff util.Duration `json:"base_backoff,omitempty"`
+	MaxBackoff  util.Duration `json:"max_backoff,omitempty"`
+	Budget      RetryBudget   `json:"budget"`
+}
+
+// UpstreamPolicy is how the router talks to a pool's servers. Protocol is
+// http1 (the default), h2 for HTTP/2 over TLS or h2c for cleartext HTTP/2.
+// Setting TLS sends http1 over TLS too.
+type UpstreamPolicy struct {
+	Protocol      string               `json:"protocol,omitempty"`
+	ProxyProtocol string               `json:"proxy_protocol,omitempty"` // PROXY header version to send, v1 or v2
+	TLS           *UpstreamTLSPolicy   `json:"tls,omitempty"`
+	Timeouts      TimeoutPolicy        `json:"timeouts"`
+	Retry         RetryPolicy          `json:"retry"`
+	Hedge         *HedgePolicy         `json:"hedge,omitempty"`
+	Connections   ConnectionPoolPolicy `json:"connections"`
+	Upgrades      UpgradePolicy        `json:"upgrades"`
+}
+
+// ValidateUpstreamPolicy reports whether SetUpstreamPolicy would accept the
+// policy.
+func ValidateUpstreamPolicy(policy UpstreamPolicy) error {
+	return policy.validate()
+}
+
+func (p *UpstreamPolicy) validate() error {
+	switch p.Protocol {
+	case "":
+		p.Protocol = ProtocolHTTP1
+	case ProtocolHTTP1, ProtocolH2, ProtocolH2C:
+	default:
+		return fmt.Errorf("%w: unknown protocol %q", ErrInvalidUpstreamPolicy, p.Protocol)
+	}
+
+	switch p.ProxyProtocol {
+	case "", util.ProxyProtocolV1, util.ProxyProtocolV2:
+	default:
+		return fmt.Errorf("%w: unknown proxy_protocol %q", ErrInvalidUpstreamPolicy, p.ProxyProtocol)
+	}
+
+	if p.ProxyProtocol != "" && p.Multiplexed() {
+		return fmt.Errorf("%w: proxy_protocol needs a connection per client, which %s shares", ErrInvalidUpstreamPolicy, p.Protocol)
+	}
+
+	if p.TLS != nil {
+		if p.Protocol == ProtocolH2C {
+			return fmt.Errorf("%w: h2c is cleartext and can't be used with tls", ErrInvalidUpstreamPolicy)
+		}
+
+		tlsPolicy := *p.TLS
+		if err := tlsPolicy.validate(); err != nil {
+			return err
+		}
+		p.TLS = &tlsPolicy
+	} else if p.Protocol == ProtocolH2 {
+		p.TLS = &UpstreamTLSPolicy{}
+		if err := p.TLS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if p.Timeouts.Connect < 0 || p.Timeouts.ResponseHeader < 0 || p.Timeouts.Total < 0 {
+		return fmt.Errorf("%w: timeouts must not be negative", ErrInvalidUpstreamPolicy)
+	}
+
+	if p.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("%w: max_attempts %d", ErrInvalidUpstreamPolicy, p.Retry.MaxAttempts)
+	}
+
+	if p.Retry.MaxAttempts == 0 {
+		p.Retry.MaxAttempts = 1
+	}
+
+	for _, condition := range p.Retry.RetryOn {
+		if _, ok := grpcRetryConditions[condition]; !ok && !slices.Contains(retryableConditions, condition) {
+			return fmt.Errorf("%w: unknown retry_on condition %q", ErrInvalidUpstreamPolicy, condition)
+		}
+	}
+
+	if len(p.Retry.RetryOn) == 0 {
+		p.Retry.RetryOn = defaultRetryOn
+	}
+
+	if len(p.Retry.Methods) == 0 {
+		p.Retry.Methods = idempotentMethods
+	}
+
+	if p.Retry.BaseBackoff <= 0 {
+		p.Retry.BaseBackoff = util.Duration(defaultBaseBackoff)
+	}
+
+	if p.Retry.MaxBackoff <= 0 {
+		p.Retry.MaxBackoff = util.Duration(defaultMaxBackoff)
+	}
+
+	if p.Hedge != nil {
+		hedge := *p.Hedge
+		if err := hedge.validate(); err != nil {
+			return err
+		}
+		p.Hedge = &hedge
+	}
+	if err := p.Connections.validate(); err != nil {
+		return err
+	}
+
+	if err := p.Upgrades.validate(); err != nil {
+		return err
+	}
+	return p.Retry.Budget.validate()
+}
+
+// Multiplexed reports whether requests to the pool share connections as
+// HTTP/2 streams.
+func (p *UpstreamPolicy) Multiplexed() bool {
+	return p.Protocol == ProtocolH2 || p.Protocol == ProtocolH2C
+}
+
+// ClientTLSConfig returns the TLS settings for connections to the pool's
+// servers, or nil if they are cleartext.
+func (p *UpstreamPolicy) ClientTLSConfig() (*tls.Config, error) {
+	if p.TLS != nil {
+		return p.TLS.ClientConfig()
+	}
+
+	if p.Protocol == ProtocolH2 {
+		return (&UpstreamTLSPolicy{}).ClientConfig()
+	}
+	return nil, nil
+}
+
+// equal compares two validated policies by their settings, ignoring the TLS
+// config loaded from them.
+func (p *UpstreamPolicy) equal(other *UpstreamPolicy) bool {
+	a, b := *p, *other
+	for _, policy := range []*UpstreamPolicy{&a, &b} {
+		if policy.TLS != nil {
+			tlsPolicy := *policy.TLS
+			tlsPolicy.config = nil
+			policy.TLS = &tlsPolicy
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (p *UpstreamPolicy) tlsConfig() *tls.Config {
+	if p.TLS == nil {
+		return nil
+	}
+	return p.TLS.config
+}
+
+// backoff is exponential with full jitter.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	ceiling := min(time.Duration(p.MaxBackoff), time.Duration(p.BaseBackoff)<<retry)
+	return rand.N(ceiling + 1)
+}
+
+func (p *RetryPolicy) allowsMethod(method string) bool {
+	return p.MaxAttempts > 1 && slices.Contains(p.Methods, method)
+}
+
+// upstream is a pool's long-lived reverse proxy and connection pool. Per
+// request state travels in the request context as an attemptTransport.
+type upstream struct {
+	policy     UpstreamPolicy
+	conns      *connectionPool
+	proxy      *httputil.ReverseProxy
+	budget     *retryBucket    // nil when retries are off
+	latency    *latencyTracker // nil when hedging is off
+	observeTLS func(addr string)
+}
+
+type attemptKey struct{}
+
+func newUpstream(pool string, policy UpstreamPolicy, observeTLS func(addr string)) *upstream {
+	u := &upstream{
+		policy:     policy,
+		conns:      newConnectionPool(pool, policy.Protocol, policy.ProxyProtocol, policy.Timeouts, policy.Connections, policy.tlsConfig(), observeTLS),
+		observeTLS: observeTLS,
+	}
+	u.proxy = &httputil.ReverseProxy{
+		Director:       u.direct,
+		Transport:      u,
+		ModifyResponse: u.modifyResponse,
+		ErrorHandler:   u.handleError,
+	}
+
+	if policy.Retry.MaxAttempts > 1 {
+		u.budget = newRetryBucket(pool, policy.Retry.Budget)
+	}
+	if policy.Hedge != nil {
+		u.latency = newLatencyTracker()
+	}
+	return u
+}
+
+func attemptFrom(ctx context.Context) *attemptTransport {
+	return ctx.Value(attemptKey{}).(*attemptTransport)
+}
+
+func (u *upstream) direct(req *http.Request) {
+	u.directTo(req, attemptFrom(req.Context()).server)
+}
+
+// directTo points req at server, the rewrite shared by proxied and mirrored
+// requests.
+func (u *upstream) directTo(req *http.Request, server loadbalancer.Server) {
+	req.URL.Scheme = "http"
+	if u.policy.TLS != nil {
+		req.URL.Scheme = "https"
+	}
+	req.URL.Host = server.GetHostPort()
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// explicitly disable User-Agent so it's not set to default value
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	return attemptFrom(req.Context()).RoundTrip(req)
+}
+
+func (u *upstream) modifyResponse(resp *http.Response) error {
+	attempt := attemptFrom(resp.Request.Context())
+	attempt.failed = resp.StatusCode >= http.StatusInternalServerError
+	pin(attempt.lb, resp.Header, attempt.server)
+	if isGRPC(resp.Request) {
+		u.observeGRPC(resp, attempt)
+	}
+	return nil
+}
+
+func (u *upstream) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	attempt := attemptFrom(req.Context())
+	attempt.failed = true
+	if isGRPC(req) {
+		attempt.observeFailure(req, err)
+		code := util.GRPCUnavailable
+		if isTimeout(err) {
+			code = util.GRPCDeadlineExceeded
+		}
+		util.WriteGRPCError(w, code, err.Error())
+		return
+	}
+
+	switch {
+	case isTimeout(err):
+		http.Error(w, fmt.Sprintf("upstream timeout: %s", err.Error()), http.StatusGatewayTimeout)
+	case errors.Is(err, ErrConnectionPoolExhausted):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// SetUpstreamPolicy configures timeouts, retries, hedging and connection
+// pooling for requests to a pool. Setting the policy already in force is a
+// no-op, so the pool keeps its connections, retry budget and latency
+// history, and its TLS files aren't read again.
+func (r *Router) SetUpstreamPolicy(pool string, policy UpstreamPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old, ok := r.upstreams[pool]; ok {
+		if old.policy.equal(&policy) {
+			return nil
+		}
+		old.conns.close()
+	}
+	r.upstreams[pool] = newUpstream(pool, policy, r.observeTLS(pool))
+	return nil
+}
+
+// PruneUpstreams drops the upstreams of pools that are no longer registered,
+// closing their idle connections.
+func (r *Router) PruneUpstreams() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for pool, u := range r.upstreams {
+		if _, err := r.pools.GetPool(pool); err != nil {
+			u.conns.close()
+			delete(r.upstreams, pool)
+		}
+	}
+}
+
+// observeTLS reports failed TLS handshakes with the pool's servers to its
+// outlier detector, looked up every time since reloads replace it.
+func (r *Router) observeTLS(pool string) func(addr string) {
+	return func(addr string) {
+		if p, err := r.pools.GetPool(pool); err == nil {
+			p.OutlierDetector().ObserveAddr(addr, true)
+		}
+	}
+}
+
+// UpstreamPolicy returns the policy in force for a pool, which is the
+// default one until SetUpstreamPolicy is called.
+func (r *Router) UpstreamPolicy(pool string) UpstreamPolicy {
+	return r.upstream(pool).policy
+}
+
+// upstream returns the pool's upstream, creating one with the default
+// policy the first time a pool without a configured policy is used.
+func (r *Router) upstream(pool string) *upstream {
+	r.mu.RLock()
+	u, ok := r.upstreams[pool]
+	r.mu.RUnlock()
+	if ok {
+		return u
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if u, ok := r.upstreams[pool]; ok {
+		return u
+	}
+
+	var policy UpstreamPolicy
+	policy.validate()
+	u = newUpstream(pool, policy, r.observeTLS(pool))
+	r.upstreams[pool] = u
+	return u
+}
+
+// attemptTransport runs the proxied request against the server picked by the
+// router, hedging and retrying on other servers from the same load balancer
+// when the policy allows. After RoundTrip returns, server holds the connection that
+// produced the response and the caller must release it.
+type attemptTransport struct {
+	base     http.RoundTripper
+	lb       loadbalancer.LoadBalancer
+	pool     string
+	policy   RetryPolicy
+	budget   *retryBucket
+	hedge    *HedgePolicy
+	latency  *latencyTracker
+	outliers *loadbalancer.OutlierDetector // nil without outlier detection
+	server   loadbalancer.Server
+	body     []byte      // replayable request body, nil when retries are off
+	stream   *replayBody // gRPC request body, recorded by the first attempt
+	retries  bool
+	attempts int
+	start    time.Time
+	failed   bool
+}
+
+func (t *attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[string]bool)
+
+	for {
+		t.attempts++
+		t.start = time.Now()
+
+		var resp *http.Response
+		var err error
+		if t.hedge != nil && req.Method == http.MethodGet && (req.Body == nil || req.Body == http.NoBody) {
+			resp, err = t.sendHedged(req, tried)
+		} else {
+			resp, err = t.send(req, t.server)
+		}
+		if !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		if !t.budget.tryRetry() {
+			return resp, err
+		}
+
+		tried[loadbalancer.InstanceOf(t.server).ID] = true
+		if !sleepContext(req.Context(), t.policy.backoff(t.attempts-1)) {
+			return resp, err
+		}
+
+		next, ok := t.nextServer(req.Context(), tried)
+		if !ok {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t.observeFailure(req, err)
+		t.server.ObserveResult(time.Since(t.start), true)
+		t.server.ReleaseConnection()
+		t.server = next
+
+		metrics.GetCounter(fmt.Sprintf("router_retries_total{pool=%q}", t.pool)).Inc()
+	}
+}
+
+// observeFailure reports a failed attempt to the pool's outlier detection.
+// Failed handshakes were already reported by the dialer, and a cancelled
+// request or an exhausted connection pool isn't the server's doing.
+func (t *attemptTransport) observeFailure(req *http.Request, err error) {
+	var handshake *handshakeError
+	if req.Context().Err() != nil || errors.As(err, &handshake) || errors.Is(err, ErrConnectionPoolExhausted) {
+		return
+	}
+	t.outliers.Observe(t.server, true)
+}
+
+func (t *attemptTransport) send(req *http.Request, server loadbalancer.Server) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Host = server.GetHostPort()
+	if t.retries && t.body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(t.body))
+	} else if t.stream != nil && t.attempts > 1 {
+		out.Body = t.stream.replay()
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(out)
+	if err == nil && t.latency != nil {
+		t.latency.observe(time.Since(start))
+	}
+	return resp, err
+}
+
+func (t *attemptTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if !t.retries || t.attempts >= t.policy.MaxAttempts || req.Context().Err() != nil {
+		return false
+	}
+
+	if t.stream != nil && !t.stream.replayable() {
+		return false
+	}
+
+	var condition string
+	switch {
+	case err != nil && isTimeout(err):
+		condition = RetryOnTimeout
+	case err != nil:
+		condition = RetryOnConnectFailure
+	case isGRPC(req) && resp.StatusCode == http.StatusOK:
+		condition = grpcRetryCondition(resp)
+	default:
+		condition = strconv.Itoa(resp.StatusCode)
+	}
+	return slices.Contains(t.policy.RetryOn, condition)
+}
+
+// nextServer asks the load balancer for a server that hasn't been tried yet,
+// giving back any repeats.
+func (t *attemptTransport) nextServer(ctx context.Context, tried map[string]bool) (loadbalancer.Server, bool) {
+	for range t.lb.GetServers() {
+		server, err := t.lb.NextServer(ctx)
+		if err != nil {
+			return nil, false
+		}
+
+		if !tried[loadbalancer.InstanceOf(server).ID] {
+			return server, true
+		}
+		server.ReleaseConnection()
+	}
+	return nil, false
+}
+
+// prepareRetries buffers a small request body so it can be replayed, and
+// reports whether the request may be retried at all.
+func prepareRetries(req *http.Request, policy RetryPolicy) ([]byte, bool) {
+	if !policy.allowsMethod(req.Method) {
+		return nil, false
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	if req.ContentLength < 0 || req.ContentLength > maxRetryBodyBytes {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBodyBytes+1))
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) > maxRetryBodyBytes {
+		return nil, false
+	}
+	return body, true
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
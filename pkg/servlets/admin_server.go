@@ -0,0 +1,237 @@
+package servlets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+type AdminServer struct {
+	pools  *loadbalancer.PoolManager
+	routes *router.RouteTable
+	host   string
+	port   int
+	server *http.Server
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewAdminServer serves the admin API on host and port. The API can drain and
+// reroute every pool, so host should stay a loopback or otherwise private
+// address.
+func NewAdminServer(pools *loadbalancer.PoolManager, routes *router.RouteTable, host string, port int) *AdminServer {
+	return &AdminServer{
+		pools:  pools,
+		routes: routes,
+		host:   host,
+		port:   port,
+	}
+}
+
+func (s *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /pools", s.listPools)
+	mux.HandleFunc("GET /pools/{pool}", s.getPool)
+	mux.HandleFunc("GET /pools/{pool}/servers", s.listServers)
+	mux.HandleFunc("PUT /pools/{pool}/servers/{id}/weight", s.updateServerWeight)
+	mux.HandleFunc("PUT /pools/{pool}/servers/{id}/max-conns", s.updateServerMaxConn)
+	mux.HandleFunc("PUT /pools/{pool}/servers/{id}/status", s.setServerStatus)
+	mux.HandleFunc("GET /routes", s.listRoutes)
+	mux.HandleFunc("PUT /routes", s.replaceRoutes)
+	mux.HandleFunc("POST /routes", s.addRoute)
+	mux.HandleFunc("DELETE /routes/{name}", s.removeRoute)
+	mux.HandleFunc("PUT /routes/{name}/split", s.updateSplitWeights)
+	mux.Handle("GET /metrics", metrics.DefaultRegistry)
+
+	return mux
+}
+
+func (s *AdminServer) Start() error {
+	s.server = &http.Server{
+		Addr:    net.JoinHostPort(s.host, strconv.Itoa(s.port)),
+		Handler: s.Handler(),
+	}
+
+	fmt.Printf("Admin API started on %s\n", s.server.Addr)
+	return s.server.ListenAndServe()
+}
+
+func (s *AdminServer) Stop() error {
+	if s.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return s.server.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (s *AdminServer) listPools(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.pools.Status())
+}
+
+func (s *AdminServer) getPool(w http.ResponseWriter, r *http.Request) {
+	pool, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Status())
+}
+
+func (s *AdminServer) listServers(w http.ResponseWriter, r *http.Request) {
+	pool, ok := s.lookupPool(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, pool.Status().Servers)
+}
+
+func (s *AdminServer) updateServerWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Weight int `json:"weight"`
+	}
+	pool, ok := s.lookupPool(w, r)
+	if !ok || !decodeJSON(w, r, &body) {
+		return
+	}
+	writeAdminResult(w, pool.UpdateServerWeight(r.PathValue("id"), body.Weight))
+}
+
+func (s *AdminServer) updateServerMaxConn(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MaxConns int `json:"max_conns"`
+	}
+	pool, ok := s.lookupPool(w, r)
+	if !ok || !decodeJSON(w, r, &body) {
+		return
+	}
+	writeAdminResult(w, pool.UpdateServerMaxConn(r.PathValue("id"), body.MaxConns))
+}
+
+func (s *AdminServer) setServerStatus(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Active bool `json:"active"`
+	}
+	pool, ok := s.lookupPool(w, r)
+	if !ok || !decodeJSON(w, r, &body) {
+		return
+	}
+	writeAdminResult(w, pool.SetServerStatus(r.PathValue("id"), body.Active))
+}
+
+func (s *AdminServer) listRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.routes.GetRoutes())
+}
+
+func (s *AdminServer) replaceRoutes(w http.ResponseWriter, r *http.Request) {
+	var routes []router.Route
+	if !decodeJSON(w, r, &routes) {
+		return
+	}
+
+	for _, route := range routes {
+		if !s.checkRoutePools(w, route) {
+			return
+		}
+	}
+	writeAdminResult(w, s.routes.SetRoutes(routes))
+}
+
+func (s *AdminServer) addRoute(w http.ResponseWriter, r *http.Request) {
+	var route router.Route
+	if !decodeJSON(w, r, &route) || !s.checkRoutePools(w, route) {
+		return
+	}
+
+	err := s.routes.AddRoute(route)
+	if errors.Is(err, router.ErrRouteAlreadyExists) {
+		writeJSON(w, http.StatusConflict, adminErrorResponse{Error: err.Error()})
+		return
+	}
+	writeAdminResult(w, err)
+}
+
+func (s *AdminServer) removeRoute(w http.ResponseWriter, r *http.Request) {
+	writeAdminResult(w, s.routes.RemoveRoute(r.PathValue("name")))
+}
+
+func (s *AdminServer) updateSplitWeights(w http.ResponseWriter, r *http.Request) {
+	var backends []router.SplitBackend
+	if !decodeJSON(w, r, &backends) {
+		return
+	}
+
+	pools := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		pools = append(pools, backend.Pool)
+	}
+	if !s.checkPools(w, r.PathValue("name"), pools) {
+		return
+	}
+	writeAdminResult(w, s.routes.UpdateSplitWeights(r.PathValue("name"), backends))
+}
+
+func (s *AdminServer) lookupPool(w http.ResponseWriter, r *http.Request) (*loadbalancer.Pool, bool) {
+	pool, err := s.pools.GetPool(r.PathValue("pool"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, adminErrorResponse{Error: err.Error()})
+		return nil, false
+	}
+	return pool, true
+}
+
+// checkRoutePools rejects a route sending traffic to a pool that doesn't
+// exist. An unknown pool is a bad request body here, not a missing resource.
+func (s *AdminServer) checkRoutePools(w http.ResponseWriter, route router.Route) bool {
+	return s.checkPools(w, route.Name, route.Pools())
+}
+
+func (s *AdminServer) checkPools(w http.ResponseWriter, route string, pools []string) bool {
+	for _, pool := range pools {
+		if pool == "" {
+			continue // left for the route table to reject
+		}
+
+		if _, err := s.pools.GetPool(pool); err != nil {
+			writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: fmt.Sprintf("route %s: %v: %s", route, err, pool)})
+			return false
+		}
+	}
+	return true
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, loadbalancer.ErrServerNotFound), errors.Is(err, router.ErrRouteNotFound):
+		writeJSON(w, http.StatusNotFound, adminErrorResponse{Error: err.Error()})
+	default:
+		writeJSON(w, http.StatusBadRequest, adminErrorResponse{Error: err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
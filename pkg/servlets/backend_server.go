@@ -7,44 +7,85 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+const maxGRPCMessageBytes = 4 << 20
+
 type BackendServer struct {
 	port   int
+	grpc   bool
 	server *http.Server
 }
 
-func NewBackendServer(port int) *BackendServer {
+// NewBackendServer creates a mock backend. In gRPC mode it speaks cleartext
+// HTTP/2, answers grpc.health.v1 health checks and echoes every other call.
+func NewBackendServer(port int, grpc bool) *BackendServer {
 	return &BackendServer{
 		port: port,
+		grpc: grpc,
 	}
 }
 
 func (s *BackendServer) Start() error {
-	s.server = &http.Server{
-		Addr: fmt.Sprintf(":%d", s.port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("X-Backend-Server", fmt.Sprintf("backend-%d", s.port))
-			fmt.Fprintf(w, "Backend Server Port: %d\n\n", s.port)
-
-			fmt.Fprintf(w, "Request Headers:\n")
-			headers := make([]string, 0, len(r.Header))
-			for name := range r.Header {
-				headers = append(headers, name)
-			}
-			sort.Strings(headers)
+	var handler http.Handler = http.HandlerFunc(s.serveHTTP)
+	if s.grpc {
+		handler = h2c.NewHandler(http.HandlerFunc(s.serveGRPC), &http2.Server{})
+	}
 
-			for _, name := range headers {
-				values := r.Header[name]
-				fmt.Fprintf(w, "%s: %s\n", name, strings.Join(values, ", "))
-			}
-		}),
+	s.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.port),
+		Handler: handler,
 	}
 
 	fmt.Printf("Starting backend server on port %d\n", s.port)
 	return s.server.ListenAndServe()
 }
 
+func (s *BackendServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Backend-Server", fmt.Sprintf("backend-%d", s.port))
+	fmt.Fprintf(w, "Backend Server Port: %d\n\n", s.port)
+
+	fmt.Fprintf(w, "Request Headers:\n")
+	headers := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		headers = append(headers, name)
+	}
+	sort.Strings(headers)
+
+	for _, name := range headers {
+		values := r.Header[name]
+		fmt.Fprintf(w, "%s: %s\n", name, strings.Join(values, ", "))
+	}
+}
+
+func (s *BackendServer) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Backend-Server", fmt.Sprintf("backend-%d", s.port))
+	if r.ProtoMajor != 2 || !util.IsGRPC(r.Header.Get("Content-Type")) {
+		http.Error(w, "expected a gRPC call over HTTP/2", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	msg, err := util.ReadGRPCFrame(r.Body, maxGRPCMessageBytes)
+	if err != nil {
+		util.WriteGRPCError(w, util.GRPCInternal, err.Error())
+		return
+	}
+
+	reply := msg
+	if r.URL.Path == "/grpc.health.v1.Health/Check" {
+		reply = util.EncodeHealthCheckResponse(util.HealthServing)
+	}
+
+	w.Header().Set("Content-Type", util.GRPCContentType)
+	w.Header().Set("Trailer", "Grpc-Status")
+	util.WriteGRPCFrame(w, reply)
+	w.Header().Set("Grpc-Status", "0")
+}
+
 func (s *BackendServer) Stop() error {
 	if s.server != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -0,0 +1,85 @@
+package servlets
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+)
+
+var ErrHTTP3WithoutTLS = errors.New("http3 requires a TLS listener")
+
+// altSvcMaxAge is how long, in seconds, clients may remember that the
+// listener speaks HTTP/3.
+const altSvcMaxAge = 86400
+
+// newHTTP3Server serves handler over QUIC on the UDP port with the same
+// number as the TLS listener. 0-RTT stays off, as early data can be
+// replayed.
+func newHTTP3Server(port int, config *tls.Config, handler http.Handler) *http3.Server {
+	return &http3.Server{
+		Addr:       fmt.Sprintf(":%d", port),
+		Port:       port,
+		TLSConfig:  config,
+		QUICConfig: &quic.Config{Tracer: quicTracer(port)},
+		Handler:    handler,
+	}
+}
+
+// advertiseHTTP3 tells clients of the TCP listener where to find HTTP/3.
+func advertiseHTTP3(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", altSvc)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// quicTracer counts QUIC connections, and the ones that closed before
+// their handshake completed.
+func quicTracer(port int) func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+	total := metrics.GetCounter(fmt.Sprintf("listener_quic_connections_total{port=\"%d\"}", port))
+	active := metrics.GetGauge(fmt.Sprintf("listener_quic_connections_active{port=\"%d\"}", port))
+	failures := metrics.GetCounter(fmt.Sprintf("listener_quic_handshake_failures_total{port=\"%d\"}", port))
+
+	return func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+		var started, handshaken atomic.Bool
+		var closeOnce sync.Once
+		closed := func() {
+			closeOnce.Do(func() {
+				if !started.Load() {
+					return
+				}
+				active.Add(-1)
+				if !handshaken.Load() {
+					failures.Inc()
+				}
+			})
+		}
+
+		return &logging.ConnectionTracer{
+			StartedConnection: func(_, _ net.Addr, _, _ logging.ConnectionID) {
+				started.Store(true)
+				total.Inc()
+				active.Add(1)
+			},
+			// The server drops its handshake keys once the handshake is done.
+			DroppedEncryptionLevel: func(level logging.EncryptionLevel) {
+				if level == logging.EncryptionHandshake {
+					handshaken.Store(true)
+				}
+			},
+			ClosedConnection: func(error) { closed() },
+			Close:            closed,
+		}
+	}
+}
@@ -2,34 +2,76 @@ package servlets
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
 	"github.com/raydatray/goobernetes/pkg/middleware"
 	"github.com/raydatray/goobernetes/pkg/router"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// ListenerConfig sets the protocols the load balancer accepts. With TLS
+// it serves HTTPS and negotiates HTTP/2; without it serves HTTP/1.1, plus
+// cleartext HTTP/2 if H2C is set. HTTP3 also serves HTTP/3 over QUIC on
+// the same port number and advertises it with Alt-Svc; it needs TLS.
+// ProxyProtocol takes client addresses from PROXY headers sent by a
+// balancer in front.
+type ListenerConfig struct {
+	TLS                  *TLSConfig
+	H2C                  bool
+	HTTP3                bool
+	MaxConcurrentStreams uint32
+	ProxyProtocol        *ProxyProtocolConfig
+}
+
 type HttpServer struct {
-	router router.RequestRouter
-	port   int
-	server *http.Server
+	router   router.RequestRouter
+	port     int
+	proxies  *loadbalancer.TrustedProxies
+	listener ListenerConfig
+	server   *http.Server
+	h3       *http3.Server
 }
 
-func NewHttpServer(router router.RequestRouter, port int) *HttpServer {
+func NewHttpServer(router router.RequestRouter, port int, proxies *loadbalancer.TrustedProxies, listener ListenerConfig) *HttpServer {
 	return &HttpServer{
-		router: router,
-		port:   port,
+		router:   router,
+		port:     port,
+		proxies:  proxies,
+		listener: listener,
 	}
 }
 
 func (s *HttpServer) Start() error {
     mux := http.NewServeMux()
 
-    handler := middleware.Chain(
+    // Identity headers are dropped on every listener, before routing, so
+    // clients can't forge them where there are no client certificates.
+    var auth *ClientAuthConfig
+    subjectHeader, uriHeader := defaultSubjectHeader, defaultURIHeader
+    if s.listener.TLS != nil && s.listener.TLS.ClientAuth != nil {
+        auth = s.listener.TLS.ClientAuth
+        subjectHeader, uriHeader = auth.headers()
+    }
+
+    middlewares := []middleware.Middleware{
+        middleware.RequestAttributesMiddleware(s.proxies),
+        middleware.StripIdentityHeadersMiddleware(defaultSubjectHeader, defaultURIHeader, subjectHeader, uriHeader),
+    }
+    if auth != nil {
+        middlewares = append(middlewares, middleware.ClientIdentityMiddleware(auth.Allow, subjectHeader, uriHeader))
+    }
+
+    handler := middleware.Chain(append(middlewares,
         middleware.HeadersMiddleware(fmt.Sprintf("goobernetes-lb-%d", s.port)),
         middleware.RateLimiterMiddleware(100), // Allow 100 requests per second
-    )(s.router.ServeRequest)
+    )...)(s.router.ServeRequest)
 
     mux.HandleFunc("/", handler)
 
@@ -38,11 +80,90 @@ func (s *HttpServer) Start() error {
         Handler: mux,
     }
 
+    h2 := &http2.Server{MaxConcurrentStreams: s.listener.MaxConcurrentStreams}
+    if s.listener.HTTP3 && s.listener.TLS == nil {
+        return ErrHTTP3WithoutTLS
+    }
+
+    var certs *CertificateStore
+    if s.listener.TLS != nil {
+        var err error
+        if certs, err = NewCertificateStore(*s.listener.TLS); err != nil {
+            return fmt.Errorf("tls listener: %w", err)
+        }
+    }
+
+    listener, err := net.Listen("tcp", s.server.Addr)
+    if err != nil {
+        return err
+    }
+    if s.listener.ProxyProtocol != nil {
+        wrapped, err := newProxyProtocolListener(listener, s.port, *s.listener.ProxyProtocol)
+        if err != nil {
+            listener.Close()
+            return err
+        }
+        listener = wrapped
+    }
+
+    if certs != nil {
+        s.server.TLSConfig = certs.TLSConfig()
+        if err := http2.ConfigureServer(s.server, h2); err != nil {
+            listener.Close()
+            return err
+        }
+
+        ctx, cancel := context.WithCancel(context.Background())
+        defer cancel()
+        go certs.Watch(ctx)
+
+        if s.listener.HTTP3 {
+            udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.port})
+            if err != nil {
+                listener.Close()
+                return err
+            }
+            defer udp.Close()
+            s.h3 = newHTTP3Server(s.port, certs.TLSConfig(), mux)
+            s.server.Handler = advertiseHTTP3(s.port, mux)
+
+            // A failed QUIC listener takes the TCP one down with it, so the
+            // listener fails as a whole like it would for a TCP error.
+            h3Err := make(chan error, 1)
+            go func() {
+                if err := s.h3.Serve(udp); err != nil && !errors.Is(err, http.ErrServerClosed) {
+                    h3Err <- fmt.Errorf("http3 listener: %w", err)
+                    s.server.Close()
+                }
+            }()
+
+            fmt.Printf("Load balancer started on port %d (https, h2, h3)\n", s.port)
+            err = s.server.ServeTLS(listener, "", "")
+            select {
+            case err := <-h3Err:
+                return err
+            default:
+                s.h3.Close()
+                return err
+            }
+        }
+
+        fmt.Printf("Load balancer started on port %d (https, h2)\n", s.port)
+        return s.server.ServeTLS(listener, "", "")
+    }
+
+    if s.listener.H2C {
+        s.server.Handler = h2c.NewHandler(mux, h2)
+    }
+
     fmt.Printf("Load balancer started on port %d\n", s.port)
-    return s.server.ListenAndServe()
+    return s.server.Serve(listener)
 }
 
 func (s *HttpServer) Stop() error {
+	if s.h3 != nil {
+		s.h3.Close()
+	}
 	if s.server != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -0,0 +1,135 @@
+package servlets
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspFetchTimeout    = 10 * time.Second
+	ocspRetryInterval   = time.Minute
+	maxOCSPResponseSize = 1 << 20
+)
+
+// ocspStaple is the certificate being served with a staple and the staple's
+// parsed response, kept to know when it is due for a refresh or has expired.
+// response is nil once an expired staple has been dropped.
+type ocspStaple struct {
+	cert     *tls.Certificate
+	response *ocsp.Response
+	fetch    bool
+}
+
+// issuerOf returns the certificate that signed cert's leaf, which is the
+// next one in its chain. Without it staples are matched to the leaf by
+// serial number only, and can't be fetched.
+func issuerOf(cert *tls.Certificate) *x509.Certificate {
+	if len(cert.Certificate) < 2 {
+		return nil
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil
+	}
+	return issuer
+}
+
+// parseStaple accepts raw only if it is a signed OCSP response saying that
+// cert's leaf is good, and it hasn't passed its NextUpdate.
+func parseStaple(raw []byte, cert *tls.Certificate) (*ocsp.Response, error) {
+	response, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuerOf(cert))
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, fmt.Errorf("certificate was revoked on %s", response.RevokedAt.Format(time.RFC3339))
+	default:
+		return nil, errors.New("certificate status is unknown")
+	}
+
+	if !response.NextUpdate.IsZero() && time.Now().After(response.NextUpdate) {
+		return nil, fmt.Errorf("staple expired on %s", response.NextUpdate.Format(time.RFC3339))
+	}
+	return response, nil
+}
+
+// due reports whether the staple is past half of its validity, when a
+// fresh one should be fetched so it is in place well before this one
+// expires, or has already been dropped.
+func (s *ocspStaple) due(now time.Time) bool {
+	if s.response == nil {
+		return true
+	}
+
+	if s.response.NextUpdate.IsZero() {
+		return false
+	}
+
+	validity := s.response.NextUpdate.Sub(s.response.ThisUpdate)
+	return !now.Before(s.response.ThisUpdate.Add(validity / 2))
+}
+
+// expired reports whether the staple being served has passed its
+// NextUpdate, after which clients would reject it.
+func (s *ocspStaple) expired(now time.Time) bool {
+	return s.response != nil && !s.response.NextUpdate.IsZero() && now.After(s.response.NextUpdate)
+}
+
+// newerThan reports whether s holds a later staple for the same leaf as
+// other, such as one fetched since other's file was written.
+func (s *ocspStaple) newerThan(other *ocspStaple) bool {
+	return s.response != nil && bytes.Equal(s.cert.Certificate[0], other.cert.Certificate[0]) &&
+		s.response.ThisUpdate.After(other.response.ThisUpdate)
+}
+
+// fetchStaple asks the leaf's OCSP responder for a new staple and checks it
+// as loading one from disk would.
+func (s *ocspStaple) fetchStaple() ([]byte, *ocsp.Response, error) {
+	issuer := issuerOf(s.cert)
+	if issuer == nil {
+		return nil, nil, errors.New("the certificate file has no issuer to ask about")
+	}
+
+	if len(s.cert.Leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("the certificate names no OCSP responder")
+	}
+
+	request, err := ocsp.CreateRequest(s.cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := &http.Client{Timeout: ocspFetchTimeout}
+	resp, err := client.Post(s.cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %s answered %s", s.cert.Leaf.OCSPServer[0], resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := parseStaple(raw, s.cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, response, nil
+}
@@ -0,0 +1,180 @@
+package servlets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	defaultProxyHeaderTimeout = 5 * time.Second
+	maxAcceptDelay            = time.Second
+)
+
+// ProxyProtocolConfig makes a listener accept PROXY protocol v1 and v2
+// headers from peers in TrustedCIDRs, such as a cloud L4 balancer, and take
+// the client address from them. Connections from anywhere else are served
+// as they are, so the header can't be forged.
+type ProxyProtocolConfig struct {
+	TrustedCIDRs  []string      `json:"trusted_cidrs"`
+	HeaderTimeout util.Duration `json:"header_timeout,omitempty"`
+}
+
+// proxyProtocolListener reads headers off accepted connections in the
+// background, so a slow peer can't hold up Accept.
+type proxyProtocolListener struct {
+	net.Listener
+	port      int
+	trusted   *loadbalancer.TrustedProxies
+	timeout   time.Duration
+	conns     chan net.Conn
+	failed    chan struct{}
+	err       error // set before failed is closed
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newProxyProtocolListener(listener net.Listener, port int, config ProxyProtocolConfig) (net.Listener, error) {
+	trusted, err := loadbalancer.NewTrustedProxies(config.TrustedCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	if config.HeaderTimeout <= 0 {
+		config.HeaderTimeout = util.Duration(defaultProxyHeaderTimeout)
+	}
+
+	l := &proxyProtocolListener{
+		Listener: listener,
+		port:     port,
+		trusted:  trusted,
+		timeout:  time.Duration(config.HeaderTimeout),
+		conns:    make(chan net.Conn),
+		failed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.accept()
+	return l, nil
+}
+
+// accept hands every connection to its own handshake, so one with a bad
+// header is dropped on its own without failing the listener.
+func (l *proxyProtocolListener) accept() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ok bool
+			if delay, ok = retryAccept(err, delay); ok {
+				continue
+			}
+			l.err = err
+			close(l.failed)
+			return
+		}
+		delay = 0
+		go l.handshake(conn)
+	}
+}
+
+// retryAccept waits out a temporary Accept error, such as running out of
+// file descriptors, backing off from 5ms to a second as net/http.Server
+// does. It returns the delay to back off from next time, and false if the
+// error isn't temporary and the listener should give up.
+func retryAccept(err error, delay time.Duration) (time.Duration, bool) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Temporary() {
+		return 0, false
+	}
+
+	delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+	log.Printf("accept error: %v; retrying in %v", err, delay)
+	time.Sleep(delay)
+	return delay, true
+}
+
+func (l *proxyProtocolListener) handshake(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !l.trusted.Trusts(host) {
+		l.deliver(conn)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(l.timeout))
+	addr, err := util.ReadProxyHeader(reader)
+	conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, io.EOF) {
+		conn.Close()
+		return
+	}
+	if err != nil {
+		metrics.GetCounter(fmt.Sprintf("listener_proxy_protocol_errors_total{port=\"%d\"}", l.port)).Inc()
+		log.Printf("proxy protocol from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	l.deliver(&proxyConn{Conn: conn, reader: reader, remote: addr})
+}
+
+func (l *proxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.failed:
+		return nil, l.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyConn reports the address from its PROXY header as the remote
+// address, or the peer's own if the header didn't carry one.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the underlying connection, so TCP listeners can
+// pass on a backend's half-close to clients behind a PROXY header too.
+func (c *proxyConn) CloseWrite() error {
+	if conn, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,68 @@
+package servlets
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clientHelloTimeout = 5 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// peekServerName reads the client's TLS ClientHello without answering it
+// and returns the SNI name, empty if the client sent none, along with every
+// byte read so far, which must be replayed to the backend.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var recorded bytes.Buffer
+	var name string
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := tls.Server(&helloConn{Conn: conn, reader: io.TeeReader(conn, &recorded)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, err
+	}
+	return name, recorded.Bytes(), nil
+}
+
+// helloConn lets crypto/tls parse a ClientHello but not answer it.
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *helloConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// sniPool picks the pool for an SNI name: an exact match, then a wildcard
+// one level up, then the listener's default pool.
+func (s *TcpServer) sniPool(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if pool, ok := s.config.SNIRoutes[name]; ok {
+		return pool
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if pool, ok := s.config.SNIRoutes["*"+name[i:]]; ok {
+			return pool
+		}
+	}
+	return s.config.Pool
+}
@@ -0,0 +1,349 @@
+package servlets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	defaultTCPConnectTimeout = 5 * time.Second
+	defaultTCPIdleTimeout    = 5 * time.Minute
+)
+
+// TcpListenerConfig proxies raw TCP on Port to the servers of Pool. A
+// connection is dropped if its backend can't be reached within
+// ConnectTimeout, or once no bytes have moved either way for IdleTimeout.
+// ProxyProtocol takes client addresses from PROXY headers sent by a
+// balancer in front. With SNIRoutes the listener passes TLS through
+// untouched, choosing the pool by the name in the ClientHello, exact or
+// "*.example.com", and using Pool for clients with no or an unknown name.
+type TcpListenerConfig struct {
+	Port           int                  `json:"port"`
+	Pool           string               `json:"pool"`
+	ConnectTimeout util.Duration        `json:"connect_timeout,omitempty"`
+	IdleTimeout    util.Duration        `json:"idle_timeout,omitempty"`
+	ProxyProtocol  *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+	SNIRoutes      map[string]string    `json:"sni_routes,omitempty"`
+}
+
+type TcpServer struct {
+	pools     *loadbalancer.PoolManager
+	upstreams *router.Router // for each pool's proxy_protocol, may be nil
+	config    TcpListenerConfig
+	mu        sync.Mutex // guards listener, conns and closed
+	listener  net.Listener
+	conns     map[*tcpConn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewTcpServer(pools *loadbalancer.PoolManager, upstreams *router.Router, config TcpListenerConfig) *TcpServer {
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = util.Duration(defaultTCPConnectTimeout)
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = util.Duration(defaultTCPIdleTimeout)
+	}
+
+	routes := make(map[string]string, len(config.SNIRoutes))
+	for name, pool := range config.SNIRoutes {
+		routes[strings.ToLower(name)] = pool
+	}
+	config.SNIRoutes = routes
+
+	return &TcpServer{
+		pools:     pools,
+		upstreams: upstreams,
+		config:    config,
+		conns:     make(map[*tcpConn]struct{}),
+	}
+}
+
+func (s *TcpServer) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.Port))
+	if err != nil {
+		return err
+	}
+	if s.config.ProxyProtocol != nil {
+		wrapped, err := newProxyProtocolListener(listener, s.config.Port, *s.config.ProxyProtocol)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = wrapped
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	fmt.Printf("TCP proxy for pool %s started on port %d\n", s.config.Pool, s.config.Port)
+	var delay time.Duration
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			var ok bool
+			if delay, ok = retryAccept(err, delay); ok {
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(client)
+		}()
+	}
+}
+
+// Stop closes the listener and every proxied connection, and waits for
+// them to be released.
+func (s *TcpServer) Stop() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *TcpServer) handle(client net.Conn) {
+	poolName := s.config.Pool
+	var hello []byte
+	if len(s.config.SNIRoutes) > 0 {
+		name, recorded, err := peekServerName(client)
+		if errors.Is(err, io.EOF) {
+			client.Close()
+			return
+		}
+		if err != nil {
+			metrics.GetCounter(fmt.Sprintf("tcp_client_hello_errors_total{port=\"%d\"}", s.config.Port)).Inc()
+			client.Close()
+			return
+		}
+		poolName, hello = s.sniPool(name), recorded
+	}
+
+	pool, err := s.pools.GetPool(poolName)
+	if err != nil {
+		log.Printf("tcp proxy on port %d: %v: %q", s.config.Port, err, poolName)
+		client.Close()
+		return
+	}
+
+	ctx := context.Background()
+	if host, _, err := net.SplitHostPort(client.RemoteAddr().String()); err == nil {
+		ctx = context.WithValue(ctx, loadbalancer.ClientIPKey, host)
+	}
+
+	server, err := pool.NextServer(ctx)
+	if err != nil {
+		metrics.GetCounter(fmt.Sprintf("tcp_no_server_total{pool=%q}", pool.Name)).Inc()
+		client.Close()
+		return
+	}
+	defer server.ReleaseConnection()
+
+	labels := serverLabels(pool.Name, server)
+
+	start := time.Now()
+	backend, err := net.DialTimeout("tcp", server.GetHostPort(), time.Duration(s.config.ConnectTimeout))
+	if err == nil {
+		err = s.sendProxyHeader(pool.Name, client, backend)
+	}
+	if err == nil && len(hello) > 0 {
+		if _, err = backend.Write(hello); err != nil {
+			backend.Close()
+		}
+	}
+	server.ObserveResult(time.Since(start), err != nil)
+	if err != nil {
+		metrics.GetCounter("tcp_connect_errors_total" + labels).Inc()
+		log.Printf("tcp proxy: failed to connect to %s: %v", server.GetHostPort(), err)
+		client.Close()
+		return
+	}
+
+	conn := &tcpConn{
+		client:  client,
+		backend: backend,
+		labels:  labels,
+		idle:    time.Duration(s.config.IdleTimeout),
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	metrics.GetCounter("tcp_connections_total" + labels).Inc()
+	metrics.GetCounter("tcp_bytes_received_total" + labels).Add(int64(len(hello)))
+	active := metrics.GetGauge("tcp_connections_active" + labels)
+	active.Add(1)
+
+	conn.serve()
+
+	active.Add(-1)
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// sendProxyHeader announces client to backend if the pool's upstream
+// policy asks for a PROXY header.
+func (s *TcpServer) sendProxyHeader(pool string, client, backend net.Conn) error {
+	if s.upstreams == nil {
+		return nil
+	}
+
+	version := s.upstreams.UpstreamPolicy(pool).ProxyProtocol
+	if version == "" {
+		return nil
+	}
+
+	header, err := util.ProxyHeader(version, client.RemoteAddr(), client.LocalAddr())
+	if err == nil {
+		_, err = backend.Write(header)
+	}
+	if err != nil {
+		backend.Close()
+	}
+	return err
+}
+
+type tcpConn struct {
+	client     net.Conn
+	backend    net.Conn
+	labels     string
+	idle       time.Duration
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+// serve copies bytes both ways. When one side finishes sending, the other
+// is half-closed so it sees EOF but can keep replying; the connection is
+// torn down once both directions are done, either side errors or it has
+// been idle too long.
+func (c *tcpConn) serve() {
+	c.touch()
+
+	copied := make(chan error, 2)
+	go func() {
+		copied <- c.copy(c.backend, c.client, "tcp_bytes_received_total")
+	}()
+	go func() {
+		copied <- c.copy(c.client, c.backend, "tcp_bytes_sent_total")
+	}()
+
+	interval := min(c.idle/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for remaining := 2; remaining > 0; {
+		select {
+		case err := <-copied:
+			remaining--
+			if err != nil {
+				c.close()
+			}
+		case <-c.done:
+			for ; remaining > 0; remaining-- {
+				<-copied
+			}
+		case <-ticker.C:
+			if time.Since(time.Unix(0, c.lastActive.Load())) > c.idle {
+				metrics.GetCounter("tcp_idle_closed_total" + c.labels).Inc()
+				c.close()
+			}
+		}
+	}
+	c.close()
+}
+
+// copy forwards src to dst and half-closes dst at EOF. It returns an error
+// if the stream ended any other way.
+func (c *tcpConn) copy(dst, src net.Conn, counter string) error {
+	bytes := metrics.GetCounter(counter + c.labels)
+	_, err := io.Copy(dst, &countingReader{Reader: src, touch: c.touch, bytes: bytes})
+	if err != nil {
+		return err
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return io.ErrClosedPipe
+}
+
+func (c *tcpConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+func (c *tcpConn) close() {
+	c.closeOnce.Do(func() {
+		c.client.Close()
+		c.backend.Close()
+		close(c.done)
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	touch func()
+	bytes *metrics.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+		r.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// serverLabels names a server in per-backend metrics by its ID where it has
+// one.
+func serverLabels(pool string, server loadbalancer.Server) string {
+	id := server.GetHostPort()
+	if instance := loadbalancer.InstanceOf(server); instance != nil {
+		id = instance.ID
+	}
+	return fmt.Sprintf("{pool=%q,server=%q}", pool, id)
+}
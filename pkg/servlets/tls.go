@@ -0,0 +1,408 @@
+package servlets
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultCertificateReloadInterval = 5 * time.Second
+	defaultSubjectHeader             = "X-Client-Cert-Subject"
+	defaultURIHeader                 = "X-Client-Cert-URI"
+)
+
+var (
+	ErrNoCertificates        = errors.New("no certificates configured")
+	ErrInvalidCertificate    = errors.New("invalid certificate")
+	ErrCertificateExpired    = errors.New("certificate expired")
+	ErrInvalidOCSPStaple     = errors.New("invalid OCSP staple")
+	ErrInvalidTLSVersion     = errors.New("invalid TLS version")
+	ErrUnknownCipherSuite    = errors.New("unknown cipher suite")
+	ErrInvalidReloadInterval = errors.New("invalid certificate reload interval: duration must not be negative")
+	ErrInvalidClientCA       = errors.New("invalid client CA")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertificateConfig is a certificate and key pair, with the issuer's
+// certificate following the leaf in CertFile for OCSP. An OCSPStapleFile
+// has to hold a good, unexpired response for the leaf, and stops being
+// stapled once it expires. With OCSPFetch, halfway through its validity a
+// fresh one is fetched from the leaf's OCSP responder and kept in memory;
+// the file itself is left alone.
+type CertificateConfig struct {
+	CertFile       string `json:"cert_file"`
+	KeyFile        string `json:"key_file"`
+	OCSPStapleFile string `json:"ocsp_staple_file,omitempty"`
+	OCSPFetch      bool   `json:"ocsp_fetch,omitempty"`
+}
+
+// TLSConfig configures an HTTPS listener. The certificate for a connection
+// is picked by SNI, exact names before wildcards, falling back to the first
+// certificate. CipherSuites only apply up to TLS 1.2.
+type TLSConfig struct {
+	Certificates   []CertificateConfig `json:"certificates"`
+	MinVersion     string              `json:"min_version,omitempty"` // defaults to 1.2
+	CipherSuites   []string            `json:"cipher_suites,omitempty"`
+	ReloadInterval util.Duration       `json:"reload_interval,omitempty"`
+	ClientAuth     *ClientAuthConfig   `json:"client_auth,omitempty"`
+}
+
+// ClientAuthConfig requires clients to present a certificate signed by one
+// of CAFiles. Allow limits which identities get through, matched as
+// loadbalancer.ClientIdentity.Matches does, and is empty to let in any
+// verified client. The identity is forwarded to backends in SubjectHeader
+// and URIHeader.
+type ClientAuthConfig struct {
+	CAFiles       []string `json:"ca_files"`
+	Allow         []string `json:"allow,omitempty"`
+	SubjectHeader string   `json:"subject_header,omitempty"` // defaults to X-Client-Cert-Subject
+	URIHeader     string   `json:"uri_header,omitempty"`     // defaults to X-Client-Cert-URI
+}
+
+func (c ClientAuthConfig) headers() (subject string, uri string) {
+	subject, uri = c.SubjectHeader, c.URIHeader
+	if subject == "" {
+		subject = defaultSubjectHeader
+	}
+	if uri == "" {
+		uri = defaultURIHeader
+	}
+	return subject, uri
+}
+
+func loadClientCAs(files []string) (*x509.CertPool, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: client_auth needs at least one CA file", ErrInvalidClientCA)
+	}
+
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidClientCA, err)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%w: no certificates in %s", ErrInvalidClientCA, file)
+		}
+	}
+	return pool, nil
+}
+
+// CertificateStore holds a listener's certificates and swaps them out when
+// their files change on disk.
+type CertificateStore struct {
+	config     TLSConfig
+	minVersion uint16
+	ciphers    []uint16
+	clientCAs  *x509.CertPool
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	names    map[string]*tls.Certificate
+	modTimes map[string]time.Time
+	staples  map[string]*ocspStaple // by certificate file
+
+	fetched map[string]time.Time // last staple fetch by certificate file, only used by Watch
+}
+
+func NewCertificateStore(config TLSConfig) (*CertificateStore, error) {
+	if len(config.Certificates) == 0 {
+		return nil, ErrNoCertificates
+	}
+
+	if config.ReloadInterval < 0 {
+		return nil, ErrInvalidReloadInterval
+	}
+
+	if config.ReloadInterval == 0 {
+		config.ReloadInterval = util.Duration(defaultCertificateReloadInterval)
+	}
+
+	s := &CertificateStore{config: config, minVersion: tls.VersionTLS12, fetched: make(map[string]time.Time)}
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTLSVersion, config.MinVersion)
+		}
+		s.minVersion = version
+	}
+
+	for _, name := range config.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownCipherSuite, name)
+		}
+		s.ciphers = append(s.ciphers, id)
+	}
+
+	if config.ClientAuth != nil {
+		pool, err := loadClientCAs(config.ClientAuth.CAFiles)
+		if err != nil {
+			return nil, err
+		}
+		s.clientCAs = pool
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// TLSConfig returns the server side tls.Config, which always serves the
+// store's current certificates.
+func (s *CertificateStore) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion:     s.minVersion,
+		CipherSuites:   s.ciphers,
+		GetCertificate: s.GetCertificate,
+	}
+	if s.clientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = s.clientCAs
+	}
+	return config
+}
+
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.names[name]; ok {
+		return cert, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// load reads every certificate, only replacing the current ones if all of
+// them are valid.
+func (s *CertificateStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.config.Certificates))
+	names := make(map[string]*tls.Certificate)
+	modTimes := make(map[string]time.Time)
+	staples := make(map[string]*ocspStaple)
+
+	for _, cc := range s.config.Certificates {
+		cert, staple, err := loadCertificate(cc)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		if staple != nil {
+			// Keep serving a staple fetched since the file was written.
+			if current, ok := s.staples[cc.CertFile]; ok && current.newerThan(staple) {
+				cert.OCSPStaple = current.cert.OCSPStaple
+				staple.response = current.response
+			}
+			staples[cc.CertFile] = staple
+		}
+
+		hosts := cert.Leaf.DNSNames
+		if len(hosts) == 0 && cert.Leaf.Subject.CommonName != "" {
+			hosts = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, host := range hosts {
+			host = strings.ToLower(host)
+			if _, ok := names[host]; !ok {
+				names[host] = cert
+			}
+		}
+
+		for _, path := range cc.files() {
+			if info, err := os.Stat(path); err == nil {
+				modTimes[path] = info.ModTime()
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.certs, s.names, s.modTimes, s.staples = certs, names, modTimes, staples
+	s.mu.Unlock()
+	return nil
+}
+
+func loadCertificate(cc CertificateConfig) (*tls.Certificate, *ocspStaple, error) {
+	cert, err := tls.LoadX509KeyPair(cc.CertFile, cc.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidCertificate, cc.CertFile, err)
+	}
+
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidCertificate, cc.CertFile, err)
+		}
+	}
+
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, nil, fmt.Errorf("%w: %s expired on %s", ErrCertificateExpired, cc.CertFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, nil, fmt.Errorf("%w: %s is not valid before %s", ErrInvalidCertificate, cc.CertFile, cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+
+	if cc.OCSPStapleFile == "" {
+		if cc.OCSPFetch {
+			return nil, nil, fmt.Errorf("%w: %s: ocsp_fetch needs an ocsp_staple_file to start from", ErrInvalidOCSPStaple, cc.CertFile)
+		}
+		return &cert, nil, nil
+	}
+
+	raw, err := os.ReadFile(cc.OCSPStapleFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidOCSPStaple, err)
+	}
+
+	if len(raw) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s is empty", ErrInvalidOCSPStaple, cc.OCSPStapleFile)
+	}
+
+	response, err := parseStaple(raw, &cert)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidOCSPStaple, cc.OCSPStapleFile, err)
+	}
+	cert.OCSPStaple = raw
+	return &cert, &ocspStaple{cert: &cert, response: response, fetch: cc.OCSPFetch}, nil
+}
+
+func (cc CertificateConfig) files() []string {
+	files := []string{cc.CertFile, cc.KeyFile}
+	if cc.OCSPStapleFile != "" {
+		files = append(files, cc.OCSPStapleFile)
+	}
+	return files
+}
+
+// Watch polls the certificate files and reloads them when any changes,
+// until ctx is done, refreshing staples that are due first. A reload that
+// fails keeps the current certificates and is retried on the next tick.
+func (s *CertificateStore) Watch(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.config.ReloadInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshStaples()
+			if !s.changed() {
+				continue
+			}
+
+			if err := s.load(); err != nil {
+				log.Printf("tls: keeping current certificates: %v", err)
+				continue
+			}
+			log.Printf("tls: reloaded certificates")
+		}
+	}
+}
+
+// refreshStaples fetches the staples that are due, where fetching is on,
+// and drops the ones that have expired without a replacement. A responder
+// is asked at most once per ocspRetryInterval, so one that fails or keeps
+// handing out the same response isn't hammered.
+func (s *CertificateStore) refreshStaples() {
+	s.mu.RLock()
+	staples := s.staples
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for path, staple := range staples {
+		if staple.fetch && staple.due(now) && now.Sub(s.fetched[path]) >= ocspRetryInterval {
+			s.fetched[path] = now
+
+			raw, response, err := staple.fetchStaple()
+			if err == nil {
+				s.setStaple(staple, raw, response)
+				log.Printf("tls: refreshed OCSP staple for %s", path)
+				continue
+			}
+			log.Printf("tls: refreshing OCSP staple for %s: %v", path, err)
+		}
+
+		if staple.expired(now) {
+			s.setStaple(staple, nil, nil)
+			log.Printf("tls: OCSP staple for %s expired, no longer stapling it", path)
+		}
+	}
+}
+
+// setStaple serves a copy of the staple's certificate with raw stapled,
+// since handshakes may still be reading the current one.
+func (s *CertificateStore) setStaple(staple *ocspStaple, raw []byte, response *ocsp.Response) {
+	cert := *staple.cert
+	cert.OCSPStaple = raw
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.certs {
+		if c == staple.cert {
+			s.certs[i] = &cert
+		}
+	}
+	for name, c := range s.names {
+		if c == staple.cert {
+			s.names[name] = &cert
+		}
+	}
+	staple.cert, staple.response = &cert, response
+}
+
+func (s *CertificateStore) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, cc := range s.config.Certificates {
+		for _, path := range cc.files() {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if !info.ModTime().Equal(s.modTimes[path]) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package servlets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const (
+	defaultUDPIdleTimeout = 30 * time.Second
+	maxDatagramSize       = 64 * 1024
+)
+
+// UdpListenerConfig relays datagrams on Port to the servers of Pool. Each
+// client address gets a flow that's pinned to one server and holds one of
+// its connection slots until it has been idle for IdleTimeout. With
+// PerPacket set, every datagram is balanced on its own instead, which suits
+// stateless protocols such as DNS; the flow then only routes replies back.
+type UdpListenerConfig struct {
+	Port        int           `json:"port"`
+	Pool        string        `json:"pool"`
+	IdleTimeout util.Duration `json:"idle_timeout,omitempty"`
+	PerPacket   bool          `json:"per_packet,omitempty"`
+}
+
+type UdpServer struct {
+	pools    *loadbalancer.PoolManager
+	config   UdpListenerConfig
+	mu       sync.Mutex // guards listener, flows and closed
+	listener *net.UDPConn
+	flows    map[string]*udpFlow
+	addrs    *udpAddrs
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewUdpServer(pools *loadbalancer.PoolManager, config UdpListenerConfig) *UdpServer {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = util.Duration(defaultUDPIdleTimeout)
+	}
+
+	return &UdpServer{
+		pools:  pools,
+		config: config,
+		flows:  make(map[string]*udpFlow),
+		addrs:  &udpAddrs{addrs: make(map[string]*net.UDPAddr)},
+		done:   make(chan struct{}),
+	}
+}
+
+func (s *UdpServer) Start() error {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{Port: s.config.Port})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go s.expire()
+
+	fmt.Printf("UDP proxy for pool %s started on port %d\n", s.config.Pool, s.config.Port)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.relay(client, buf[:n])
+	}
+}
+
+// Stop closes the listener and every flow, releasing their servers.
+func (s *UdpServer) Stop() error {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.done)
+	}
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for key, flow := range s.flows {
+		flow.close()
+		delete(s.flows, key)
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// relay sends a datagram from client to its flow's server, or to the next
+// server in per-packet mode, opening a flow first if the client is new or
+// its server has gone inactive.
+func (s *UdpServer) relay(client *net.UDPAddr, datagram []byte) {
+	pool, err := s.pools.GetPool(s.config.Pool)
+	if err != nil {
+		log.Printf("udp proxy on port %d: %v", s.config.Port, err)
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), loadbalancer.ClientIPKey, client.IP.String())
+
+	flow, err := s.flow(ctx, pool, client)
+	if err != nil {
+		metrics.GetCounter(fmt.Sprintf("udp_no_server_total{pool=%q}", pool.Name)).Inc()
+		return
+	}
+	flow.touch()
+
+	server := flow.server
+	if s.config.PerPacket {
+		if server, err = pool.NextServer(ctx); err != nil {
+			metrics.GetCounter(fmt.Sprintf("udp_no_server_total{pool=%q}", pool.Name)).Inc()
+			return
+		}
+		defer server.ReleaseConnection()
+	}
+
+	backend, err := s.addrs.resolve(server)
+	if err == nil {
+		_, err = flow.conn.WriteToUDP(datagram, backend)
+	}
+	labels := serverLabels(pool.Name, server)
+	if err != nil {
+		server.ObserveResult(0, true)
+		metrics.GetCounter("udp_send_errors_total" + labels).Inc()
+		return
+	}
+	metrics.GetCounter("udp_packets_received_total" + labels).Inc()
+	metrics.GetCounter("udp_bytes_received_total" + labels).Add(int64(len(datagram)))
+}
+
+func (s *UdpServer) flow(ctx context.Context, pool *loadbalancer.Pool, client *net.UDPAddr) (*udpFlow, error) {
+	key := client.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if flow, ok := s.flows[key]; ok {
+		if flow.server == nil || loadbalancer.InstanceOf(flow.server).IsActive() {
+			return flow, nil
+		}
+		flow.close()
+		delete(s.flows, key)
+	}
+
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+
+	flow := &udpFlow{
+		pool:     pool,
+		client:   client,
+		listener: s.listener,
+		addrs:    s.addrs,
+	}
+	if !s.config.PerPacket {
+		server, err := pool.NextServer(ctx)
+		if err != nil {
+			return nil, err
+		}
+		flow.server = server
+		metrics.GetCounter("udp_flows_total" + serverLabels(pool.Name, server)).Inc()
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		if flow.server != nil {
+			flow.server.ReleaseConnection()
+		}
+		return nil, err
+	}
+	flow.conn = conn
+	flow.touch()
+	s.flows[key] = flow
+	metrics.GetGauge(fmt.Sprintf("udp_flows_active{pool=%q}", pool.Name)).Add(1)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		flow.reply()
+	}()
+	return flow, nil
+}
+
+// expire closes flows that have been idle for longer than IdleTimeout.
+func (s *UdpServer) expire() {
+	defer s.wg.Done()
+
+	idle := time.Duration(s.config.IdleTimeout)
+	ticker := time.NewTicker(min(idle/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		for key, flow := range s.flows {
+			if time.Since(time.Unix(0, flow.lastActive.Load())) > idle {
+				metrics.GetCounter(fmt.Sprintf("udp_flows_expired_total{pool=%q}", flow.pool.Name)).Inc()
+				flow.close()
+				delete(s.flows, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+type udpFlow struct {
+	pool       *loadbalancer.Pool
+	server     loadbalancer.Server // nil in per-packet mode
+	client     *net.UDPAddr
+	listener   *net.UDPConn
+	conn       *net.UDPConn // the flow's own socket towards the servers
+	addrs      *udpAddrs
+	lastActive atomic.Int64
+	closeOnce  sync.Once
+}
+
+// reply relays datagrams from the pool's servers back to the client until
+// the flow is closed. Datagrams from anywhere else are dropped.
+func (f *udpFlow) reply() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		server := f.sender(from)
+		if server == nil {
+			continue
+		}
+		f.touch()
+
+		if _, err := f.listener.WriteToUDP(buf[:n], f.client); err != nil {
+			continue
+		}
+		labels := serverLabels(f.pool.Name, server)
+		metrics.GetCounter("udp_packets_sent_total" + labels).Inc()
+		metrics.GetCounter("udp_bytes_sent_total" + labels).Add(int64(n))
+	}
+}
+
+func (f *udpFlow) sender(from *net.UDPAddr) loadbalancer.Server {
+	servers := []loadbalancer.Server{f.server}
+	if f.server == nil {
+		servers = f.pool.GetServers()
+	}
+
+	for _, server := range servers {
+		if addr, err := f.addrs.resolve(server); err == nil && addr.IP.Equal(from.IP) && addr.Port == from.Port {
+			return server
+		}
+	}
+	return nil
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		f.conn.Close()
+		if f.server != nil {
+			f.server.ReleaseConnection()
+		}
+		metrics.GetGauge(fmt.Sprintf("udp_flows_active{pool=%q}", f.pool.Name)).Add(-1)
+	})
+}
+
+// udpAddrs caches the servers' resolved addresses by host and port, so
+// datagrams aren't resolved one at a time. An address is only resolved
+// again when a server with a new one joins the pool.
+type udpAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]*net.UDPAddr
+}
+
+func (a *udpAddrs) resolve(server loadbalancer.Server) (*net.UDPAddr, error) {
+	hostPort := server.GetHostPort()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if addr, ok := a.addrs[hostPort]; ok {
+		return addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	a.addrs[hostPort] = addr
+	return addr, nil
+}
@@ -0,0 +1,202 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes, as defined by google.golang.org/grpc/codes.
+const (
+	GRPCOK                = 0
+	GRPCCancelled         = 1
+	GRPCUnknown           = 2
+	GRPCDeadlineExceeded  = 4
+	GRPCResourceExhausted = 8
+	GRPCUnimplemented     = 12
+	GRPCInternal          = 13
+	GRPCUnavailable       = 14
+	GRPCDataLoss          = 15
+)
+
+// grpc.health.v1.HealthCheckResponse.ServingStatus values.
+const (
+	HealthUnknown        = 0
+	HealthServing        = 1
+	HealthNotServing     = 2
+	HealthServiceUnknown = 3
+)
+
+const GRPCContentType = "application/grpc"
+
+var (
+	ErrGRPCMessageTooLarge = errors.New("grpc message too large")
+	ErrGRPCCompressed      = errors.New("compressed grpc messages are not supported")
+	ErrInvalidProtobuf     = errors.New("invalid protobuf message")
+)
+
+// IsGRPC reports whether a content type is gRPC, with or without a codec
+// suffix like application/grpc+proto.
+func IsGRPC(contentType string) bool {
+	rest, ok := strings.CutPrefix(contentType, GRPCContentType)
+	return ok && (rest == "" || rest[0] == '+' || rest[0] == ';')
+}
+
+// GRPCStatus reads grpc-status from the trailers, or from the headers of a
+// trailers-only response.
+func GRPCStatus(header, trailer http.Header) (int, bool) {
+	value := trailer.Get("Grpc-Status")
+	if value == "" {
+		value = header.Get("Grpc-Status")
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// WriteGRPCError writes a trailers-only response carrying a gRPC status, so
+// gRPC clients see a proper status instead of an HTTP error page.
+func WriteGRPCError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", GRPCContentType)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes a status message as the gRPC over
+// HTTP/2 spec asks.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// WriteGRPCFrame writes one length-prefixed, uncompressed message.
+func WriteGRPCFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// ReadGRPCFrame reads one length-prefixed message of at most limit bytes.
+func ReadGRPCFrame(r io.Reader, limit int) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	if prefix[0] != 0 {
+		return nil, ErrGRPCCompressed
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > uint32(limit) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrGRPCMessageTooLarge, size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// EncodeHealthCheckRequest encodes a grpc.health.v1.HealthCheckRequest.
+func EncodeHealthCheckRequest(service string) []byte {
+	if service == "" {
+		return nil
+	}
+
+	msg := []byte{0x0a}
+	msg = binary.AppendUvarint(msg, uint64(len(service)))
+	return append(msg, service...)
+}
+
+// DecodeHealthCheckRequest returns the service a
+// grpc.health.v1.HealthCheckRequest asks about.
+func DecodeHealthCheckRequest(msg []byte) (string, error) {
+	var service string
+	err := decodeProtobuf(msg, func(field int, value uint64, data []byte) {
+		if field == 1 && data != nil {
+			service = string(data)
+		}
+	})
+	return service, err
+}
+
+// EncodeHealthCheckResponse encodes a grpc.health.v1.HealthCheckResponse.
+func EncodeHealthCheckResponse(status int) []byte {
+	if status == HealthUnknown {
+		return nil
+	}
+	return binary.AppendUvarint([]byte{0x08}, uint64(status))
+}
+
+// DecodeHealthCheckResponse returns the serving status in a
+// grpc.health.v1.HealthCheckResponse.
+func DecodeHealthCheckResponse(msg []byte) (int, error) {
+	status := HealthUnknown
+	err := decodeProtobuf(msg, func(field int, value uint64, data []byte) {
+		if field == 1 && data == nil {
+			status = int(value)
+		}
+	})
+	return status, err
+}
+
+// decodeProtobuf calls fn for each varint and length-delimited field in msg,
+// with data nil for varints, and skips fixed width fields.
+func decodeProtobuf(msg []byte, fn func(field int, value uint64, data []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ErrInvalidProtobuf
+		}
+		msg = msg[n:]
+
+		field, wire := int(tag>>3), tag&7
+		switch wire {
+		case 0:
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return ErrInvalidProtobuf
+			}
+			msg = msg[n:]
+			fn(field, value, nil)
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return ErrInvalidProtobuf
+			}
+			msg = msg[size:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return ErrInvalidProtobuf
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		default:
+			return ErrInvalidProtobuf
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLength = 107
+
+	proxyV2HeaderLength = 16
+	proxyV2Version      = 0x20
+	proxyV2Local        = 0x00
+	proxyV2Proxy        = 0x01
+	proxyV2TCP4         = 0x11
+	proxyV2UDP4         = 0x12
+	proxyV2TCP6         = 0x21
+	proxyV2UDP6         = 0x22
+)
+
+var (
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ReadProxyHeader consumes a PROXY protocol v1 or v2 header from r and
+// returns the client address it carries. It returns nil, without reading
+// anything, if r doesn't start with a header, and nil after consuming one
+// that carries no address, such as v1 UNKNOWN or a v2 LOCAL health check.
+func ReadProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only peek as far as the first byte says a header could reach, so a
+	// client without one that sends a short message isn't kept waiting.
+	switch first[0] {
+	case proxyV2Signature[0]:
+		if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	case proxyV1Prefix[0]:
+		if prefix, err := r.Peek(len(proxyV1Prefix)); err == nil && string(prefix) == proxyV1Prefix {
+			return readProxyV1(r)
+		}
+	}
+	return nil, nil
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+		if len(line) > proxyV1MaxLength {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 || (fields[1] == "TCP4" && ip.To4() == nil) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	if header[12]&0xf0 != proxyV2Version {
+		return nil, fmt.Errorf("%w: unsupported version %#x", ErrInvalidProxyHeader, header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch header[12] & 0x0f {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("%w: unknown command %#x", ErrInvalidProxyHeader, header[12]&0x0f)
+	}
+
+	var size int
+	switch header[13] {
+	case proxyV2TCP4, proxyV2UDP4:
+		size = net.IPv4len
+	case proxyV2TCP6, proxyV2UDP6:
+		size = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry nothing we can use.
+		return nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidProxyHeader)
+	}
+	ip := net.IP(bytes.Clone(payload[:size]))
+	port := int(binary.BigEndian.Uint16(payload[2*size:]))
+
+	if header[13] == proxyV2UDP4 || header[13] == proxyV2UDP6 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// ProxyHeader builds a PROXY protocol header announcing a connection from
+// source to destination. Without a usable pair of addresses it builds one
+// that carries none: v1 UNKNOWN or v2 LOCAL.
+func ProxyHeader(version string, source, destination net.Addr) ([]byte, error) {
+	if version != ProxyProtocolV1 && version != ProxyProtocolV2 {
+		return nil, fmt.Errorf("%w: unknown version %q", ErrInvalidProxyHeader, version)
+	}
+
+	srcIP, srcPort, srcOK := splitAddr(source)
+	dstIP, dstPort, dstOK := splitAddr(destination)
+	ok := srcOK && dstOK
+
+	// Both ends must share a family, so IPv4 is mapped into IPv6 if only
+	// one of them is IPv6.
+	ipv4 := ok && srcIP.To4() != nil && dstIP.To4() != nil
+	if ipv4 {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	} else if ok {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	if version == ProxyProtocolV1 {
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+		}
+		return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort), nil
+	}
+
+	header := append(bytes.Clone(proxyV2Signature), proxyV2Version|proxyV2Local, 0, 0, 0)
+	if !ok {
+		return header, nil
+	}
+
+	header[12] = proxyV2Version | proxyV2Proxy
+	header[13] = proxyV2TCP6
+	if ipv4 {
+		header[13] = proxyV2TCP4
+	}
+	if _, udp := source.(*net.UDPAddr); udp {
+		header[13]++
+	}
+
+	binary.BigEndian.PutUint16(header[14:], uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcPort))
+	return binary.BigEndian.AppendUint16(header, uint16(dstPort)), nil
+}
+
+func splitAddr(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port, a.IP != nil
+	case *net.UDPAddr:
+		return a.IP, a.Port, a.IP != nil
+	}
+	return nil, 0, false
+}
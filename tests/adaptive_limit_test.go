@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	lbconfig "github.com/raydatray/goobernetes/pkg/config"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+func TestAIMDLimiter(t *testing.T) {
+	limiter, err := loadbalancer.NewAIMDLimiter(2, 20, 10, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 5 {
+		limiter.OnSample(10*time.Millisecond, limiter.Limit(), false)
+	}
+	if got := limiter.Limit(); got != 15 {
+		t.Fatalf("expected fast successes at the limit to grow it to 15 but got %d", got)
+	}
+
+	limiter.OnSample(10*time.Millisecond, 1, false)
+	if got := limiter.Limit(); got != 15 {
+		t.Fatalf("expected an underused limit not to grow but got %d", got)
+	}
+
+	limiter.OnSample(10*time.Millisecond, 15, true)
+	if got := limiter.Limit(); got != 13 {
+		t.Fatalf("expected an error to back the limit off to 13 but got %d", got)
+	}
+
+	limiter.OnSample(time.Second, 13, false)
+	if got := limiter.Limit(); got != 12 {
+		t.Fatalf("expected a slow response to back the limit off to 12 but got %d", got)
+	}
+
+	for range 50 {
+		limiter.OnSample(10*time.Millisecond, 1, true)
+	}
+	if got := limiter.Limit(); got != 2 {
+		t.Fatalf("expected the limit to bottom out at the minimum of 2 but got %d", got)
+	}
+
+	for range 50 {
+		limiter.OnSample(10*time.Millisecond, limiter.Limit(), false)
+	}
+	if got := limiter.Limit(); got != 20 {
+		t.Fatalf("expected the limit to top out at the maximum of 20 but got %d", got)
+	}
+}
+
+func TestGradientLimiter(t *testing.T) {
+	limiter, err := loadbalancer.NewGradientLimiter(5, 50, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 20 {
+		limiter.OnSample(10*time.Millisecond, limiter.Limit(), false)
+	}
+	grown := limiter.Limit()
+	if grown <= 10 {
+		t.Fatalf("expected steady latency under load to grow the limit past 10 but got %d", grown)
+	}
+
+	before := limiter.Limit()
+	limiter.OnSample(10*time.Millisecond, 1, false)
+	if got := limiter.Limit(); got != before {
+		t.Fatalf("expected an underused limit to stay at %d but got %d", before, got)
+	}
+
+	for range 10 {
+		limiter.OnSample(200*time.Millisecond, limiter.Limit(), false)
+	}
+	slowed := limiter.Limit()
+	if slowed >= grown {
+		t.Fatalf("expected a latency spike to shrink the limit below %d but got %d", grown, slowed)
+	}
+
+	for range 10 {
+		limiter.OnSample(10*time.Millisecond, limiter.Limit(), true)
+	}
+	if got := limiter.Limit(); got >= slowed {
+		t.Fatalf("expected errors to shrink the limit below %d but got %d", slowed, got)
+	}
+
+	for range 100 {
+		limiter.OnSample(10*time.Millisecond, limiter.Limit(), true)
+	}
+	if got := limiter.Limit(); got != 5 {
+		t.Fatalf("expected the limit to bottom out at the minimum of 5 but got %d", got)
+	}
+}
+
+func TestAdaptiveLimitBounds(t *testing.T) {
+	if _, err := loadbalancer.NewAIMDLimiter(5, 20, 30, time.Second); err == nil {
+		t.Fatal("expected an initial limit above the maximum to be rejected")
+	}
+	if _, err := loadbalancer.NewGradientLimiter(0, 20, 10); err == nil {
+		t.Fatal("expected a minimum below 1 to be rejected")
+	}
+}
+
+func TestAdaptiveLimitConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{
+		"pools": [
+			{
+				"name": "web",
+				"adaptive_limit": "aimd",
+				"adaptive_limits": {"min_limit": 2, "initial_limit": 4, "timeout": "50ms"},
+				"max_conns": 10,
+				"servers": [{"id": "server1", "host": "127.0.0.1", "port": 8081}]
+			}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := lbconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pools, err := cfg.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, _ := pools.GetPool("web")
+	server := loadbalancer.InstanceOf(pool.GetServers()[0])
+
+	if got := server.ConcurrencyLimit(); got != 4 {
+		t.Fatalf("expected the limit to start at the configured 4 but got %d", got)
+	}
+
+	server.ObserveResult(100*time.Millisecond, false)
+	if got := server.ConcurrencyLimit(); got != 3 {
+		t.Fatalf("expected a response over the 50ms timeout to back off to 3 but got %d", got)
+	}
+
+	if err := pool.UpdateServerMaxConn("server1", 30); err != nil {
+		t.Fatal(err)
+	}
+	for range 40 {
+		// The limiter only grows while the server is kept busy.
+		acquired := 0
+		for server.AcquireConnection() {
+			acquired++
+		}
+		server.ObserveResult(time.Millisecond, false)
+		for range acquired {
+			server.ReleaseConnection()
+		}
+	}
+	if got := server.ConcurrencyLimit(); got != 30 {
+		t.Fatalf("expected raising max_conns to let the limit grow to 30 but got %d", got)
+	}
+
+	if err := pool.UpdateServerMaxConn("server1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.ConcurrencyLimit(); got != 5 {
+		t.Fatalf("expected lowering max_conns to cap the limit at 5 but got %d", got)
+	}
+}
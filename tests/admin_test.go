@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+)
+
+func newAdminHandler(t *testing.T) (http.Handler, *loadbalancer.PoolManager, *router.RouteTable) {
+	t.Helper()
+	pools := loadbalancer.NewPoolManager()
+	for _, name := range []string{"web", "api"} {
+		lb := loadbalancer.NewWeightedRoundRobinLoadBalancer()
+		for _, id := range []string{"server1", "server2"} {
+			server, _ := loadbalancer.NewWeightedServerInstance(id, "192.168.1.10", 8080, 10, 1)
+			_ = lb.AddServer(server)
+		}
+		pool, _ := loadbalancer.NewPool(name, lb)
+		if err := pools.AddPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	routes := router.NewRouteTable()
+	if err := routes.AddRoute(router.Route{Name: "default", Pool: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	return servlets.NewAdminServer(pools, routes, "127.0.0.1", 0).Handler(), pools, routes
+}
+
+func adminRequest(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestAdminServers(t *testing.T) {
+	handler, pools, _ := newAdminHandler(t)
+	web, _ := pools.GetPool("web")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"weight", http.MethodPut, "/pools/web/servers/server1/weight", `{"weight": 5}`, http.StatusNoContent},
+		{"invalid weight", http.MethodPut, "/pools/web/servers/server1/weight", `{"weight": 0}`, http.StatusBadRequest},
+		{"malformed body", http.MethodPut, "/pools/web/servers/server1/weight", `{"weight":`, http.StatusBadRequest},
+		{"unknown server", http.MethodPut, "/pools/web/servers/server9/weight", `{"weight": 2}`, http.StatusNotFound},
+		{"unknown pool", http.MethodPut, "/pools/db/servers/server1/weight", `{"weight": 2}`, http.StatusNotFound},
+		{"max conns", http.MethodPut, "/pools/web/servers/server2/max-conns", `{"max_conns": 3}`, http.StatusNoContent},
+		{"invalid max conns", http.MethodPut, "/pools/web/servers/server2/max-conns", `{"max_conns": 0}`, http.StatusBadRequest},
+		{"status", http.MethodPut, "/pools/web/servers/server2/status", `{"active": false}`, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		if got := adminRequest(handler, tc.method, tc.path, tc.body); got.Code != tc.status {
+			t.Errorf("%s: expected %d but got %d: %s", tc.name, tc.status, got.Code, got.Body)
+		}
+	}
+
+	recorder := adminRequest(handler, http.MethodGet, "/pools/web", "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200 but got %d", recorder.Code)
+	}
+	var status loadbalancer.PoolStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Healthy != 1 || status.Total != 2 {
+		t.Fatalf("expected 1 of 2 servers healthy but got %d of %d", status.Healthy, status.Total)
+	}
+
+	for _, server := range web.GetServers() {
+		weighted := server.(*loadbalancer.WeightedServerInstance)
+		switch weighted.ID {
+		case "server1":
+			if weighted.GetWeight() != 5 {
+				t.Errorf("expected server1 to have weight 5 but got %d", weighted.GetWeight())
+			}
+		case "server2":
+			if weighted.MaxConns != 3 || weighted.IsActive() {
+				t.Errorf("expected server2 to be down with max_conns 3 but got %d, active %v", weighted.MaxConns, weighted.IsActive())
+			}
+		}
+	}
+
+	if got := adminRequest(handler, http.MethodGet, "/pools", ""); got.Code != http.StatusOK || !strings.Contains(got.Body.String(), `"api"`) {
+		t.Fatalf("expected the pool list to include api but got %d: %s", got.Code, got.Body)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	handler, _, routes := newAdminHandler(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"add", http.MethodPost, "/routes", `{"name": "api", "path_prefix": "/api", "pool": "api", "priority": 10}`, http.StatusNoContent},
+		{"duplicate", http.MethodPost, "/routes", `{"name": "api", "pool": "api"}`, http.StatusConflict},
+		{"no target", http.MethodPost, "/routes", `{"name": "empty"}`, http.StatusBadRequest},
+		{"remove unknown", http.MethodDelete, "/routes/missing", "", http.StatusNotFound},
+		{"remove", http.MethodDelete, "/routes/default", "", http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		if got := adminRequest(handler, tc.method, tc.path, tc.body); got.Code != tc.status {
+			t.Errorf("%s: expected %d but got %d: %s", tc.name, tc.status, got.Code, got.Body)
+		}
+	}
+
+	got := routes.GetRoutes()
+	if len(got) != 1 || got[0].Name != "api" {
+		t.Fatalf("expected only the api route to be left but got %+v", got)
+	}
+
+	if got := adminRequest(handler, http.MethodPut, "/routes", `[{"name": "a", "pool": "web"}, {"name": "a", "pool": "api"}]`); got.Code != http.StatusBadRequest {
+		t.Fatalf("expected duplicate names to be rejected with 400 but got %d", got.Code)
+	}
+	if got := adminRequest(handler, http.MethodPut, "/routes", `[{"name": "web", "pool": "web"}]`); got.Code != http.StatusNoContent {
+		t.Fatalf("expected replacing the routes to succeed but got %d: %s", got.Code, got.Body)
+	}
+	if got := routes.GetRoutes(); len(got) != 1 || got[0].Name != "web" {
+		t.Fatalf("expected the table to hold only the web route but got %+v", got)
+	}
+}
+
+func TestAdminRoutesUnknownPool(t *testing.T) {
+	handler, _, routes := newAdminHandler(t)
+
+	for name, tc := range map[string]struct {
+		method string
+		body   string
+	}{
+		"pool":          {http.MethodPost, `{"name": "db", "pool": "db"}`},
+		"split backend": {http.MethodPost, `{"name": "split", "split": {"backends": [{"pool": "web", "weight": 1}, {"pool": "db", "weight": 1}]}}`},
+		"mirror":        {http.MethodPost, `{"name": "mirror", "pool": "web", "mirror": {"pool": "db", "percent": 10}}`},
+		"replace":       {http.MethodPut, `[{"name": "web", "pool": "web"}, {"name": "db", "pool": "db"}]`},
+	} {
+		got := adminRequest(handler, tc.method, "/routes", tc.body)
+		if got.Code != http.StatusBadRequest || !strings.Contains(got.Body.String(), "db") {
+			t.Errorf("%s: expected 400 naming the db pool but got %d: %s", name, got.Code, got.Body)
+		}
+	}
+
+	if got := routes.GetRoutes(); len(got) != 1 || got[0].Name != "default" {
+		t.Fatalf("expected the table to be untouched but got %+v", got)
+	}
+}
+
+func TestAdminSplitWeights(t *testing.T) {
+	handler, _, routes := newAdminHandler(t)
+	if err := routes.SetRoutes([]router.Route{
+		{Name: "default", Pool: "web"},
+		{Name: "canary", Split: &router.TrafficSplit{Backends: []router.SplitBackend{{Pool: "web", Weight: 9}, {Pool: "api", Weight: 1}}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"unknown pool", "/routes/canary/split", `[{"pool": "web", "weight": 1}, {"pool": "db", "weight": 1}]`, http.StatusBadRequest},
+		{"zero sum", "/routes/canary/split", `[{"pool": "web", "weight": 0}, {"pool": "api", "weight": 0}]`, http.StatusBadRequest},
+		{"no split", "/routes/default/split", `[{"pool": "web", "weight": 1}, {"pool": "api", "weight": 1}]`, http.StatusBadRequest},
+		{"unknown route", "/routes/missing/split", `[{"pool": "web", "weight": 1}, {"pool": "api", "weight": 1}]`, http.StatusNotFound},
+		{"update", "/routes/canary/split", `[{"pool": "web", "weight": 1}, {"pool": "api", "weight": 1}]`, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		if got := adminRequest(handler, http.MethodPut, tc.path, tc.body); got.Code != tc.status {
+			t.Errorf("%s: expected %d but got %d: %s", tc.name, tc.status, got.Code, got.Body)
+		}
+	}
+
+	for _, route := range routes.GetRoutes() {
+		if route.Name == "canary" && route.Split.Backends[1].Weight != 1 {
+			t.Fatalf("expected the canary split to be 1:1 but got %+v", route.Split.Backends)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+func newAttributesRouter(t *testing.T, lb loadbalancer.LoadBalancer, backends ...*httptest.Server) *router.Router {
+	t.Helper()
+
+	for i, backend := range backends {
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i+1), host, port, 10)
+		if err := lb.AddServer(server); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool, _ := loadbalancer.NewPool("attributes", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "attributes"})
+	return router.NewRouter(pools, routes)
+}
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	proxies, err := loadbalancer.NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.7:4000", "", "203.0.113.7"},
+		{"203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:4000", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"10.1.2.3:4000", "6.6.6.6, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"10.1.2.3:4000", "", "10.1.2.3"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+
+		if got := proxies.ClientIP(req); got != c.want {
+			t.Errorf("remote %s, forwarded %q: expected client %s but got %s", c.remote, c.forwarded, c.want, got)
+		}
+	}
+
+	if _, err := loadbalancer.NewTrustedProxies([]string{"not-a-network"}); err == nil {
+		t.Fatal("expected an invalid trusted proxy to be rejected")
+	}
+}
+
+func TestIPHashThroughRouter(t *testing.T) {
+	var backends []*httptest.Server
+	for i := 1; i <= 3; i++ {
+		backend := newBackend(fmt.Sprintf("server%d", i), 0)
+		defer backend.Close()
+		backends = append(backends, backend)
+	}
+
+	r := newAttributesRouter(t, loadbalancer.NewIPHashLoadBalancer(), backends...)
+	if err := r.SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(map[string]string)
+	for _, client := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		req.Header.Set("X-Forwarded-For", client)
+
+		response := httptest.NewRecorder()
+		r.ServeRequest(response, req)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s but got %d: %s", client, response.Code, response.Body.String())
+		}
+
+		server := response.Header().Get(backendServerHeader)
+		if previous, ok := served[client]; ok && previous != server {
+			t.Fatalf("expected %s to stay on %s but it moved to %s", client, previous, server)
+		}
+		served[client] = server
+	}
+}
+
+func TestClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer(), backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the upstream request to be cancelled with the client")
+	}
+	<-done
+}
@@ -0,0 +1,217 @@
+package tests
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+)
+
+const frontendSPIFFEID = "spiffe://example.org/frontend"
+
+// newIdentityBackend answers with its name and the identity headers it was
+// sent.
+func newIdentityBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(backendServerHeader, name)
+		w.Header().Set("X-Seen-Subject", r.Header.Get("X-Client-Cert-Subject"))
+		w.Header().Set("X-Seen-URI", r.Header.Get("X-Client-Cert-URI"))
+	}))
+}
+
+type clientAuthFixture struct {
+	ca   *testCA
+	addr string
+}
+
+// newClientAuthFixture starts an mTLS listener that sends the frontend
+// SPIFFE ID to one pool and everyone else to another.
+func newClientAuthFixture(t *testing.T, allow []string) *clientAuthFixture {
+	t.Helper()
+	f := &clientAuthFixture{ca: newTestCA(t)}
+
+	pools := loadbalancer.NewPoolManager()
+	for _, name := range []string{"frontend", "everyone"} {
+		backend := newIdentityBackend(name)
+		t.Cleanup(backend.Close)
+
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(name, host, port, 10)
+
+		lb := loadbalancer.NewRoundRobinLoadBalancer()
+		_ = lb.AddServer(server)
+		pool, _ := loadbalancer.NewPool(name, lb)
+		_ = pools.AddPool(pool)
+	}
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "frontend", Priority: 1, Identities: []string{frontendSPIFFEID}, Pool: "frontend"})
+	_ = routes.AddRoute(router.Route{Name: "everyone", Pool: "everyone"})
+	r := router.NewRouter(pools, routes)
+
+	_, certFile, keyFile := f.ca.issue(t, "lb.example.org", x509.ExtKeyUsageServerAuth)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{TLS: &servlets.TLSConfig{
+		Certificates: []servlets.CertificateConfig{{CertFile: certFile, KeyFile: keyFile}},
+		ClientAuth:   &servlets.ClientAuthConfig{CAFiles: []string{f.ca.CAFile}, Allow: allow},
+	}})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	f.addr = fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", f.addr)
+		if err == nil {
+			conn.Close()
+			return f
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// get makes a request presenting a certificate for name and uris, or no
+// certificate if name is empty.
+func (f *clientAuthFixture) get(t *testing.T, name string, uris ...string) (*http.Response, error) {
+	t.Helper()
+
+	config := &tls.Config{RootCAs: f.ca.pool(), ServerName: "lb.example.org"}
+	if name != "" {
+		cert, _, _ := f.ca.issue(t, name, x509.ExtKeyUsageClientAuth, uris...)
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	client := &http.Client{Timeout: 2 * time.Second, Transport: &http.Transport{TLSClientConfig: config}}
+	req, _ := http.NewRequest(http.MethodGet, "https://"+f.addr+"/", nil)
+	req.Header.Set("X-Client-Cert-Subject", "forged")
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestClientCertificateRouting(t *testing.T) {
+	f := newClientAuthFixture(t, nil)
+
+	resp, err := f.get(t, "frontend", frontendSPIFFEID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := resp.Header.Get(backendServerHeader); server != "frontend" {
+		t.Fatalf("expected the SPIFFE ID to route to the frontend pool but got %s", server)
+	}
+	if got := resp.Header.Get("X-Seen-URI"); got != frontendSPIFFEID {
+		t.Fatalf("expected the backend to be sent the SPIFFE ID but got %q", got)
+	}
+	if got := resp.Header.Get("X-Seen-Subject"); got != "frontend" {
+		t.Fatalf("expected the backend to be sent the verified subject but got %q", got)
+	}
+
+	resp, err = f.get(t, "batch-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := resp.Header.Get(backendServerHeader); server != "everyone" {
+		t.Fatalf("expected other identities to take the default route but got %s", server)
+	}
+	if got := resp.Header.Get("X-Seen-URI"); got != "" {
+		t.Fatalf("expected no SAN URI header but got %q", got)
+	}
+
+	if _, err := f.get(t, ""); err == nil {
+		t.Fatal("expected a client without a certificate to be refused")
+	}
+}
+
+func TestClientCertificateAllowlist(t *testing.T) {
+	f := newClientAuthFixture(t, []string{"spiffe://example.org/*", "ops"})
+
+	for _, c := range []struct {
+		name string
+		uris []string
+		want int
+	}{
+		{"frontend", []string{frontendSPIFFEID}, http.StatusOK},
+		{"ops", nil, http.StatusOK},
+		{"intruder", nil, http.StatusForbidden},
+		{"intruder", []string{"spiffe://elsewhere.org/frontend"}, http.StatusForbidden},
+	} {
+		resp, err := f.get(t, c.name, c.uris...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.want {
+			t.Errorf("%s %v: expected status %d but got %d", c.name, c.uris, c.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestIdentityHeadersStrippedWithoutClientAuth(t *testing.T) {
+	backend := newIdentityBackend("plain")
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	server, _ := loadbalancer.NewServerInstance("plain", host, port, 10)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+	pools := loadbalancer.NewPoolManager()
+	pool, _ := loadbalancer.NewPool("plain", lb)
+	_ = pools.AddPool(pool)
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "plain", Pool: "plain"})
+	r := router.NewRouter(pools, routes)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lbPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewHttpServer(r, lbPort, r.TrustedProxies(), servlets.ListenerConfig{})
+	go srv.Start()
+	defer srv.Stop()
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%d/", lbPort), nil)
+	req.Header.Set("X-Client-Cert-Subject", "forged")
+	req.Header.Set("X-Client-Cert-URI", frontendSPIFFEID)
+
+	var resp *http.Response
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	resp.Body.Close()
+
+	if subject, uri := resp.Header.Get("X-Seen-Subject"), resp.Header.Get("X-Seen-URI"); subject != "" || uri != "" {
+		t.Fatalf("expected forged identity headers to be dropped but the backend saw %q and %q", subject, uri)
+	}
+}
@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newGRPCBackend serves gRPC over h2c, echoing the request message. A
+// non-zero status is sent as a trailers-only response, unless trailing is
+// set, in which case the echo is followed by that status in the trailers.
+func newGRPCBackend(name string, status int, trailing bool) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(backendServerHeader, name)
+		msg, err := util.ReadGRPCFrame(r.Body, 1024)
+		if err != nil {
+			util.WriteGRPCError(w, util.GRPCInternal, err.Error())
+			return
+		}
+
+		if status != util.GRPCOK && !trailing {
+			util.WriteGRPCError(w, status, "unavailable for testing")
+			return
+		}
+
+		w.Header().Set("Content-Type", util.GRPCContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		util.WriteGRPCFrame(w, msg)
+		w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func newGRPCRouter(t *testing.T, poolName string, policy router.UpstreamPolicy, backends ...*httptest.Server) (*httptest.Server, []*loadbalancer.ServerInstance) {
+	t.Helper()
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	var servers []*loadbalancer.ServerInstance
+	for i, backend := range backends {
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i+1), host, port, 10)
+		server.SetMultiplexed(true)
+		_ = lb.AddServer(server)
+		servers = append(servers, server)
+	}
+
+	pool, _ := loadbalancer.NewPool(poolName, lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: poolName})
+
+	r := router.NewRouter(pools, routes)
+	policy.Protocol = router.ProtocolH2C
+	if err := r.SetUpstreamPolicy(poolName, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	lbServer := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(r.ServeRequest), &http2.Server{}))
+	t.Cleanup(lbServer.Close)
+	return lbServer, servers
+}
+
+func newH2CClient() *http.Client {
+	return &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// callGRPC makes a unary call with a body of unknown length, like a
+// streaming client would, and returns the reply and its grpc-status.
+func callGRPC(t *testing.T, url string, msg string) (*http.Response, string, string) {
+	t.Helper()
+
+	var frame bytes.Buffer
+	util.WriteGRPCFrame(&frame, []byte(msg))
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/test.Echo/Echo", io.MultiReader(&frame))
+	req.Header.Set("Content-Type", util.GRPCContentType)
+	req.Header.Set("Te", "trailers")
+
+	resp, err := newH2CClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reply, _ := util.ReadGRPCFrame(resp.Body, 1024)
+	io.Copy(io.Discard, resp.Body)
+
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	return resp, string(reply), status
+}
+
+func TestGRPCRetriesOnUnavailable(t *testing.T) {
+	unavailable := newGRPCBackend("server1", util.GRPCUnavailable, false)
+	defer unavailable.Close()
+	healthy := newGRPCBackend("server2", util.GRPCOK, false)
+	defer healthy.Close()
+
+	lb, _ := newGRPCRouter(t, "grpc-retries", router.UpstreamPolicy{
+		Retry: router.RetryPolicy{MaxAttempts: 2, RetryOn: []string{"unavailable"}},
+	}, unavailable, healthy)
+
+	retries := metrics.GetCounter(`router_retries_total{pool="grpc-retries"}`)
+	before := retries.Value()
+	for range 2 {
+		resp, reply, status := callGRPC(t, lb.URL, "ping")
+		if status != "0" {
+			t.Fatalf("expected grpc-status 0 but got %q", status)
+		}
+		if reply != "ping" {
+			t.Fatalf("expected the call to be echoed but got %q", reply)
+		}
+		if server := resp.Header.Get(backendServerHeader); server != "server2" {
+			t.Fatalf("expected server2 to answer but got %s", server)
+		}
+	}
+
+	// Round robin sends each call to server1 first.
+	if n := retries.Value() - before; n != 2 {
+		t.Fatalf("expected 2 retries but got %d", n)
+	}
+}
+
+func TestGRPCStatusCountsAsFailure(t *testing.T) {
+	backend := newGRPCBackend("server1", util.GRPCUnavailable, true)
+	defer backend.Close()
+
+	lb, servers := newGRPCRouter(t, "grpc-outliers", router.UpstreamPolicy{}, backend)
+	limiter, _ := loadbalancer.NewAIMDLimiter(1, 10, 10, 0)
+	servers[0].SetConcurrencyLimiter(limiter)
+
+	statuses := metrics.GetCounter(`router_grpc_status_total{pool="grpc-outliers",code="14"}`)
+	before := statuses.Value()
+
+	resp, reply, status := callGRPC(t, lb.URL, "ping")
+	if resp.StatusCode != http.StatusOK || reply != "ping" {
+		t.Fatalf("expected the streamed reply to pass through, got status %d and %q", resp.StatusCode, reply)
+	}
+	if status != "14" {
+		t.Fatalf("expected the grpc-status trailer to be forwarded, got %q", status)
+	}
+
+	if limit := servers[0].Status().ConcurrencyLimit; limit >= 10 {
+		t.Fatalf("expected grpc-status UNAVAILABLE to count as a failure, limit is still %d", limit)
+	}
+	if n := statuses.Value() - before; n != 1 {
+		t.Fatalf("expected 1 UNAVAILABLE status to be counted but got %d", n)
+	}
+}
+
+func TestGRPCUpstreamErrors(t *testing.T) {
+	backend := newGRPCBackend("server1", util.GRPCOK, false)
+	backend.Close()
+
+	lb, _ := newGRPCRouter(t, "grpc-errors", router.UpstreamPolicy{}, backend)
+
+	resp, _, status := callGRPC(t, lb.URL, "ping")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected a trailers-only response but got status %d", resp.StatusCode)
+	}
+	if status != strconv.Itoa(util.GRPCUnavailable) {
+		t.Fatalf("expected grpc-status UNAVAILABLE but got %q", status)
+	}
+}
+
+func TestGRPCHealthProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	backend := servlets.NewBackendServer(port, true)
+	go backend.Start()
+	defer backend.Stop()
+
+	probe := loadbalancer.GRPCProbe("http", "", newH2CClient())
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", port, 10)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err = probe(context.Background(), server)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the gRPC backend to be healthy: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	notServing := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", util.GRPCContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		util.WriteGRPCFrame(w, util.EncodeHealthCheckResponse(util.HealthNotServing))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer notServing.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(notServing.URL, "http://"))
+	port, _ = strconv.Atoi(portStr)
+	server, _ = loadbalancer.NewServerInstance("server2", host, port, 10)
+	if err := probe(context.Background(), server); err == nil {
+		t.Fatal("expected a NOT_SERVING backend to fail the probe")
+	}
+}
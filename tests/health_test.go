@@ -0,0 +1,252 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+)
+
+func TestHealthFlipsDuringSelection(t *testing.T) {
+	base := loadbalancer.NewRoundRobinLoadBalancer()
+	lb, err := loadbalancer.NewStickySessionLoadBalancer(base, loadbalancer.StickySessionConfig{Secret: []byte("test-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"server1", "server2"} {
+		server, _ := loadbalancer.NewServerInstance(id, "192.168.1.10", 8080, 1000)
+		_ = lb.AddServer(server)
+	}
+
+	health, err := loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{Interval: time.Hour, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failing atomic.Bool
+	health.SetProbe(func(ctx context.Context, server loadbalancer.Server) error {
+		if failing.Load() && loadbalancer.InstanceOf(server).ID == "server1" {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	// A cookie pinning the client to server1 sends the sticky path through
+	// the health status too.
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	first, err := lb.SelectServer(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.Pin(recorder.Header(), first)
+	first.ReleaseConnection()
+	cookie := recorder.Result().Cookies()[0]
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for range 500 {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.AddCookie(cookie)
+				if server, err := lb.SelectServer(context.Background(), req); err == nil {
+					server.ReleaseConnection()
+				}
+				if server, err := lb.NextServer(context.Background()); err == nil {
+					server.ReleaseConnection()
+				}
+			}
+		}()
+	}
+
+	// Upgraded connections and UDP flows poll their backend's health
+	// without going through the load balancer.
+	servers := lb.GetServers()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		for range 2000 {
+			for _, server := range servers {
+				_ = loadbalancer.InstanceOf(server).IsActive()
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := range 200 {
+			failing.Store(i%2 == 0)
+			health.CheckAll()
+		}
+	}()
+
+	close(start)
+	wg.Wait()
+
+	for _, server := range lb.GetServers() {
+		if !loadbalancer.InstanceOf(server).IsActive() {
+			t.Fatalf("expected %s to end up healthy after the last passing check", loadbalancer.InstanceOf(server).ID)
+		}
+	}
+}
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", "192.168.1.10", 8080, 10)
+	_ = lb.AddServer(server)
+
+	health, err := loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{
+		Interval:           time.Hour,
+		Timeout:            time.Second,
+		HealthyThreshold:   3,
+		UnhealthyThreshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failing atomic.Bool
+	health.SetProbe(func(ctx context.Context, server loadbalancer.Server) error {
+		if failing.Load() {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	steps := []struct {
+		failing bool
+		active  bool
+	}{
+		{true, true},  // one failure is below the unhealthy threshold
+		{false, true}, // a success resets the streak
+		{true, true},
+		{true, false},  // two failures in a row
+		{false, false}, // one and two successes are not enough
+		{false, false},
+		{false, true},
+	}
+	for i, step := range steps {
+		failing.Store(step.failing)
+		health.CheckAll()
+		if server.IsActive() != step.active {
+			t.Fatalf("check %d: expected active %v but got %v", i+1, step.active, server.IsActive())
+		}
+	}
+}
+
+func TestHealthCheckerHTTPProbe(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", host, port, 10)
+	_ = lb.AddServer(server)
+
+	health, err := loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{Path: "/healthz", Interval: time.Hour, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health.CheckAll()
+	if !server.IsActive() {
+		t.Fatal("expected a 200 to keep the server healthy")
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	health.CheckAll()
+	if server.IsActive() {
+		t.Fatal("expected a 503 to mark the server unhealthy")
+	}
+
+	status.Store(http.StatusNoContent)
+	health.CheckAll()
+	if !server.IsActive() {
+		t.Fatal("expected a 204 to bring the server back")
+	}
+
+	backend.Close()
+	health.CheckAll()
+	if server.IsActive() {
+		t.Fatal("expected a refused connection to mark the server unhealthy")
+	}
+}
+
+func TestPoolRunsHealthChecker(t *testing.T) {
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	for _, id := range []string{"server1", "server2"} {
+		server, _ := loadbalancer.NewServerInstance(id, "192.168.1.10", 8080, 10)
+		_ = lb.AddServer(server)
+	}
+	pool, err := loadbalancer.NewPool("web", lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	health, _ := loadbalancer.NewHealthChecker(pool, loadbalancer.HealthCheckConfig{Interval: 5 * time.Millisecond, Timeout: time.Second})
+	var probes atomic.Int32
+	health.SetProbe(func(ctx context.Context, server loadbalancer.Server) error {
+		probes.Add(1)
+		if loadbalancer.InstanceOf(server).ID == "server2" {
+			return errors.New("down")
+		}
+		return nil
+	})
+	pool.SetHealthChecker(health)
+
+	time.Sleep(20 * time.Millisecond)
+	if probes.Load() != 0 {
+		t.Fatal("expected the health checker to wait for the pool to be registered")
+	}
+
+	pools := loadbalancer.NewPoolManager()
+	if err := pools.AddPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	if err := pools.AddPool(pool); !errors.Is(err, loadbalancer.ErrPoolAlreadyExists) {
+		t.Fatalf("expected ErrPoolAlreadyExists but got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for pool.Status().Healthy != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected server2 to be marked down but got %+v", pool.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := pools.RemovePool("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pools.GetPool("web"); !errors.Is(err, loadbalancer.ErrPoolNotFound) {
+		t.Fatalf("expected ErrPoolNotFound but got %v", err)
+	}
+	stopped := probes.Load()
+	time.Sleep(20 * time.Millisecond)
+	if probes.Load() != stopped {
+		t.Fatal("expected removing the pool to stop its health checker")
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CBackend serves cleartext HTTP/2, holding each request until release
+// is closed and rejecting anything that arrives over HTTP/1.1.
+func newH2CBackend(release chan struct{}) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "expected HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprint(w, r.Proto)
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestH2CUpstream(t *testing.T) {
+	release := make(chan struct{})
+	backend := newH2CBackend(release)
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	server, _ := loadbalancer.NewServerInstance("server1", host, port, 10)
+	server.SetMultiplexed(true)
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+
+	pool, _ := loadbalancer.NewPool("h2c", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "h2c"})
+
+	r := router.NewRouter(pools, routes)
+	err := r.SetUpstreamPolicy("h2c", router.UpstreamPolicy{
+		Protocol:    router.ProtocolH2C,
+		Connections: router.ConnectionPoolPolicy{MaxConcurrentStreams: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 2)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(response *httptest.ResponseRecorder) {
+			defer wg.Done()
+			r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		}(responses[i])
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Status().Streams != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 streams in use but got %d", server.Status().Streams)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := server.Status().Connections; got != 0 {
+		t.Fatalf("expected an h2c server to report streams instead of connections, got %d connections", got)
+	}
+
+	response := httptest.NewRecorder()
+	r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected a request over the stream limit to get 503 but got %d", response.Code)
+	}
+
+	close(release)
+	wg.Wait()
+
+	for _, response := range responses {
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d: %s", response.Code, response.Body.String())
+		}
+		if got := response.Body.String(); got != "HTTP/2.0" {
+			t.Fatalf("expected the backend to be reached over HTTP/2.0 but got %q", got)
+		}
+	}
+
+	if dials := metrics.GetCounter(`router_connection_pool_dials_total{pool="h2c"}`).Value(); dials != 1 {
+		t.Fatalf("expected both streams to share one connection but got %d dials", dials)
+	}
+}
+
+func TestH2CListener(t *testing.T) {
+	backend := newBackend("server1", 0)
+	defer backend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer(), backend)
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{H2C: true})
+	go srv.Start()
+	defer srv.Stop()
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	var resp *http.Response
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected the listener to answer over HTTP/2 but got %s", resp.Proto)
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+)
+
+// startHTTP3Listener runs a load balancer listener serving HTTPS and HTTP/3
+// in front of a single backend and returns its port.
+func startHTTP3Listener(t *testing.T) int {
+	t.Helper()
+
+	dir := t.TempDir()
+	config := servlets.TLSConfig{Certificates: []servlets.CertificateConfig{validCertificate(t, dir, "h3", "h3.example.com")}}
+
+	backend := newBackend("server1", 0)
+	t.Cleanup(backend.Close)
+
+	// The port has to be free for both TCP and UDP.
+	var port int
+	for {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port = udp.LocalAddr().(*net.UDPAddr).Port
+		tcp, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		udp.Close()
+		if err == nil {
+			tcp.Close()
+			break
+		}
+	}
+
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer(), backend)
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{TLS: &config, HTTP3: true})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return port
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHTTP3Listener(t *testing.T) {
+	port := startHTTP3Listener(t)
+	url := fmt.Sprintf("https://127.0.0.1:%d/", port)
+
+	connections := metrics.GetCounter(fmt.Sprintf("listener_quic_connections_total{port=\"%d\"}", port))
+	before := connections.Value()
+
+	https := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := https.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := fmt.Sprintf(`h3=":%d"; ma=86400`, port); resp.Header.Get("Alt-Svc") != want {
+		t.Fatalf("expected HTTPS responses to advertise %s but got %q", want, resp.Header.Get("Alt-Svc"))
+	}
+
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	t.Cleanup(func() { transport.Close() })
+	h3 := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err = h3.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 3 {
+		t.Fatalf("expected an HTTP/3 response but got %s", resp.Proto)
+	}
+	if string(body) != "hello from server1" {
+		t.Fatalf("expected the request to be routed to server1 but got %q", body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Fatal("expected HTTP/3 responses not to advertise Alt-Svc")
+	}
+	if got := connections.Value() - before; got != 1 {
+		t.Fatalf("expected 1 QUIC connection but counted %d", got)
+	}
+}
+
+func TestHTTP3HandshakeFailures(t *testing.T) {
+	port := startHTTP3Listener(t)
+
+	failures := metrics.GetCounter(fmt.Sprintf("listener_quic_handshake_failures_total{port=\"%d\"}", port))
+	before := failures.Value()
+
+	// The client doesn't trust the self-signed certificate, so it abandons
+	// the handshake.
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{ServerName: "h3.example.com"}}
+	t.Cleanup(func() { transport.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://127.0.0.1:%d/", port), nil)
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for failures.Value() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the failed handshake to be counted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
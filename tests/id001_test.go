@@ -49,7 +49,7 @@ func (t *roundRobinTest) theFollowingBackendServersAreConfigured(table *godog.Ta
 
 func (t *roundRobinTest) allBackendServersAreHealthy() error {
 	for _, server := range t.lb.GetServers() {
-		if !server.(*loadbalancer.ServerInstance).Active {
+		if !server.(*loadbalancer.ServerInstance).IsActive() {
 			t.lastError = loadbalancer.ErrServerNotAvailable
 			return loadbalancer.ErrServerNotAvailable
 		}
@@ -2,8 +2,10 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/cucumber/godog"
@@ -50,7 +52,7 @@ func (t *weightedRoundRobinTest) theFollowingBackendServersAreConfigured(table *
 
 func (t *weightedRoundRobinTest) allBackendServersAreHealthy() error {
 	for _, server := range t.lb.GetServers() {
-		if !server.(*loadbalancer.WeightedServerInstance).Active {
+		if !server.(*loadbalancer.WeightedServerInstance).IsActive() {
 			t.lastError = loadbalancer.ErrServerNotAvailable
 			return loadbalancer.ErrServerNotAvailable
 		}
@@ -147,3 +149,88 @@ func TestID002(t *testing.T) {
 		t.Fatal("ID002 test failure")
 	}
 }
+
+func TestID002ConcurrentWeightUpdates(t *testing.T) {
+	lb := loadbalancer.NewWeightedRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewWeightedServerInstance("server1", "192.168.1.10", 8080, 1000, 1)
+	_ = lb.AddServer(server)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for range 1000 {
+				// What GET /pools/{pool}/servers and the proxy do.
+				if i%2 == 0 {
+					_ = server.Status()
+				} else if srv, err := lb.NextServer(context.Background()); err == nil {
+					srv.ReleaseConnection()
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		for i := range 1000 {
+			if err := lb.UpdateServerWeight("server1", 1+i%100); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	close(start)
+	wg.Wait()
+
+	if got := server.Status().Weight; got != 100 {
+		t.Fatalf("expected the last weight of 100 but got %d", got)
+	}
+}
+
+func TestID002UpdateServerWeight(t *testing.T) {
+	lb := loadbalancer.NewWeightedRoundRobinLoadBalancer()
+	for _, id := range []string{"server1", "server2"} {
+		server, _ := loadbalancer.NewWeightedServerInstance(id, "192.168.1.10", 8080, 100, 1)
+		_ = lb.AddServer(server)
+	}
+
+	if err := lb.UpdateServerWeight("server1", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for range 8 {
+		server, err := lb.NextServer(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[loadbalancer.InstanceOf(server).ID]++
+		server.ReleaseConnection()
+	}
+	if counts["server1"] != 6 || counts["server2"] != 2 {
+		t.Fatalf("expected weights 3:1 to route 6 and 2 of 8 requests but got %v", counts)
+	}
+
+	if err := lb.UpdateServerWeight("server1", 0); !errors.Is(err, loadbalancer.ErrInvalidWeight) {
+		t.Fatalf("expected ErrInvalidWeight for weight 0 but got %v", err)
+	}
+	if err := lb.UpdateServerWeight("server3", 2); !errors.Is(err, loadbalancer.ErrServerNotFound) {
+		t.Fatalf("expected ErrServerNotFound for an unknown server but got %v", err)
+	}
+	if weight := lb.GetServers()[0].(*loadbalancer.WeightedServerInstance).GetWeight(); weight != 3 {
+		t.Fatalf("expected rejected updates to keep weight 3 but got %d", weight)
+	}
+
+	plain := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", "192.168.1.10", 8080, 100)
+	_ = plain.AddServer(server)
+	if err := plain.UpdateServerWeight("server1", 2); !errors.Is(err, loadbalancer.ErrServerNotWeighted) {
+		t.Fatalf("expected ErrServerNotWeighted for an unweighted server but got %v", err)
+	}
+}
@@ -0,0 +1,405 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cucumber/godog"
+	lbconfig "github.com/raydatray/goobernetes/pkg/config"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const stickyCookieName = "goobernetes_session"
+
+type stickySessionTest struct {
+	lb        *loadbalancer.StickySessionLoadBalancer
+	now       time.Time
+	resource  string
+	cookie    *http.Cookie
+	oldCookie *http.Cookie
+	server    *loadbalancer.ServerInstance
+	lastError error
+}
+
+func (t *stickySessionTest) reset() {
+	t.lb = nil
+	t.now = time.Now()
+	t.resource = "resource-A"
+	t.cookie = nil
+	t.oldCookie = nil
+	t.server = nil
+	t.lastError = nil
+}
+
+func (t *stickySessionTest) newLoadBalancer(idleTimeout time.Duration) error {
+	lb, err := loadbalancer.NewStickySessionLoadBalancer(loadbalancer.NewRoundRobinLoadBalancer(), loadbalancer.StickySessionConfig{
+		CookieName:  stickyCookieName,
+		HttpOnly:    true,
+		IdleTimeout: idleTimeout,
+		Secret:      []byte("test-secret"),
+		Clock:       func() time.Time { return t.now },
+	})
+	if err != nil {
+		return err
+	}
+	t.lb = lb
+
+	for i := 1; i <= 3; i++ {
+		server, err := loadbalancer.NewServerInstance(fmt.Sprintf("server-%d", i), fmt.Sprintf("192.168.1.%d", 10+i), 8080, 100)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %v", err)
+		}
+
+		if err := t.lb.AddServer(server); err != nil {
+			return fmt.Errorf("failed to add server: %v", err)
+		}
+	}
+	return nil
+}
+
+// send routes one request carrying the current cookie, and keeps the cookie
+// the load balancer hands back.
+func (t *stickySessionTest) send() error {
+	req := httptest.NewRequest(http.MethodGet, "/"+t.resource, nil)
+	if t.cookie != nil {
+		req.AddCookie(t.cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	server, err := t.lb.SelectServer(context.Background(), req)
+	t.lastError = err
+	if err != nil {
+		return err
+	}
+	t.lb.Pin(recorder.Header(), server)
+	server.ReleaseConnection()
+	t.server = server.(*loadbalancer.ServerInstance)
+
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == stickyCookieName {
+			t.oldCookie = t.cookie
+			t.cookie = cookie
+		}
+	}
+	return nil
+}
+
+func (t *stickySessionTest) theLoadBalancerIsRunningWithStickySessionSupportEnabled() error {
+	t.reset()
+	return nil
+}
+
+func (t *stickySessionTest) theBackendServersAreConfiguredToHandleRequestsFromClients() error {
+	return t.newLoadBalancer(30 * time.Minute)
+}
+
+func (t *stickySessionTest) theLoadBalancerUsesASessionCookieToIdentifyClients() error {
+	if t.lb == nil {
+		return fmt.Errorf("sticky session load balancer not configured")
+	}
+	return nil
+}
+
+func (t *stickySessionTest) aClientSendsARequestToTheLoadBalancerFor(resource string) error {
+	t.resource = resource
+	return nil
+}
+
+func (t *stickySessionTest) theLoadBalancerRoutesTheRequestToABackendServer() error {
+	return t.send()
+}
+
+func (t *stickySessionTest) theClientShouldReceiveASessionCookieIdentifyingTheBackendServer() error {
+	if t.cookie == nil {
+		return fmt.Errorf("expected a %q cookie but got none", stickyCookieName)
+	}
+
+	if !t.cookie.HttpOnly {
+		return fmt.Errorf("expected session cookie to be HttpOnly")
+	}
+	return nil
+}
+
+func (t *stickySessionTest) subsequentRequestsFromTheClientShouldBeRoutedToTheSameBackendServer() error {
+	expected := t.server.ID
+	for i := 0; i < 5; i++ {
+		if err := t.send(); err != nil {
+			return err
+		}
+
+		if t.server.ID != expected {
+			return fmt.Errorf("request %d: expected %s but got %s", i+1, expected, t.server.ID)
+		}
+	}
+	return nil
+}
+
+func (t *stickySessionTest) theLoadBalancerHasASessionCookieForAClientIdentifying(serverID string) error {
+	if err := t.send(); err != nil {
+		return err
+	}
+
+	if t.server.ID != serverID {
+		return fmt.Errorf("expected session for %s but got %s", serverID, t.server.ID)
+	}
+	return nil
+}
+
+func (t *stickySessionTest) serverIsDown(serverID string) error {
+	return t.lb.SetServerStatus(serverID, false)
+}
+
+func (t *stickySessionTest) theClientSendsARequest() error {
+	return t.send()
+}
+
+func (t *stickySessionTest) theLoadBalancerShouldRouteTheRequestToAnAvailableBackendServer() error {
+	if t.lastError != nil {
+		return fmt.Errorf("expected request to be routed but got %v", t.lastError)
+	}
+
+	if !t.server.IsActive() {
+		return fmt.Errorf("request was routed to inactive server %s", t.server.ID)
+	}
+	return nil
+}
+
+func (t *stickySessionTest) theClientShouldReceiveANewSessionCookieForTheNewBackendServer() error {
+	if t.oldCookie == nil || t.cookie.Value == t.oldCookie.Value {
+		return fmt.Errorf("expected a new session cookie to be issued")
+	}
+
+	expected := t.server.ID
+	if err := t.send(); err != nil {
+		return err
+	}
+
+	if t.server.ID != expected {
+		return fmt.Errorf("expected new cookie to pin %s but got %s", expected, t.server.ID)
+	}
+	return nil
+}
+
+func (t *stickySessionTest) aClientSendsMultipleRequestsToTheLoadBalancerFor(resource string) error {
+	return t.aClientSendsARequestToTheLoadBalancerFor(resource)
+}
+
+func (t *stickySessionTest) theFirstRequestIsRoutedTo(serverID string) error {
+	return t.theLoadBalancerHasASessionCookieForAClientIdentifying(serverID)
+}
+
+func (t *stickySessionTest) theLoadBalancerShouldRouteTheRequestToBasedOnTheSessionCookie(serverID string) error {
+	if t.server.ID != serverID {
+		return fmt.Errorf("expected %s but got %s", serverID, t.server.ID)
+	}
+	return nil
+}
+
+func (t *stickySessionTest) theLoadBalancerIsRunningWithStickySessionsAndSessionTimeoutSetToMinutes(minutes int) error {
+	if err := t.newLoadBalancer(time.Duration(minutes) * time.Minute); err != nil {
+		return err
+	}
+	return t.theLoadBalancerHasASessionCookieForAClientIdentifying("server-1")
+}
+
+func (t *stickySessionTest) theClientHasNotMadeARequestForMinutes(minutes int) error {
+	t.now = t.now.Add(time.Duration(minutes) * time.Minute)
+	return nil
+}
+
+func (t *stickySessionTest) theLoadBalancerShouldTreatTheClientAsANewSessionOnTheNextRequest() error {
+	if err := t.send(); err != nil {
+		return err
+	}
+
+	if t.oldCookie == nil || t.cookie.Value == t.oldCookie.Value {
+		return fmt.Errorf("expected a new session cookie to be issued")
+	}
+	return nil
+}
+
+func (t *stickySessionTest) theClientShouldBeRoutedToAnAvailableBackendServerBasedOnTheLoadBalancingAlgorithm() error {
+	// Round robin already handed out server-1, so a fresh session lands on server-2
+	if t.server.ID != "server-2" {
+		return fmt.Errorf("expected server-2 but got %s", t.server.ID)
+	}
+	return nil
+}
+
+func initializeID011Scenario(ctx *godog.ScenarioContext) {
+	test := &stickySessionTest{}
+
+	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.Step(`^the load balancer is running with sticky session support enabled$`, test.theLoadBalancerIsRunningWithStickySessionSupportEnabled)
+	ctx.Step(`^the backend servers are configured to handle requests from clients$`, test.theBackendServersAreConfiguredToHandleRequestsFromClients)
+	ctx.Step(`^the load balancer uses a session cookie to identify clients$`, test.theLoadBalancerUsesASessionCookieToIdentifyClients)
+	ctx.Step(`^a client sends a request to the load balancer for "([^"]*)"$`, test.aClientSendsARequestToTheLoadBalancerFor)
+	ctx.Step(`^the load balancer routes the request to a backend server$`, test.theLoadBalancerRoutesTheRequestToABackendServer)
+	ctx.Step(`^the client should receive a session cookie identifying the backend server$`, test.theClientShouldReceiveASessionCookieIdentifyingTheBackendServer)
+	ctx.Step(`^subsequent requests from the client should be routed to the same backend server using the session cookie$`, test.subsequentRequestsFromTheClientShouldBeRoutedToTheSameBackendServer)
+	ctx.Step(`^the load balancer has a session cookie for a client identifying "([^"]*)"$`, test.theLoadBalancerHasASessionCookieForAClientIdentifying)
+	ctx.Step(`^"([^"]*)" is down$`, test.serverIsDown)
+	ctx.Step(`^the client sends a request$`, test.theClientSendsARequest)
+	ctx.Step(`^the load balancer should route the request to an available backend server$`, test.theLoadBalancerShouldRouteTheRequestToAnAvailableBackendServer)
+	ctx.Step(`^the client should receive a new session cookie for the new backend server$`, test.theClientShouldReceiveANewSessionCookieForTheNewBackendServer)
+	ctx.Step(`^a client sends multiple requests to the load balancer for "([^"]*)"$`, test.aClientSendsMultipleRequestsToTheLoadBalancerFor)
+	ctx.Step(`^the first request is routed to "([^"]*)"$`, test.theFirstRequestIsRoutedTo)
+	ctx.Step(`^the client sends a second request$`, test.theClientSendsARequest)
+	ctx.Step(`^the load balancer should route the request to "([^"]*)" based on the session cookie$`, test.theLoadBalancerShouldRouteTheRequestToBasedOnTheSessionCookie)
+	ctx.Step(`^the load balancer is running with sticky sessions and session timeout set to (\d+) minutes$`, test.theLoadBalancerIsRunningWithStickySessionsAndSessionTimeoutSetToMinutes)
+	ctx.Step(`^the client has not made a request for (\d+) minutes$`, test.theClientHasNotMadeARequestForMinutes)
+	ctx.Step(`^the load balancer should treat the client as a new session on the next request$`, test.theLoadBalancerShouldTreatTheClientAsANewSessionOnTheNextRequest)
+	ctx.Step(`^the client should be routed to an available backend server based on the load balancing algorithm$`, test.theClientShouldBeRoutedToAnAvailableBackendServerBasedOnTheLoadBalancingAlgorithm)
+}
+
+func TestID011(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: initializeID011Scenario,
+		Options: &godog.Options{
+			Format:    "pretty",
+			Paths:     []string{"../features/ID011_Sticky_Sessions.feature"},
+			Randomize: 0,
+		},
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("ID011 test failure")
+	}
+}
+
+// stickyCookie signs a session cookie the way the load balancer does.
+func stickyCookie(name string, secret string, serverID string, lastSeen time.Time) *http.Cookie {
+	payload := fmt.Sprintf("%s.%d", serverID, lastSeen.Unix())
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return &http.Cookie{Name: name, Value: payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))}
+}
+
+func TestID011ConfigIdleTimeout(t *testing.T) {
+	disabled := util.Duration(0)
+	cases := []struct {
+		name        string
+		idleTimeout *util.Duration
+		staleServer string
+	}{
+		{"unset defaults to 30m", nil, "server1"},
+		{"0 disables", &disabled, "server2"},
+	}
+
+	for _, c := range cases {
+		cfg := &lbconfig.Config{
+			StickySecret: "test-secret",
+			Pools: []lbconfig.PoolConfig{{
+				Name:     "web",
+				Strategy: lbconfig.StrategyRoundRobin,
+				MaxConns: 10,
+				Sticky:   &lbconfig.StickyConfig{IdleTimeout: c.idleTimeout},
+				Servers: []lbconfig.ServerConfig{
+					{ID: "server1", Host: "192.168.1.10", Port: 8080},
+					{ID: "server2", Host: "192.168.1.11", Port: 8080},
+				},
+			}},
+		}
+		pools, err := cfg.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool, _ := pools.GetPool("web")
+		selector := pool.LoadBalancer.(loadbalancer.RequestSelector)
+
+		route := func(lastSeen time.Time) string {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(stickyCookie("goobernetes_web", "test-secret", "server2", lastSeen))
+			server, err := selector.SelectServer(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.ReleaseConnection()
+			return loadbalancer.InstanceOf(server).ID
+		}
+
+		if got := route(time.Now().Add(-time.Minute)); got != "server2" {
+			t.Errorf("%s: expected a fresh session to stay on server2 but got %s", c.name, got)
+		}
+		if got := route(time.Now().Add(-31 * time.Minute)); got != c.staleServer {
+			t.Errorf("%s: expected a session idle for 31m to go to %s but got %s", c.name, c.staleServer, got)
+		}
+		pools.RemovePool("web")
+	}
+}
+
+func TestID011CookieNamesTheServerThatAnswered(t *testing.T) {
+	lb, err := loadbalancer.NewStickySessionLoadBalancer(loadbalancer.NewRoundRobinLoadBalancer(), loadbalancer.StickySessionConfig{Secret: []byte("test-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(failing.Close)
+	healthy := newBackend("server2", 0)
+	t.Cleanup(healthy.Close)
+
+	r := newAttributesRouter(t, lb, failing, healthy)
+	if err := r.SetUpstreamPolicy("attributes", router.UpstreamPolicy{Retry: router.RetryPolicy{
+		MaxAttempts: 2,
+		RetryOn:     []string{"503"},
+		Budget:      router.RetryBudget{Ratio: 1, MinPerSecond: 100},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first pick is server1, which fails and is retried on server2.
+	recorder := httptest.NewRecorder()
+	r.ServeRequest(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get(backendServerHeader) != "server2" {
+		t.Fatalf("expected the request to be answered by server2 but got %d from %q", recorder.Code, recorder.Header().Get(backendServerHeader))
+	}
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Value, "server2.") {
+		t.Fatalf("expected one session cookie pinning server2 but got %v", cookies)
+	}
+}
+
+func TestID011PinnedServerInPanicMode(t *testing.T) {
+	lb, err := loadbalancer.NewStickySessionLoadBalancer(loadbalancer.NewRoundRobinLoadBalancer(), loadbalancer.StickySessionConfig{Secret: []byte("test-secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i), "192.168.1.10", 8080+i, 10)
+		_ = lb.AddServer(server)
+		_ = lb.SetServerStatus(server.ID, false)
+	}
+	_ = lb.SetPanicThreshold(0.5)
+
+	// With every server down the pool is in panic mode, where strategies
+	// route to any server, so the pin is kept rather than rebalanced.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(stickyCookie(stickyCookieName, "test-secret", "server3", time.Now()))
+	server, err := lb.SelectServer(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ReleaseConnection()
+
+	if id := loadbalancer.InstanceOf(server).ID; id != "server3" {
+		t.Fatalf("expected the pinned server3 to be used in panic mode but got %s", id)
+	}
+}
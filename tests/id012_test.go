@@ -3,6 +3,9 @@ package tests
 import (
 	"context"
 	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/cucumber/godog"
@@ -150,3 +153,126 @@ func TestID012(t *testing.T) {
 		t.Fatal("ID012 test failure")
 	}
 }
+
+func TestID012ShrinkBelowInFlight(t *testing.T) {
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", "192.168.1.10", 8080, 10)
+	_ = lb.AddServer(server)
+
+	for i := 0; i < 10; i++ {
+		if _, err := lb.NextServer(context.Background()); err != nil {
+			t.Fatalf("acquire %d: %v", i+1, err)
+		}
+	}
+
+	if err := lb.UpdateServerMaxConn("server1", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.GetConnectionAmount() != 10 {
+		t.Fatalf("expected in-flight connections to survive shrink, got %d", server.GetConnectionAmount())
+	}
+
+	for i := 0; i < 5; i++ {
+		server.ReleaseConnection()
+		if server.AcquireConnection() {
+			t.Fatalf("admitted a connection with %d in flight over a limit of 5", server.GetConnectionAmount())
+		}
+	}
+
+	server.ReleaseConnection()
+	if !server.AcquireConnection() {
+		t.Fatalf("expected a connection to be admitted below the limit, got %d in flight", server.GetConnectionAmount())
+	}
+}
+
+func TestID012ConcurrentResize(t *testing.T) {
+	const workers = 64
+	const maxLimit = 4
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", "192.168.1.10", 8080, 20)
+	_ = lb.AddServer(server)
+
+	// Workers admit under the read lock and resizes take the write lock, so
+	// the limit a worker samples is the one it was admitted under. The
+	// in-flight count is dropped before the connection is released, so it
+	// never runs ahead of the server's own count.
+	var resizing sync.RWMutex
+	var inFlight, admitted, peak atomic.Int64
+	var overAdmitted atomic.Value
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				resizing.RLock()
+				srv, err := lb.NextServer(context.Background())
+				if err != nil {
+					resizing.RUnlock()
+					runtime.Gosched()
+					continue
+				}
+
+				current := inFlight.Add(1)
+				if limit := int64(server.ConcurrencyLimit()); current > limit {
+					overAdmitted.CompareAndSwap(nil, fmt.Sprintf("%d connections in flight under a limit of %d", current, limit))
+				}
+				resizing.RUnlock()
+
+				admitted.Add(1)
+				for seen := peak.Load(); current > seen && !peak.CompareAndSwap(seen, current); seen = peak.Load() {
+				}
+				runtime.Gosched()
+				inFlight.Add(-1)
+				srv.ReleaseConnection()
+			}
+		}()
+	}
+
+	limit := maxLimit
+	for i := 0; i < 1000; i++ {
+		limit = 1 + (i*3)%maxLimit
+		resizing.Lock()
+		err := lb.UpdateServerMaxConn("server1", limit)
+		resizing.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := server.ConcurrencyLimit(); got != limit {
+			t.Fatalf("expected the live limit to be %d after resizing but got %d", limit, got)
+		}
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+
+	if reason := overAdmitted.Load(); reason != nil {
+		t.Fatal(reason)
+	}
+	if admitted.Load() == 0 || peak.Load() < 2 {
+		t.Fatalf("expected concurrent admissions but got %d with a peak of %d in flight", admitted.Load(), peak.Load())
+	}
+
+	if server.GetConnectionAmount() != 0 {
+		t.Fatalf("expected all connections to be released, got %d", server.GetConnectionAmount())
+	}
+
+	for i := 0; i < limit; i++ {
+		if !server.AcquireConnection() {
+			t.Fatalf("expected %d connections to be admitted under the final limit of %d", i+1, limit)
+		}
+	}
+	if server.AcquireConnection() {
+		t.Fatalf("admitted a connection over the final limit of %d", limit)
+	}
+}
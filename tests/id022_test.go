@@ -0,0 +1,314 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cucumber/godog"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+const backendServerHeader = "X-Backend-Server"
+
+type timeoutRetryTest struct {
+	backends []*httptest.Server
+	router   *router.Router
+	response *httptest.ResponseRecorder
+}
+
+func (t *timeoutRetryTest) reset() {
+	for _, backend := range t.backends {
+		backend.Close()
+	}
+	t.backends = nil
+	t.router = nil
+	t.response = nil
+}
+
+// newBackend answers after the given delay, unless the proxy gives up first.
+func newBackend(name string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(delay):
+		}
+		w.Header().Set(backendServerHeader, name)
+		fmt.Fprintf(w, "hello from %s", name)
+	}))
+}
+
+func (t *timeoutRetryTest) theLoadBalancerIsRunning() error {
+	t.reset()
+	return nil
+}
+
+func (t *timeoutRetryTest) theFollowingBackendServersAreRegistered(table *godog.Table) error {
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	var policy router.UpstreamPolicy
+
+	for i, row := range table.Rows[1:] {
+		name := row.Cells[0].Value
+		values := make([]int, 3)
+		for j := range values {
+			v, err := strconv.Atoi(row.Cells[j+1].Value)
+			if err != nil {
+				return fmt.Errorf("invalid value %q for %s: %v", row.Cells[j+1].Value, name, err)
+			}
+			values[j] = v
+		}
+
+		backend := newBackend(name, time.Duration(values[0])*time.Millisecond)
+		t.backends = append(t.backends, backend)
+
+		host, portStr, err := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		if err != nil {
+			return err
+		}
+		port, _ := strconv.Atoi(portStr)
+
+		server, err := loadbalancer.NewServerInstance(name, host, port, 10)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %v", err)
+		}
+
+		if err := lb.AddServer(server); err != nil {
+			return fmt.Errorf("failed to add server: %v", err)
+		}
+
+		if i == 0 {
+			policy.Timeouts.ResponseHeader = util.Duration(time.Duration(values[1]) * time.Millisecond)
+			policy.Retry.MaxAttempts = values[2] + 1
+		}
+	}
+
+	pool, err := loadbalancer.NewPool("default", lb)
+	if err != nil {
+		return err
+	}
+
+	pools := loadbalancer.NewPoolManager()
+	if err := pools.AddPool(pool); err != nil {
+		return err
+	}
+
+	routes := router.NewRouteTable()
+	if err := routes.AddRoute(router.Route{Name: "default", Pool: "default"}); err != nil {
+		return err
+	}
+
+	t.router = router.NewRouter(pools, routes)
+	return t.router.SetUpstreamPolicy("default", policy)
+}
+
+func (t *timeoutRetryTest) aClientSendsARequestTo(server string) error {
+	t.response = httptest.NewRecorder()
+	t.router.ServeRequest(t.response, httptest.NewRequest(http.MethodGet, "/", nil))
+	return nil
+}
+
+func (t *timeoutRetryTest) theRequestShouldSucceed() error {
+	if t.response.Code != http.StatusOK {
+		return fmt.Errorf("expected status 200 but got %d: %s", t.response.Code, t.response.Body.String())
+	}
+	return nil
+}
+
+func (t *timeoutRetryTest) theRequestShouldFailWithAError(reason string) error {
+	if t.response.Code != http.StatusGatewayTimeout {
+		return fmt.Errorf("expected status 504 but got %d", t.response.Code)
+	}
+
+	if !strings.Contains(t.response.Body.String(), reason) {
+		return fmt.Errorf("expected a %q error but got %q", reason, t.response.Body.String())
+	}
+	return nil
+}
+
+func (t *timeoutRetryTest) theRequestShouldBeRetriedOn(server string) error {
+	if got := t.response.Header().Get(backendServerHeader); got != server {
+		return fmt.Errorf("expected the request to be served by %s but got %q", server, got)
+	}
+	return nil
+}
+
+func initializeID022Scenario(ctx *godog.ScenarioContext) {
+	test := &timeoutRetryTest{}
+
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.Step(`^the load balancer is running$`, test.theLoadBalancerIsRunning)
+	ctx.Step(`^the following backend servers are registered:$`, test.theFollowingBackendServersAreRegistered)
+	ctx.Step(`^a client sends a request to "([^"]*)"$`, test.aClientSendsARequestTo)
+	ctx.Step(`^the request should succeed$`, test.theRequestShouldSucceed)
+	ctx.Step(`^the request should fail with a "([^"]*)" error$`, test.theRequestShouldFailWithAError)
+	ctx.Step(`^the request should be retried on "([^"]*)"$`, test.theRequestShouldBeRetriedOn)
+}
+
+func TestID022(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: initializeID022Scenario,
+		Options: &godog.Options{
+			Format:    "pretty",
+			Paths:     []string{"../features/ID022_Timeout_Retries.feature"},
+			Randomize: 0,
+		},
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("ID022 test failure")
+	}
+}
+
+func TestID022RetryBudget(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := newBackend("healthy", 0)
+	defer healthy.Close()
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	for i, backend := range []*httptest.Server{failing, healthy} {
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i+1), host, port, 10)
+		_ = lb.AddServer(server)
+	}
+
+	pool, _ := loadbalancer.NewPool("budget", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "budget"})
+
+	r := router.NewRouter(pools, routes)
+	err := r.SetUpstreamPolicy("budget", router.UpstreamPolicy{
+		Retry: router.RetryPolicy{
+			MaxAttempts: 2,
+			RetryOn:     []string{"503"},
+			BaseBackoff: util.Duration(time.Millisecond),
+			Budget:      router.RetryBudget{Ratio: 0.01, MinPerSecond: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retries := metrics.GetCounter(`router_retries_total{pool="budget"}`)
+	exhausted := metrics.GetCounter(`router_retry_budget_exhausted_total{pool="budget"}`)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	codes := make(map[int]int)
+	for i := 0; i < 10; i++ {
+		response := httptest.NewRecorder()
+		r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		codes[response.Code]++
+	}
+	log.SetOutput(os.Stderr)
+
+	if retries.Value() != 1 {
+		t.Fatalf("expected the budget to allow exactly 1 retry, got %d", retries.Value())
+	}
+
+	if exhausted.Value() < 2 {
+		t.Fatalf("expected every denied retry to be counted, got %d", exhausted.Value())
+	}
+
+	if lines := strings.Count(logged.String(), "retry budget for pool budget exhausted"); lines != 1 {
+		t.Fatalf("expected running out of budget to be logged once, got %d times", lines)
+	}
+
+	if codes[http.StatusServiceUnavailable] == 0 {
+		t.Fatalf("expected requests over budget to fail with the original 503, got %v", codes)
+	}
+}
+
+func TestID022Hedging(t *testing.T) {
+	slow := newBackend("server1", 500*time.Millisecond)
+	defer slow.Close()
+
+	fast := newBackend("server2", 0)
+	defer fast.Close()
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	var servers []*loadbalancer.ServerInstance
+	for i, backend := range []*httptest.Server{slow, fast} {
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i+1), host, port, 10)
+		_ = lb.AddServer(server)
+		servers = append(servers, server)
+	}
+
+	pool, _ := loadbalancer.NewPool("hedged", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "hedged"})
+
+	r := router.NewRouter(pools, routes)
+	err := r.SetUpstreamPolicy("hedged", router.UpstreamPolicy{
+		Hedge: &router.HedgePolicy{Delay: util.Duration(50 * time.Millisecond)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	response := httptest.NewRecorder()
+	r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("expected the hedge to answer before the slow server, took %v", elapsed)
+	}
+
+	if got := response.Header().Get(backendServerHeader); got != "server2" {
+		t.Fatalf("expected the hedge on server2 to win, got %q", got)
+	}
+
+	if hedges := metrics.GetCounter(`router_hedges_total{pool="hedged"}`).Value(); hedges != 1 {
+		t.Fatalf("expected 1 hedge, got %d", hedges)
+	}
+
+	if wins := metrics.GetCounter(`router_hedge_wins_total{pool="hedged"}`).Value(); wins != 1 {
+		t.Fatalf("expected 1 hedge win, got %d", wins)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for servers[0].GetConnectionAmount() != 0 || servers[1].GetConnectionAmount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected hedged connections to be released, got %d and %d", servers[0].GetConnectionAmount(), servers[1].GetConnectionAmount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// POSTs are never hedged.
+	response = httptest.NewRecorder()
+	r.ServeRequest(response, httptest.NewRequest(http.MethodPost, "/", nil))
+	if hedges := metrics.GetCounter(`router_hedges_total{pool="hedged"}`).Value(); hedges != 1 {
+		t.Fatalf("expected a POST not to be hedged, got %d hedges", hedges)
+	}
+}
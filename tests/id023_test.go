@@ -0,0 +1,367 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cucumber/godog"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+const holdHeader = "X-Hold"
+
+// poolingScenarios keeps pool names, and so their metrics, apart between
+// scenarios.
+var poolingScenarios atomic.Int64
+
+type connectionPoolingTest struct {
+	pool        string
+	backend     *httptest.Server
+	router      *router.Router
+	arrived     chan struct{}
+	mu          sync.Mutex
+	gate        chan struct{}
+	held        sync.WaitGroup
+	poolSize    int
+	maxPerHost  int
+	established int
+	inUse       int
+	response    *httptest.ResponseRecorder
+}
+
+func (t *connectionPoolingTest) reset() {
+	t.releaseHeld()
+	if t.backend != nil {
+		t.backend.Close()
+	}
+
+	t.pool = fmt.Sprintf("pooling-%d", poolingScenarios.Add(1))
+	t.backend = nil
+	t.router = nil
+	t.arrived = make(chan struct{}, 16)
+	t.poolSize = 0
+	t.maxPerHost = 0
+	t.established = 0
+	t.inUse = 0
+	t.response = nil
+}
+
+func (t *connectionPoolingTest) currentGate() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.gate
+}
+
+// releaseHeld lets every held request finish and sets up a fresh gate.
+func (t *connectionPoolingTest) releaseHeld() {
+	t.mu.Lock()
+	if t.gate != nil {
+		close(t.gate)
+	}
+	t.gate = make(chan struct{})
+	t.mu.Unlock()
+
+	t.held.Wait()
+}
+
+func (t *connectionPoolingTest) counter(name string) int64 {
+	return metrics.GetCounter(fmt.Sprintf("router_connection_pool_%s_total{pool=%q}", name, t.pool)).Value()
+}
+
+func (t *connectionPoolingTest) open() int64 {
+	return metrics.GetGauge(fmt.Sprintf("router_connection_pool_open{pool=%q}", t.pool)).Value()
+}
+
+func (t *connectionPoolingTest) setup() error {
+	arrived := t.arrived
+	t.backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(holdHeader) != "" {
+			gate := t.currentGate()
+			arrived <- struct{}{}
+			<-gate
+		}
+		fmt.Fprint(w, "ok")
+	}))
+
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(t.backend.URL, "http://"))
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, err := loadbalancer.NewServerInstance("server1", host, port, 10)
+	if err != nil {
+		return err
+	}
+	if err := lb.AddServer(server); err != nil {
+		return err
+	}
+
+	pool, err := loadbalancer.NewPool(t.pool, lb)
+	if err != nil {
+		return err
+	}
+
+	pools := loadbalancer.NewPoolManager()
+	if err := pools.AddPool(pool); err != nil {
+		return err
+	}
+
+	routes := router.NewRouteTable()
+	if err := routes.AddRoute(router.Route{Name: "default", Pool: t.pool}); err != nil {
+		return err
+	}
+
+	t.router = router.NewRouter(pools, routes)
+	return t.router.SetUpstreamPolicy(t.pool, router.UpstreamPolicy{
+		Connections: router.ConnectionPoolPolicy{
+			MaxIdlePerHost: t.poolSize,
+			MaxPerHost:     t.maxPerHost,
+		},
+	})
+}
+
+// hold sends n requests that the backend keeps open until the gate closes,
+// so each of them needs its own connection.
+func (t *connectionPoolingTest) hold(n int) error {
+	for range n {
+		t.held.Add(1)
+		go func() {
+			defer t.held.Done()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(holdHeader, "true")
+			t.router.ServeRequest(httptest.NewRecorder(), req)
+		}()
+	}
+
+	for range n {
+		select {
+		case <-t.arrived:
+		case <-time.After(2 * time.Second):
+			return fmt.Errorf("only some of the %d held requests reached the backend", n)
+		}
+	}
+	return nil
+}
+
+func (t *connectionPoolingTest) theLoadBalancerIsRunning() error {
+	t.reset()
+	return nil
+}
+
+func (t *connectionPoolingTest) theConnectionPoolSizeIs(size int) error {
+	t.poolSize = size
+	return nil
+}
+
+func (t *connectionPoolingTest) connectionsAreEstablished(n int) error {
+	t.established = n
+	return nil
+}
+
+func (t *connectionPoolingTest) connectionsAreInUse(n int) error {
+	t.inUse = n
+	return nil
+}
+
+func (t *connectionPoolingTest) theMaxConnectionsLimitIs(limit int) error {
+	t.maxPerHost = limit
+	return nil
+}
+
+func (t *connectionPoolingTest) aClientSendsARequest() error {
+	if err := t.setup(); err != nil {
+		return err
+	}
+
+	if t.established > 0 {
+		if err := t.hold(t.established); err != nil {
+			return err
+		}
+		t.releaseHeld()
+	}
+
+	if err := t.hold(t.inUse); err != nil {
+		return err
+	}
+
+	t.response = httptest.NewRecorder()
+	t.router.ServeRequest(t.response, httptest.NewRequest(http.MethodGet, "/", nil))
+	return nil
+}
+
+func (t *connectionPoolingTest) theRequestShouldUseAnExistingConnection() error {
+	if t.response.Code != http.StatusOK {
+		return fmt.Errorf("expected status 200 but got %d: %s", t.response.Code, t.response.Body.String())
+	}
+
+	if dials := t.counter("dials"); dials != int64(t.established) {
+		return fmt.Errorf("expected %d dials but got %d", t.established, dials)
+	}
+
+	if hits := t.counter("hits"); hits != 1 {
+		return fmt.Errorf("expected the request to reuse a pooled connection, got %d hits", hits)
+	}
+	return nil
+}
+
+func (t *connectionPoolingTest) theConnectionShouldBeReturnedToThePoolAfterUse() error {
+	if open := t.open(); open != int64(t.poolSize) {
+		return fmt.Errorf("expected %d open connections but got %d", t.poolSize, open)
+	}
+	return nil
+}
+
+func (t *connectionPoolingTest) aNewConnectionShouldBeCreated() error {
+	if t.response.Code != http.StatusOK {
+		return fmt.Errorf("expected status 200 but got %d: %s", t.response.Code, t.response.Body.String())
+	}
+
+	if dials := t.counter("dials"); dials != int64(t.inUse+1) {
+		return fmt.Errorf("expected %d dials but got %d", t.inUse+1, dials)
+	}
+	return nil
+}
+
+func (t *connectionPoolingTest) theConnectionShouldBeClosedAfterUse() error {
+	t.releaseHeld()
+
+	deadline := time.Now().Add(time.Second)
+	for t.open() != int64(t.poolSize) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected connections over the pool size to be closed, %d still open", t.open())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (t *connectionPoolingTest) theRequestShouldFailWithError(reason string) error {
+	if t.response.Code != http.StatusServiceUnavailable {
+		return fmt.Errorf("expected status 503 but got %d", t.response.Code)
+	}
+
+	if !strings.Contains(t.response.Body.String(), reason) {
+		return fmt.Errorf("expected a %q error but got %q", reason, t.response.Body.String())
+	}
+	return nil
+}
+
+func initializeID023Scenario(ctx *godog.ScenarioContext) {
+	test := &connectionPoolingTest{}
+
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.Step(`^the load balancer is running$`, test.theLoadBalancerIsRunning)
+	ctx.Step(`^the connection pool size is (\d+)$`, test.theConnectionPoolSizeIs)
+	ctx.Step(`^(\d+) connections are established$`, test.connectionsAreEstablished)
+	ctx.Step(`^(\d+) connections are in use$`, test.connectionsAreInUse)
+	ctx.Step(`^the max connections limit is (\d+)$`, test.theMaxConnectionsLimitIs)
+	ctx.Step(`^a client sends a request$`, test.aClientSendsARequest)
+	ctx.Step(`^the request should use an existing connection$`, test.theRequestShouldUseAnExistingConnection)
+	ctx.Step(`^the connection should be returned to the pool after use$`, test.theConnectionShouldBeReturnedToThePoolAfterUse)
+	ctx.Step(`^a new connection should be created$`, test.aNewConnectionShouldBeCreated)
+	ctx.Step(`^the connection should be closed after use$`, test.theConnectionShouldBeClosedAfterUse)
+	ctx.Step(`^the request should fail with "([^"]*)" error$`, test.theRequestShouldFailWithError)
+}
+
+func TestID023(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: initializeID023Scenario,
+		Options: &godog.Options{
+			Format:    "pretty",
+			Paths:     []string{"../features/ID023_Connection_Pooling.feature"},
+			Randomize: 0,
+		},
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("ID023 test failure")
+	}
+}
+
+func TestID023ReapplyPolicy(t *testing.T) {
+	var opened, closed atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed:
+			closed.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	server, _ := loadbalancer.NewServerInstance("server1", host, port, 10)
+	_ = lb.AddServer(server)
+
+	pool, _ := loadbalancer.NewPool("reapply", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "reapply"})
+	r := router.NewRouter(pools, routes)
+
+	policy := router.UpstreamPolicy{Retry: router.RetryPolicy{MaxAttempts: 2}}
+	request := func() {
+		t.Helper()
+		response := httptest.NewRecorder()
+		r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected 200 but got %d", response.Code)
+		}
+	}
+
+	if err := r.SetUpstreamPolicy("reapply", policy); err != nil {
+		t.Fatal(err)
+	}
+	request()
+	if err := r.SetUpstreamPolicy("reapply", policy); err != nil {
+		t.Fatal(err)
+	}
+	request()
+	if opened.Load() != 1 {
+		t.Fatalf("expected an unchanged policy to keep the pooled connection, but %d were opened", opened.Load())
+	}
+
+	policy.Retry.MaxAttempts = 3
+	if err := r.SetUpstreamPolicy("reapply", policy); err != nil {
+		t.Fatal(err)
+	}
+	request()
+	if opened.Load() != 2 {
+		t.Fatalf("expected a changed policy to start a new connection pool, but %d connections were opened", opened.Load())
+	}
+
+	_ = pools.RemovePool("reapply")
+	r.PruneUpstreams()
+	deadline := time.Now().Add(time.Second)
+	for closed.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected removing the pool to close its idle connection, but %d of 2 are closed", closed.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,253 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// newMirrorRouter routes everything to the primary pool, mirroring to the
+// shadow pool. A nil shadow leaves the shadow pool without servers.
+func newMirrorRouter(t *testing.T, route string, mirror router.MirrorPolicy, primary, shadow *httptest.Server) *httptest.Server {
+	t.Helper()
+	pools := loadbalancer.NewPoolManager()
+	for name, backend := range map[string]*httptest.Server{"primary": primary, "shadow": shadow} {
+		lb := loadbalancer.NewRoundRobinLoadBalancer()
+		if backend != nil {
+			host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+			port, _ := strconv.Atoi(portStr)
+			server, _ := loadbalancer.NewServerInstance(name, host, port, 1000)
+			_ = lb.AddServer(server)
+		}
+		pool, _ := loadbalancer.NewPool(name, lb)
+		_ = pools.AddPool(pool)
+	}
+
+	mirror.Pool = "shadow"
+	routes := router.NewRouteTable()
+	if err := routes.AddRoute(router.Route{Name: route, Pool: "primary", Mirror: &mirror}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := router.NewRouter(pools, routes)
+	proxy := httptest.NewServer(http.HandlerFunc(r.ServeRequest))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func newCountingBackend(count *atomic.Int64, status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		count.Add(1)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+}
+
+// waitForCount waits for background mirrors to land.
+func waitForCount(t *testing.T, count func() int64, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for count() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least %d but got %d", want, count())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	const requests = 1000
+	for _, percent := range []float64{0, 25, 100} {
+		t.Run(fmt.Sprint(percent), func(t *testing.T) {
+			var primaryCount, shadowCount atomic.Int64
+			primary := newCountingBackend(&primaryCount, http.StatusOK, "primary")
+			defer primary.Close()
+			shadow := newCountingBackend(&shadowCount, http.StatusOK, "shadow")
+			defer shadow.Close()
+
+			route := fmt.Sprintf("sampling-%v", percent)
+			proxy := newMirrorRouter(t, route, router.MirrorPolicy{Percent: percent, MaxConcurrent: requests}, primary, shadow)
+			for range requests {
+				resp, err := http.Get(proxy.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			sent := metrics.GetCounter(fmt.Sprintf("router_mirror_requests_total{route=%q}", route))
+			waitForCount(t, shadowCount.Load, int64(sent.Value()))
+			if primaryCount.Load() != requests {
+				t.Fatalf("expected the primary to see all %d requests but got %d", requests, primaryCount.Load())
+			}
+
+			want := float64(requests) * percent / 100
+			if got := float64(shadowCount.Load()); got < want-60 || got > want+60 {
+				t.Fatalf("expected about %.0f mirrored requests but got %.0f", want, got)
+			}
+		})
+	}
+}
+
+func TestMirrorIgnoresResponse(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Backend", "primary")
+		io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+
+	mirrored := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r
+		bodies <- string(body)
+		w.Header().Set("X-Backend", "shadow")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "shadow")
+	}))
+	defer shadow.Close()
+
+	proxy := newMirrorRouter(t, "ignore", router.MirrorPolicy{Percent: 100}, primary, shadow)
+	resp, err := http.Post(proxy.URL+"/orders?id=7", "text/plain", strings.NewReader("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "primary" || resp.Header.Get("X-Backend") != "primary" {
+		t.Fatalf("expected the primary's response but got %d %q from %s", resp.StatusCode, body, resp.Header.Get("X-Backend"))
+	}
+
+	select {
+	case req := <-mirrored:
+		if req.Method != http.MethodPost || req.URL.RequestURI() != "/orders?id=7" || req.Header.Get("X-Goobernetes-Mirror") != "true" {
+			t.Fatalf("expected a marked copy of POST /orders?id=7 but got %s %s %v", req.Method, req.URL, req.Header)
+		}
+		if got := <-bodies; got != "order" {
+			t.Fatalf("expected the mirror to get the request body but got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be mirrored")
+	}
+}
+
+func TestMirrorDoesNotAffectPrimary(t *testing.T) {
+	var primaryCount atomic.Int64
+	primary := newCountingBackend(&primaryCount, http.StatusOK, "primary")
+	defer primary.Close()
+
+	release := make(chan struct{})
+	var shadowCount atomic.Int64
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shadowCount.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	cases := []struct {
+		name   string
+		shadow *httptest.Server
+	}{
+		{"slow shadow", shadow},
+		{"shadow without servers", nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			route := "affect-" + strings.ReplaceAll(tc.name, " ", "-")
+			policy := router.MirrorPolicy{Percent: 100, Timeout: util.Duration(200 * time.Millisecond)}
+			proxy := newMirrorRouter(t, route, policy, primary, tc.shadow)
+			failures := metrics.GetCounter(fmt.Sprintf("router_mirror_errors_total{route=%q}", route))
+			before := failures.Value()
+
+			for range 5 {
+				start := time.Now()
+				resp, err := http.Get(proxy.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK || string(body) != "primary" {
+					t.Fatalf("expected the primary's 200 but got %d %q", resp.StatusCode, body)
+				}
+				if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+					t.Fatalf("expected the mirror not to delay the primary but it took %v", elapsed)
+				}
+			}
+
+			// Mirrors that time out or find no server are counted as errors
+			// and nothing else.
+			waitForCount(t, func() int64 { return int64(failures.Value() - before) }, 5)
+		})
+	}
+
+	if shadowCount.Load() != 5 {
+		t.Fatalf("expected the slow shadow to get 5 requests but got %d", shadowCount.Load())
+	}
+}
+
+func TestMirrorRewritesHeadersLikePrimary(t *testing.T) {
+	seen := make(chan http.Header, 2)
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		seen <- r.Header.Clone()
+	})
+	primary := httptest.NewServer(record)
+	defer primary.Close()
+	shadow := httptest.NewServer(record)
+	defer shadow.Close()
+
+	proxy := newMirrorRouter(t, "rewrite", router.MirrorPolicy{Percent: 100}, primary, shadow)
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "secret")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var headers []http.Header
+	for range 2 {
+		select {
+		case header := <-seen:
+			headers = append(headers, header)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected both the primary and the mirror to get the request")
+		}
+	}
+
+	for _, header := range headers {
+		if header.Get("X-Hop") != "" || header.Get("Proxy-Authorization") != "" {
+			t.Fatalf("expected hop-by-hop headers to be stripped but got %v", header)
+		}
+		if got := header.Get("X-Forwarded-For"); got != "203.0.113.7, 127.0.0.1" {
+			t.Fatalf("expected the client to be appended to X-Forwarded-For but got %q", got)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cucumber/godog"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// outlierScenarios keeps pool names, and so their metrics, apart between
+// scenarios.
+var outlierScenarios atomic.Int64
+
+// outlierBackend is a gRPC echo backend whose answer can be changed while it
+// runs.
+type outlierBackend struct {
+	server    *httptest.Server
+	instance  *loadbalancer.ServerInstance
+	failEvery atomic.Int64 // fail every nth call, 0 to always succeed
+	calls     atomic.Int64
+	unhealthy atomic.Bool // fails active health checks
+}
+
+func newOutlierBackend(name string) *outlierBackend {
+	b := &outlierBackend{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(backendServerHeader, name)
+		msg, err := util.ReadGRPCFrame(r.Body, 1024)
+		if err != nil {
+			util.WriteGRPCError(w, util.GRPCInternal, err.Error())
+			return
+		}
+
+		if every := b.failEvery.Load(); every > 0 && b.calls.Add(1)%every == 0 {
+			util.WriteGRPCError(w, util.GRPCUnavailable, "unavailable for testing")
+			return
+		}
+
+		w.Header().Set("Content-Type", util.GRPCContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		util.WriteGRPCFrame(w, msg)
+		w.Header().Set("Grpc-Status", strconv.Itoa(util.GRPCOK))
+	})
+	b.server = httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	return b
+}
+
+type outlierTest struct {
+	lb       loadbalancer.LoadBalancer
+	pool     *loadbalancer.Pool
+	pools    *loadbalancer.PoolManager
+	router   *router.Router
+	proxy    *httptest.Server
+	backends map[string]*outlierBackend
+	reached  map[string]int
+	// calls that didn't succeed, which reached no backend
+	unavailable int
+}
+
+func (t *outlierTest) reset() {
+	if t.proxy != nil {
+		t.proxy.Close()
+	}
+	if t.pools != nil && t.pool != nil {
+		t.pools.RemovePool(t.pool.Name)
+	}
+	for _, backend := range t.backends {
+		backend.server.Close()
+	}
+
+	t.lb = loadbalancer.NewRoundRobinLoadBalancer()
+	t.pool, _ = loadbalancer.NewPool(fmt.Sprintf("outliers-%d", outlierScenarios.Add(1)), t.lb)
+	t.pools = loadbalancer.NewPoolManager()
+	t.proxy = nil
+	t.backends = make(map[string]*outlierBackend)
+	t.reached = make(map[string]int)
+}
+
+func (t *outlierTest) outlierDetectionEjectsAfter(failures int, ejection string) error {
+	duration, err := time.ParseDuration(ejection)
+	if err != nil {
+		return err
+	}
+
+	outliers, err := loadbalancer.NewOutlierDetector(t.pool, loadbalancer.OutlierConfig{
+		ConsecutiveFailures: failures,
+		BaseEjectionTime:    duration,
+		MaxEjectionTime:     10 * duration,
+	})
+	if err != nil {
+		return err
+	}
+	t.pool.SetOutlierDetector(outliers)
+	return nil
+}
+
+func (t *outlierTest) theFollowingGRPCBackendsAreRunning(table *godog.Table) error {
+	for _, row := range table.Rows[1:] {
+		id := row.Cells[0].Value
+		backend := newOutlierBackend(id)
+		host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.server.URL, "http://"))
+		port, _ := strconv.Atoi(portStr)
+
+		server, err := loadbalancer.NewServerInstance(id, host, port, 10)
+		if err != nil {
+			return err
+		}
+		server.SetMultiplexed(true)
+		if err := t.lb.AddServer(server); err != nil {
+			return err
+		}
+		backend.instance = server
+		t.backends[id] = backend
+	}
+
+	if err := t.pools.AddPool(t.pool); err != nil {
+		return err
+	}
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: t.pool.Name})
+
+	t.router = router.NewRouter(t.pools, routes)
+	if err := t.router.SetUpstreamPolicy(t.pool.Name, router.UpstreamPolicy{Protocol: router.ProtocolH2C}); err != nil {
+		return err
+	}
+	t.proxy = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(t.router.ServeRequest), &http2.Server{}))
+	return nil
+}
+
+func (t *outlierTest) unavailableCallsAreRetriedOnAnotherBackend() error {
+	return t.router.SetUpstreamPolicy(t.pool.Name, router.UpstreamPolicy{
+		Protocol: router.ProtocolH2C,
+		Retry: router.RetryPolicy{
+			MaxAttempts: 2,
+			RetryOn:     []string{"unavailable"},
+			Budget:      router.RetryBudget{Ratio: 1, MinPerSecond: 100},
+		},
+	})
+}
+
+func (t *outlierTest) stopsAcceptingConnections(id string) error {
+	t.backends[id].server.Close()
+	return nil
+}
+
+// activeHealthChecksRunEvery checks the backends through a probe that only
+// looks at their unhealthy flag, so the checks don't count as calls.
+func (t *outlierTest) activeHealthChecksRunEvery(interval string) error {
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return err
+	}
+
+	health, err := loadbalancer.NewHealthChecker(t.pool, loadbalancer.HealthCheckConfig{Interval: duration, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	backends := t.backends
+	health.SetProbe(func(ctx context.Context, server loadbalancer.Server) error {
+		if backends[loadbalancer.InstanceOf(server).ID].unhealthy.Load() {
+			return fmt.Errorf("unhealthy for testing")
+		}
+		return nil
+	})
+	t.pool.SetHealthChecker(health)
+	return nil
+}
+
+func (t *outlierTest) startsFailingHealthChecks(id string) error {
+	t.backends[id].unhealthy.Store(true)
+	return nil
+}
+
+func (t *outlierTest) shouldBeMarkedUnhealthyWithin(id string, wait string) error {
+	duration, err := time.ParseDuration(wait)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(duration)
+	for t.backends[id].instance.IsActive() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected %s to be marked unhealthy within %v", id, duration)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func (t *outlierTest) shouldStillBeHealthy(id string) error {
+	if !t.backends[id].instance.IsActive() {
+		return fmt.Errorf("expected ejecting %s to leave its health status alone", id)
+	}
+	return nil
+}
+
+func (t *outlierTest) thePanicThresholdIs(threshold float64) error {
+	return t.lb.SetPanicThreshold(threshold)
+}
+
+func (t *outlierTest) answersEveryCallWithUnavailable(id string) error {
+	t.backends[id].failEvery.Store(1)
+	return nil
+}
+
+func (t *outlierTest) failsEveryOtherCallWithUnavailable(id string) error {
+	t.backends[id].failEvery.Store(2)
+	return nil
+}
+
+func (t *outlierTest) recovers(id string) error {
+	t.backends[id].failEvery.Store(0)
+	return nil
+}
+
+func (t *outlierTest) aClientMakesGRPCCalls(calls int) error {
+	t.reached = make(map[string]int)
+	t.unavailable = 0
+	for range calls {
+		var frame bytes.Buffer
+		util.WriteGRPCFrame(&frame, []byte("ping"))
+
+		req, _ := http.NewRequest(http.MethodPost, t.proxy.URL+"/test.Echo/Echo", &frame)
+		req.Header.Set("Content-Type", util.GRPCContentType)
+		req.Header.Set("Te", "trailers")
+
+		resp, err := newH2CClient().Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if code, _ := util.GRPCStatus(resp.Header, resp.Trailer); code != util.GRPCOK {
+			t.unavailable++
+			continue
+		}
+		t.reached[resp.Header.Get(backendServerHeader)]++
+	}
+	return nil
+}
+
+func (t *outlierTest) moreGRPCCallsShouldOnlyReach(calls int, table *godog.Table) error {
+	if err := t.aClientMakesGRPCCalls(calls); err != nil {
+		return err
+	}
+
+	expected := make(map[string]bool)
+	for _, row := range table.Rows[1:] {
+		expected[row.Cells[0].Value] = true
+	}
+	for id, count := range t.reached {
+		if !expected[id] {
+			return fmt.Errorf("expected no calls on %q but it got %d", id, count)
+		}
+	}
+	for id := range expected {
+		if t.reached[id] == 0 {
+			return fmt.Errorf("expected calls on %s but it got none (reached %v)", id, t.reached)
+		}
+	}
+	return nil
+}
+
+func (t *outlierTest) everyCallShouldHaveSucceeded() error {
+	if t.unavailable > 0 {
+		return fmt.Errorf("expected every call to succeed but %d failed", t.unavailable)
+	}
+	return nil
+}
+
+func (t *outlierTest) shouldBeEjected(id string) error {
+	if !t.backends[id].instance.IsEjected() {
+		return fmt.Errorf("expected %s to be ejected", id)
+	}
+	return nil
+}
+
+func (t *outlierTest) shouldNotBeEjected(id string) error {
+	if t.backends[id].instance.IsEjected() {
+		return fmt.Errorf("expected %s not to be ejected", id)
+	}
+	return nil
+}
+
+func (t *outlierTest) shouldStillBeEjectedAfter(id string, wait string) error {
+	duration, err := time.ParseDuration(wait)
+	if err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	return t.shouldBeEjected(id)
+}
+
+func (t *outlierTest) shouldBeLetBackInWithin(id string, wait string) error {
+	duration, err := time.ParseDuration(wait)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(duration)
+	for t.backends[id].instance.IsEjected() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("expected %s to be let back in within %v", id, duration)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func initializeOutlierScenario(ctx *godog.ScenarioContext) {
+	test := &outlierTest{}
+
+	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.Step(`^outlier detection ejects after (\d+) consecutive failures for (\w+)$`, test.outlierDetectionEjectsAfter)
+	ctx.Step(`^the following gRPC backends are running:$`, test.theFollowingGRPCBackendsAreRunning)
+	ctx.Step(`^the panic threshold is ([\d.]+)$`, test.thePanicThresholdIs)
+	ctx.Step(`^active health checks run every (\w+)$`, test.activeHealthChecksRunEvery)
+	ctx.Step(`^"([^"]*)" starts failing health checks$`, test.startsFailingHealthChecks)
+	ctx.Step(`^"([^"]*)" should be marked unhealthy within (\w+)$`, test.shouldBeMarkedUnhealthyWithin)
+	ctx.Step(`^"([^"]*)" should still be healthy$`, test.shouldStillBeHealthy)
+	ctx.Step(`^"([^"]*)" answers every call with UNAVAILABLE$`, test.answersEveryCallWithUnavailable)
+	ctx.Step(`^"([^"]*)" fails every other call with UNAVAILABLE$`, test.failsEveryOtherCallWithUnavailable)
+	ctx.Step(`^"([^"]*)" recovers$`, test.recovers)
+	ctx.Step(`^calls that fail with UNAVAILABLE are retried on another backend$`, test.unavailableCallsAreRetriedOnAnotherBackend)
+	ctx.Step(`^"([^"]*)" stops accepting connections$`, test.stopsAcceptingConnections)
+	ctx.Step(`^every call should have succeeded$`, test.everyCallShouldHaveSucceeded)
+	ctx.Step(`^a client makes (\d+) gRPC calls$`, test.aClientMakesGRPCCalls)
+	ctx.Step(`^(\d+) more gRPC calls should only reach:$`, test.moreGRPCCallsShouldOnlyReach)
+	ctx.Step(`^"([^"]*)" should be ejected$`, test.shouldBeEjected)
+	ctx.Step(`^"([^"]*)" should not be ejected$`, test.shouldNotBeEjected)
+	ctx.Step(`^"([^"]*)" should still be ejected after (\w+)$`, test.shouldStillBeEjectedAfter)
+	ctx.Step(`^"([^"]*)" should be let back in within (\w+)$`, test.shouldBeLetBackInWithin)
+}
+
+func TestOutlierDetection(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: initializeOutlierScenario,
+		Options: &godog.Options{
+			Format:    "pretty",
+			Paths:     []string{"../features/Outlier_Detection.feature"},
+			Randomize: 0,
+		},
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("outlier detection test failure")
+	}
+}
@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/cucumber/godog"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+)
+
+type panicModeTest struct {
+	lb        loadbalancer.LoadBalancer
+	reached   map[string]int
+	lastError error
+}
+
+func (t *panicModeTest) reset() {
+	t.lb = loadbalancer.NewRoundRobinLoadBalancer()
+	t.reached = make(map[string]int)
+	t.lastError = nil
+}
+
+func (t *panicModeTest) theLoadBalancerIsRunning() error {
+	t.reset()
+	return nil
+}
+
+func (t *panicModeTest) theFollowingBackendServersAreConfigured(table *godog.Table) error {
+	for _, row := range table.Rows[1:] {
+		port, _ := strconv.Atoi(row.Cells[2].Value)
+		maxConn, _ := strconv.Atoi(row.Cells[3].Value)
+
+		server, err := loadbalancer.NewServerInstance(row.Cells[0].Value, row.Cells[1].Value, port, maxConn)
+		if err != nil {
+			return fmt.Errorf("failed to create server: %v", err)
+		}
+
+		if err := t.lb.AddServer(server); err != nil {
+			return fmt.Errorf("failed to add server: %v", err)
+		}
+	}
+	return nil
+}
+
+func (t *panicModeTest) thePanicThresholdIs(threshold float64) error {
+	return t.lb.SetPanicThreshold(threshold)
+}
+
+func (t *panicModeTest) thePanicThresholdIsSetTo(threshold float64) error {
+	t.lastError = t.lb.SetPanicThreshold(threshold)
+	return nil
+}
+
+func (t *panicModeTest) serverBecomesUnavailable(serverID string) error {
+	return t.lb.SetServerStatus(serverID, false)
+}
+
+func (t *panicModeTest) serverBecomesAvailable(serverID string) error {
+	return t.lb.SetServerStatus(serverID, true)
+}
+
+func (t *panicModeTest) aClientMakesConsecutiveRequests(requestCount int) error {
+	t.reached = make(map[string]int)
+	for range requestCount {
+		server, err := t.lb.NextServer(context.Background())
+		if err != nil {
+			return err
+		}
+		t.reached[loadbalancer.InstanceOf(server).ID]++
+		server.ReleaseConnection()
+	}
+	return nil
+}
+
+func (t *panicModeTest) theRequestsShouldOnlyReach(table *godog.Table) error {
+	expected := make(map[string]bool)
+	for _, row := range table.Rows[1:] {
+		expected[row.Cells[0].Value] = true
+	}
+
+	for id := range t.reached {
+		if !expected[id] {
+			return fmt.Errorf("expected no requests on %s but it got %d", id, t.reached[id])
+		}
+	}
+	for id := range expected {
+		if t.reached[id] == 0 {
+			return fmt.Errorf("expected requests on %s but it got none (reached %v)", id, t.reached)
+		}
+	}
+	return nil
+}
+
+func (t *panicModeTest) theLoadBalancerShouldBeInPanicMode() error {
+	if !t.lb.InPanicMode() {
+		return fmt.Errorf("expected the load balancer to be in panic mode")
+	}
+	return nil
+}
+
+func (t *panicModeTest) theLoadBalancerShouldNotBeInPanicMode() error {
+	if t.lb.InPanicMode() {
+		return fmt.Errorf("expected the load balancer not to be in panic mode")
+	}
+	return nil
+}
+
+func (t *panicModeTest) iShouldReceiveAPanicThresholdError() error {
+	if !errors.Is(t.lastError, loadbalancer.ErrInvalidPanicThreshold) {
+		return fmt.Errorf("expected ErrInvalidPanicThreshold but got %v", t.lastError)
+	}
+	return nil
+}
+
+func initializePanicModeScenario(ctx *godog.ScenarioContext) {
+	test := &panicModeTest{}
+
+	ctx.Before(func(ctx context.Context, sc *godog.Scenario) (context.Context, error) {
+		test.reset()
+		return ctx, nil
+	})
+
+	ctx.Step(`^the load balancer is running$`, test.theLoadBalancerIsRunning)
+	ctx.Step(`^the following backend servers are configured:$`, test.theFollowingBackendServersAreConfigured)
+	ctx.Step(`^the panic threshold is ([\d.]+)$`, test.thePanicThresholdIs)
+	ctx.Step(`^the panic threshold is set to ([\d.]+)$`, test.thePanicThresholdIsSetTo)
+	ctx.Step(`^"([^"]*)" becomes unavailable$`, test.serverBecomesUnavailable)
+	ctx.Step(`^"([^"]*)" becomes available$`, test.serverBecomesAvailable)
+	ctx.Step(`^a client makes (\d+) consecutive requests$`, test.aClientMakesConsecutiveRequests)
+	ctx.Step(`^the requests should only reach:$`, test.theRequestsShouldOnlyReach)
+	ctx.Step(`^the load balancer should be in panic mode$`, test.theLoadBalancerShouldBeInPanicMode)
+	ctx.Step(`^the load balancer should not be in panic mode$`, test.theLoadBalancerShouldNotBeInPanicMode)
+	ctx.Step(`^I should receive a panic threshold error$`, test.iShouldReceiveAPanicThresholdError)
+}
+
+func TestPanicMode(t *testing.T) {
+	suite := godog.TestSuite{
+		ScenarioInitializer: initializePanicModeScenario,
+		Options: &godog.Options{
+			Format:    "pretty",
+			Paths:     []string{"../features/Panic_Mode.feature"},
+			Randomize: 0,
+		},
+	}
+
+	if suite.Run() != 0 {
+		t.Fatal("panic mode test failure")
+	}
+}
+
+func TestPanicModeMetricsNameThePool(t *testing.T) {
+	sticky, err := loadbalancer.NewStickySessionLoadBalancer(loadbalancer.NewRoundRobinLoadBalancer(), loadbalancer.StickySessionConfig{Secret: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, lb := range map[string]loadbalancer.LoadBalancer{
+		"panic-plain":  loadbalancer.NewRoundRobinLoadBalancer(),
+		"panic-sticky": sticky,
+	} {
+		pool, err := loadbalancer.NewPool(name, lb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 2; i++ {
+			server, _ := loadbalancer.NewServerInstance(fmt.Sprintf("server%d", i), "192.168.1.10", 8080+i, 10)
+			_ = pool.AddServer(server)
+		}
+		_ = pool.SetPanicThreshold(0.6)
+
+		entered := metrics.GetCounter(fmt.Sprintf("loadbalancer_panic_mode_entered_total{pool=%q}", name))
+		exited := metrics.GetCounter(fmt.Sprintf("loadbalancer_panic_mode_exited_total{pool=%q}", name))
+		before := entered.Value()
+
+		_ = pool.SetServerStatus("server1", false)
+		if server, err := pool.NextServer(context.Background()); err == nil {
+			server.ReleaseConnection()
+		}
+		if entered.Value() != before+1 {
+			t.Fatalf("%s: expected entering panic mode to be counted for the pool", name)
+		}
+
+		before = exited.Value()
+		_ = pool.SetServerStatus("server1", true)
+		if server, err := pool.NextServer(context.Background()); err == nil {
+			server.ReleaseConnection()
+		}
+		if exited.Value() != before+1 {
+			t.Fatalf("%s: expected leaving panic mode to be counted for the pool", name)
+		}
+	}
+}
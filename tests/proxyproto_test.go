@@ -0,0 +1,512 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		version string
+		source  net.Addr
+		want    string
+	}{
+		{util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, "203.0.113.7:51234"},
+		{util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}, "[2001:db8::7]:443"},
+		{util.ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, "203.0.113.7:51234"},
+		{util.ProxyProtocolV2, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}, "[2001:db8::7]:443"},
+		{util.ProxyProtocolV2, &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 53}, "203.0.113.7:53"},
+		{util.ProxyProtocolV1, nil, ""},
+		{util.ProxyProtocolV2, nil, ""},
+	} {
+		destination := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+		header, err := util.ProxyHeader(c.version, c.source, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("payload")))
+		addr, err := util.ReadProxyHeader(reader)
+		if err != nil {
+			t.Fatalf("%s from %v: %v", c.version, c.source, err)
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.want {
+			t.Errorf("%s: expected source %q but got %q", c.version, c.want, got)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "payload" {
+			t.Errorf("%s: expected the payload after the header to be left, got %q", c.version, rest)
+		}
+	}
+
+	reader := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	if addr, err := util.ReadProxyHeader(reader); addr != nil || err != nil {
+		t.Fatalf("expected no header in a plain request, got %v, %v", addr, err)
+	}
+	if rest, _ := io.ReadAll(reader); string(rest) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Fatalf("expected a plain request to be left alone, got %q", rest)
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 not-an-ip 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 2001:db8::7 192.0.2.1 1 2\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 1 2" + strings.Repeat(" ", 100) + "\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x31\x11\x00\x00",
+	} {
+		if _, err := util.ReadProxyHeader(bufio.NewReader(strings.NewReader(bad))); !errors.Is(err, util.ErrInvalidProxyHeader) {
+			t.Errorf("expected %q to be rejected, got %v", bad, err)
+		}
+	}
+}
+
+// startProxyProtocolListener serves HTTP through a router to a backend that
+// echoes the X-Forwarded-For it was sent, which starts with the listener's
+// view of the client's address.
+func startProxyProtocolListener(t *testing.T, trusted []string) string {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-For", r.Header.Get("X-Forwarded-For"))
+	}))
+	t.Cleanup(backend.Close)
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	server, _ := loadbalancer.NewServerInstance("server1", host, port, 10)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+	pool, _ := loadbalancer.NewPool("default", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "default"})
+	r := router.NewRouter(pools, routes)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{
+		ProxyProtocol: &servlets.ProxyProtocolConfig{TrustedCIDRs: trusted},
+	})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// rawRequest sends prefix followed by a GET over a fresh connection.
+func rawRequest(t *testing.T, addr string, prefix []byte) *http.Response {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	conn.Write(prefix)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: lb\r\nConnection: close\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	addr := startProxyProtocolListener(t, []string{"127.0.0.1/32"})
+	destination := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+
+	for _, version := range []string{util.ProxyProtocolV1, util.ProxyProtocolV2} {
+		header, _ := util.ProxyHeader(version, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, destination)
+		resp := rawRequest(t, addr, header)
+		if got := resp.Header.Get("X-Seen-For"); !strings.HasPrefix(got, "203.0.113.7:51234") {
+			t.Errorf("%s: expected the client address from the header but the backend saw %q", version, got)
+		}
+	}
+
+	if got := rawRequest(t, addr, nil).Header.Get("X-Seen-For"); !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("expected a trusted peer without a header to be served as itself, got %q", got)
+	}
+
+	untrusted := startProxyProtocolListener(t, []string{"10.0.0.0/8"})
+	header, _ := util.ProxyHeader(util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1}, destination)
+	if resp := rawRequest(t, untrusted, header); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a header from an untrusted peer not to be parsed, got status %d", resp.StatusCode)
+	}
+}
+
+func TestProxyProtocolListenerDropsBadHeaders(t *testing.T) {
+	addr := startProxyProtocolListener(t, []string{"127.0.0.1/32"})
+
+	for _, bad := range []string{"PROXY TCP4 not-an-address\r\n", "PROXY UNKNOWN-PROTOCOL\r\n"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		io.WriteString(conn, bad)
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected the connection with header %q to be dropped", bad)
+		}
+		conn.Close()
+	}
+
+	header, _ := util.ProxyHeader(util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443})
+	if got := rawRequest(t, addr, header).Header.Get("X-Seen-For"); !strings.HasPrefix(got, "203.0.113.7:51234") {
+		t.Fatalf("expected the listener to keep serving after bad headers, the backend saw %q", got)
+	}
+}
+
+// headerListener reads a PROXY header off every accepted connection and
+// reports the address in it, "none" for a header without one and "missing"
+// when there is no header at all.
+type headerListener struct {
+	net.Listener
+	seen chan string
+}
+
+func (l *headerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	start, _ := reader.Peek(5)
+	header := string(start) == "PROXY" || string(start) == "\r\n\r\n\x00"
+	addr, err := util.ReadProxyHeader(reader)
+	switch {
+	case err != nil:
+		l.seen <- "error: " + err.Error()
+	case !header:
+		l.seen <- "missing"
+	case addr == nil:
+		l.seen <- "none"
+	default:
+		l.seen <- addr.String()
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func TestProxyProtocolToUpstream(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &headerListener{Listener: inner, seen: make(chan string, 10)}
+	backend := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}}
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", inner.Addr().(*net.TCPAddr).Port, 10)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+	pool, _ := loadbalancer.NewPool("proxied", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "proxied"})
+	r := router.NewRouter(pools, routes)
+
+	if err := r.SetUpstreamPolicy("proxied", router.UpstreamPolicy{ProxyProtocol: util.ProxyProtocolV2, Protocol: router.ProtocolH2C}); err == nil {
+		t.Fatal("expected proxy_protocol on a multiplexed pool to be rejected")
+	}
+	if err := r.SetUpstreamPolicy("proxied", router.UpstreamPolicy{ProxyProtocol: "v3"}); err == nil {
+		t.Fatal("expected an unknown proxy_protocol version to be rejected")
+	}
+	if err := r.SetUpstreamPolicy("proxied", router.UpstreamPolicy{ProxyProtocol: util.ProxyProtocolV1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []string{"198.51.100.1:1111", "198.51.100.2:2222"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = client
+		response := httptest.NewRecorder()
+		r.ServeRequest(response, req)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected status 200 but got %d: %s", response.Code, response.Body.String())
+		}
+
+		select {
+		case seen := <-listener.seen:
+			if seen != client {
+				t.Fatalf("expected each client to get its own connection announced as %s, got %s", client, seen)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected a new connection for each client")
+		}
+	}
+
+	health, err := loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{
+		Interval:      time.Second,
+		Timeout:       time.Second,
+		ProxyProtocol: util.ProxyProtocolV1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	health.CheckAll()
+	if seen := <-listener.seen; seen != "none" {
+		t.Fatalf("expected health checks to announce no client, got %s", seen)
+	}
+	if !server.Status().Active {
+		t.Fatal("expected the health check to pass")
+	}
+}
+
+func TestProxyProtocolTCP(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr, err := util.ReadProxyHeader(bufio.NewReader(conn))
+				if err != nil || addr == nil {
+					fmt.Fprintf(conn, "no header: %v", err)
+					return
+				}
+				io.WriteString(conn, addr.String())
+			}()
+		}
+	}()
+
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", backend.Addr().(*net.TCPAddr).Port, 10)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+	pool, _ := loadbalancer.NewPool("tcp-proxied", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+	r := router.NewRouter(pools, router.NewRouteTable())
+	if err := r.SetUpstreamPolicy("tcp-proxied", router.UpstreamPolicy{ProxyProtocol: util.ProxyProtocolV2}); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewTcpServer(pools, r, servlets.TcpListenerConfig{
+		Port:          port,
+		Pool:          "tcp-proxied",
+		ProxyProtocol: &servlets.ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.1"}},
+	})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for conn == nil {
+		if conn, err = net.Dial("tcp", addr); err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	header, _ := util.ProxyHeader(util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5432})
+	conn.Write(header)
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "203.0.113.9:40000" {
+		t.Fatalf("expected the client address to be passed on to the backend, got %q", reply)
+	}
+}
+
+func TestProxyProtocolTCPHalfClose(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	// The backend finishes sending first, then keeps reading until the
+	// client is done too.
+	received := make(chan string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello")
+		conn.(*net.TCPConn).CloseWrite()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", backend.Addr().(*net.TCPAddr).Port, 10)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+	pool, _ := loadbalancer.NewPool("tcp-proxied-half-close", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewTcpServer(pools, nil, servlets.TcpListenerConfig{
+		Port:          port,
+		Pool:          "tcp-proxied-half-close",
+		ProxyProtocol: &servlets.ProxyProtocolConfig{TrustedCIDRs: []string{"127.0.0.1"}},
+	})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+	for conn == nil {
+		if conn, err = net.Dial("tcp", addr); err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	header, _ := util.ProxyHeader(util.ProxyProtocolV1, &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5432})
+	conn.Write(header)
+	if greeting, _ := io.ReadAll(conn); string(greeting) != "hello" {
+		t.Fatalf("expected the backend's greeting before EOF, got %q", greeting)
+	}
+
+	io.WriteString(conn, "ping")
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case data := <-received:
+		if data != "ping" {
+			t.Fatalf("expected the backend to still get the client's data after half-closing, got %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the backend")
+	}
+}
+
+func TestProxyProtocolGRPCHealthChecks(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _, _ := ca.issue(t, "backend.internal", x509.ExtKeyUsageServerAuth)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", util.GRPCContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		util.WriteGRPCFrame(w, util.EncodeHealthCheckResponse(util.HealthServing))
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	for _, secure := range []bool{false, true} {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := &headerListener{Listener: inner, seen: make(chan string, 10)}
+
+		config := loadbalancer.HealthCheckConfig{
+			GRPC:          true,
+			Interval:      time.Second,
+			Timeout:       time.Second,
+			ProxyProtocol: util.ProxyProtocolV2,
+		}
+		backend := &httptest.Server{Listener: listener, Config: &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}}
+		if secure {
+			backend.Config.Handler = handler
+			backend.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			backend.EnableHTTP2 = true
+			backend.StartTLS()
+			config.TLS = &tls.Config{RootCAs: ca.pool(), ServerName: "backend.internal"}
+		} else {
+			backend.Start()
+		}
+		t.Cleanup(backend.Close)
+
+		server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", inner.Addr().(*net.TCPAddr).Port, 10)
+		lb := loadbalancer.NewRoundRobinLoadBalancer()
+		_ = lb.AddServer(server)
+		lb.SetServerStatus(server.ID, false)
+
+		health, err := loadbalancer.NewHealthChecker(lb, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		health.CheckAll()
+
+		select {
+		case seen := <-listener.seen:
+			if seen != "none" {
+				t.Fatalf("tls %v: expected gRPC health checks to announce no client, got %s", secure, seen)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tls %v: expected the gRPC health check to connect", secure)
+		}
+		if !server.Status().Active {
+			t.Fatalf("tls %v: expected the gRPC health check to pass", secure)
+		}
+	}
+}
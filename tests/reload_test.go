@@ -0,0 +1,309 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	lbconfig "github.com/raydatray/goobernetes/pkg/config"
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+const reloadBaseConfig = `{
+	"pools": [
+		{
+			"name": "web",
+			"strategy": "weighted_round_robin",
+			"max_conns": 10,
+			"servers": [
+				{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 1},
+				{"id": "server2", "host": "127.0.0.1", "port": 8082, "weight": 1}
+			]
+		},
+		{
+			"name": "api",
+			"servers": [{"id": "server1", "host": "127.0.0.1", "port": 9081, "max_conns": 5}]
+		}
+	]
+}`
+
+func parseConfig(t *testing.T, data string) *lbconfig.Config {
+	t.Helper()
+	var cfg lbconfig.Config
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := range cfg.Pools {
+		if cfg.Pools[i].Strategy == "" {
+			cfg.Pools[i].Strategy = lbconfig.StrategyRoundRobin
+		}
+	}
+	return &cfg
+}
+
+func serverIDs(pool *loadbalancer.Pool) map[string]*loadbalancer.ServerInstance {
+	ids := make(map[string]*loadbalancer.ServerInstance)
+	for _, server := range pool.GetServers() {
+		instance := loadbalancer.InstanceOf(server)
+		ids[instance.ID] = instance
+	}
+	return ids
+}
+
+func TestReloadReconcilesPools(t *testing.T) {
+	pools, err := parseConfig(t, reloadBaseConfig).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, _ := pools.GetPool("web")
+	server1 := serverIDs(web)["server1"]
+	if !server1.AcquireConnection() {
+		t.Fatal("expected to acquire a connection")
+	}
+
+	err = parseConfig(t, `{
+		"pools": [
+			{
+				"name": "web",
+				"strategy": "weighted_round_robin",
+				"max_conns": 20,
+				"servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4},
+					{"id": "server3", "host": "127.0.0.1", "port": 8083, "weight": 1}
+				]
+			},
+			{
+				"name": "static",
+				"servers": [{"id": "server1", "host": "127.0.0.1", "port": 7081, "max_conns": 5}]
+			}
+		]
+	}`).Apply(pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := serverIDs(web)
+	if servers["server1"] != server1 {
+		t.Fatal("expected server1 to be updated in place")
+	}
+	if _, ok := servers["server2"]; ok || servers["server3"] == nil {
+		t.Fatalf("expected server2 to be replaced by server3 but got %v", servers)
+	}
+	if status := server1.Status(); status.Connections != 1 || status.MaxConns != 20 {
+		t.Fatalf("expected server1 to keep its connection with max_conns 20 but got %+v", status)
+	}
+	if weight := web.GetServers()[0].(*loadbalancer.WeightedServerInstance).GetWeight(); weight != 4 {
+		t.Fatalf("expected server1 to have weight 4 but got %d", weight)
+	}
+
+	if _, err := pools.GetPool("api"); !errors.Is(err, loadbalancer.ErrPoolNotFound) {
+		t.Fatalf("expected the api pool to be removed but got %v", err)
+	}
+	if _, err := pools.GetPool("static"); err != nil {
+		t.Fatalf("expected the static pool to be added but got %v", err)
+	}
+}
+
+func TestReloadRejectsBadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    error
+	}{
+		{
+			name: "invalid server after a valid change",
+			config: `{"pools": [
+				{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4},
+					{"id": "server2", "host": "127.0.0.1", "port": 8082, "weight": 0}
+				]},
+				{"name": "api", "servers": [{"id": "server1", "host": "127.0.0.1", "port": 9081, "max_conns": 5}]}
+			]}`,
+			err: loadbalancer.ErrInvalidWeight,
+		},
+		{
+			name: "invalid later pool",
+			config: `{"pools": [
+				{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]},
+				{"name": "api", "panic_threshold": 2, "servers": [{"id": "server1", "host": "127.0.0.1", "port": 9081, "max_conns": 5}]}
+			]}`,
+			err: loadbalancer.ErrInvalidPanicThreshold,
+		},
+		{
+			name: "duplicate server",
+			config: `{"pools": [
+				{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4},
+					{"id": "server1", "host": "127.0.0.1", "port": 8083, "weight": 4}
+				]}
+			]}`,
+			err: loadbalancer.ErrServerAlreadyExists,
+		},
+		{
+			name: "strategy change",
+			config: `{"pools": [
+				{"name": "web", "max_conns": 20, "servers": [{"id": "server1", "host": "127.0.0.1", "port": 8081}]}
+			]}`,
+			err: lbconfig.ErrStrategyChanged,
+		},
+		{
+			name: "route to an unknown pool",
+			config: `{
+				"pools": [{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]}],
+				"routes": [{"name": "api", "pool": "api"}]
+			}`,
+			err: loadbalancer.ErrPoolNotFound,
+		},
+		{
+			name: "invalid upstream policy",
+			config: `{"pools": [
+				{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]},
+				{"name": "api", "upstream": {"protocol": "h3"}, "servers": [{"id": "server1", "host": "127.0.0.1", "port": 9081, "max_conns": 5}]}
+			]}`,
+			err: router.ErrInvalidUpstreamPolicy,
+		},
+		{
+			name: "invalid trusted proxy",
+			config: `{
+				"trusted_proxies": ["10.0.0.0/33"],
+				"pools": [{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]}]
+			}`,
+			err: loadbalancer.ErrInvalidTrustedProxy,
+		},
+		{
+			name: "duplicate route",
+			config: `{
+				"pools": [{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]}],
+				"routes": [{"name": "web", "pool": "web"}, {"name": "web", "pool": "web"}]
+			}`,
+			err: router.ErrRouteAlreadyExists,
+		},
+		{
+			name: "removing a tcp listener's pool",
+			config: `{
+				"pools": [{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]}],
+				"tcp": [{"port": 5432, "pool": "web", "sni_routes": {"api.example.com": "api"}}]
+			}`,
+			err: loadbalancer.ErrPoolNotFound,
+		},
+		{
+			name: "removing a udp listener's pool",
+			config: `{
+				"pools": [{"name": "web", "strategy": "weighted_round_robin", "max_conns": 20, "servers": [
+					{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 4}
+				]}],
+				"udp": [{"port": 53, "pool": "api"}]
+			}`,
+			err: loadbalancer.ErrPoolNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pools, err := parseConfig(t, reloadBaseConfig).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := parseConfig(t, tc.config).Apply(pools); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v but got %v", tc.err, err)
+			}
+
+			web, _ := pools.GetPool("web")
+			servers := serverIDs(web)
+			if len(servers) != 2 || servers["server1"].Status().MaxConns != 10 {
+				t.Fatalf("expected the web pool to be untouched but got %v", web.Status())
+			}
+			if weight := web.GetServers()[0].(*loadbalancer.WeightedServerInstance).GetWeight(); weight != 1 {
+				t.Fatalf("expected server1 to keep weight 1 but got %d", weight)
+			}
+			if _, err := pools.GetPool("api"); err != nil {
+				t.Fatalf("expected the api pool to be kept but got %v", err)
+			}
+		})
+	}
+}
+
+func TestReloadRoutesRejectsBadUpstreamPolicy(t *testing.T) {
+	pools, err := parseConfig(t, reloadBaseConfig).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := router.NewRouteTable()
+	r := router.NewRouter(pools, routes)
+	if err := parseConfig(t, reloadBaseConfig).ApplyRoutes(r, routes); err != nil {
+		t.Fatal(err)
+	}
+
+	err = parseConfig(t, `{
+		"trusted_proxies": ["10.0.0.1"],
+		"pools": [
+			{"name": "web", "strategy": "weighted_round_robin", "servers": [{"id": "server1", "host": "127.0.0.1", "port": 8081, "weight": 1}]},
+			{"name": "api", "upstream": {"protocol": "h3"}, "servers": [{"id": "server1", "host": "127.0.0.1", "port": 9081, "max_conns": 5}]}
+		],
+		"routes": [{"name": "api", "pool": "api"}]
+	}`).ApplyRoutes(r, routes)
+	if !errors.Is(err, router.ErrInvalidUpstreamPolicy) {
+		t.Fatalf("expected %v but got %v", router.ErrInvalidUpstreamPolicy, err)
+	}
+
+	if r.TrustedProxies().Trusts("10.0.0.1") {
+		t.Fatal("expected the trusted proxies to be left alone")
+	}
+	if names := routes.GetRoutes(); len(names) != 1 || names[0].Name != "default" {
+		t.Fatalf("expected the default route to be kept but got %v", names)
+	}
+}
+
+func TestReloadKeepsHealthChecker(t *testing.T) {
+	config := func(interval string) *lbconfig.Config {
+		return parseConfig(t, `{"pools": [{
+			"name": "web",
+			"max_conns": 10,
+			"health_check": {"path": "/healthz", "interval": "`+interval+`", "timeout": "1s"},
+			"servers": [{"id": "server1", "host": "127.0.0.1", "port": 8081}]
+		}]}`)
+	}
+
+	pools, err := config("1h").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pools.RemovePool("web")
+	web, _ := pools.GetPool("web")
+	health := web.HealthChecker()
+
+	if err := config("1h").Apply(pools); err != nil {
+		t.Fatal(err)
+	}
+	if web.HealthChecker() != health {
+		t.Fatal("expected an unchanged health check to keep its checker")
+	}
+
+	if err := config("30m").Apply(pools); err != nil {
+		t.Fatal(err)
+	}
+	if web.HealthChecker() == health || web.HealthChecker() == nil {
+		t.Fatal("expected a changed interval to replace the checker")
+	}
+
+	if err := parseConfig(t, `{"pools": [{"name": "web", "max_conns": 10, "servers": [{"id": "server1", "host": "127.0.0.1", "port": 8081}]}]}`).Apply(pools); err != nil {
+		t.Fatal(err)
+	}
+	if web.HealthChecker() != nil {
+		t.Fatal("expected removing the health check to stop the checker")
+	}
+}
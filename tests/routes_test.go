@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+func TestRouteMatching(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   router.Route
+		request func() *http.Request
+		match   bool
+	}{
+		{
+			name:    "exact host",
+			route:   router.Route{Hosts: []string{"API.example.com"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "http://api.example.com:8080/", nil) },
+			match:   true,
+		},
+		{
+			name:    "other host",
+			route:   router.Route{Hosts: []string{"api.example.com"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil) },
+		},
+		{
+			name:    "wildcard subdomain",
+			route:   router.Route{Hosts: []string{"*.example.com"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "http://a.b.example.com/", nil) },
+			match:   true,
+		},
+		{
+			name:    "wildcard excludes the apex",
+			route:   router.Route{Hosts: []string{"*.example.com"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "http://example.com/", nil) },
+		},
+		{
+			name:    "path prefix",
+			route:   router.Route{PathPrefix: "/api/"},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/users", nil) },
+			match:   true,
+		},
+		{
+			name:    "path prefix miss",
+			route:   router.Route{PathPrefix: "/api/"},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/apiv2", nil) },
+		},
+		{
+			name:    "path regex",
+			route:   router.Route{PathRegex: `^/users/\d+$`},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/users/42", nil) },
+			match:   true,
+		},
+		{
+			name:    "path regex miss",
+			route:   router.Route{PathRegex: `^/users/\d+$`},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/users/me", nil) },
+		},
+		{
+			name:    "method is case insensitive",
+			route:   router.Route{Methods: []string{"post", "PUT"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodPost, "/", nil) },
+			match:   true,
+		},
+		{
+			name:    "method miss",
+			route:   router.Route{Methods: []string{"POST"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+		},
+		{
+			name:  "header value",
+			route: router.Route{Headers: map[string]string{"x-canary": "yes"}},
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Add("X-Canary", "no")
+				req.Header.Add("X-Canary", "yes")
+				return req
+			},
+			match: true,
+		},
+		{
+			name:  "header value miss",
+			route: router.Route{Headers: map[string]string{"X-Canary": "yes"}},
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Canary", "no")
+				return req
+			},
+		},
+		{
+			name:  "header presence",
+			route: router.Route{Headers: map[string]string{"X-Debug": ""}},
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("X-Debug", "1")
+				return req
+			},
+			match: true,
+		},
+		{
+			name:    "header absent",
+			route:   router.Route{Headers: map[string]string{"X-Debug": ""}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+		},
+		{
+			name:    "identity without a client certificate",
+			route:   router.Route{Identities: []string{"spiffe://example.com/*"}},
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/", nil) },
+		},
+		{
+			name:  "every condition must match",
+			route: router.Route{Hosts: []string{"api.example.com"}, PathPrefix: "/v1", Methods: []string{"GET"}},
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "http://api.example.com/v1/users", nil)
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.route.Name, tc.route.Pool = "route", "web"
+			table := router.NewRouteTable()
+			if err := table.AddRoute(tc.route); err != nil {
+				t.Fatal(err)
+			}
+
+			_, ok := table.Match(tc.request())
+			if ok != tc.match {
+				t.Fatalf("expected match %v but got %v", tc.match, ok)
+			}
+		})
+	}
+}
+
+func TestRouteTableOrder(t *testing.T) {
+	table := router.NewRouteTable()
+	for _, route := range []router.Route{
+		{Name: "catch-all", Pool: "web"},
+		{Name: "api", PathPrefix: "/api", Pool: "api", Priority: 10},
+		{Name: "api-v2", PathPrefix: "/api/v2", Pool: "api-v2", Priority: 10},
+		{Name: "admin", PathPrefix: "/api/admin", Pool: "admin", Priority: 20},
+	} {
+		if err := table.AddRoute(route); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/":              "catch-all",
+		"/api/users":     "api",
+		"/api/v2/users":  "api", // same priority, so the earlier route wins
+		"/api/admin/foo": "admin",
+	} {
+		route, ok := table.Match(httptest.NewRequest(http.MethodGet, path, nil))
+		if !ok || route.Name != want {
+			t.Errorf("%s: expected route %s but got %v", path, want, route)
+		}
+	}
+
+	if err := table.AddRoute(router.Route{Name: "api", Pool: "web"}); !errors.Is(err, router.ErrRouteAlreadyExists) {
+		t.Fatalf("expected ErrRouteAlreadyExists but got %v", err)
+	}
+	if err := table.RemoveRoute("api"); err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := table.Match(httptest.NewRequest(http.MethodGet, "/api/v2/users", nil)); route.Name != "api-v2" {
+		t.Fatalf("expected api-v2 once api is removed but got %s", route.Name)
+	}
+	if err := table.RemoveRoute("api"); !errors.Is(err, router.ErrRouteNotFound) {
+		t.Fatalf("expected ErrRouteNotFound but got %v", err)
+	}
+}
+
+func TestRouteTableValidation(t *testing.T) {
+	table := router.NewRouteTable()
+	if err := table.SetRoutes([]router.Route{{Name: "web", Pool: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, routes := range map[string][]router.Route{
+		"missing name":      {{Pool: "web"}},
+		"no target":         {{Name: "empty"}},
+		"pool and split":    {{Name: "both", Pool: "web", Split: &router.TrafficSplit{Backends: []router.SplitBackend{{Pool: "a", Weight: 1}, {Pool: "b", Weight: 1}}}}},
+		"bad regex":         {{Name: "regex", Pool: "web", PathRegex: "("}},
+		"bad mirror":        {{Name: "mirror", Pool: "web", Mirror: &router.MirrorPolicy{Pool: "shadow", Percent: 150}}},
+		"invalid later one": {{Name: "ok", Pool: "web"}, {Name: "regex", Pool: "web", PathRegex: "["}},
+	} {
+		if err := table.SetRoutes(routes); !errors.Is(err, router.ErrInvalidRoute) {
+			t.Errorf("%s: expected ErrInvalidRoute but got %v", name, err)
+		}
+	}
+
+	if err := table.SetRoutes([]router.Route{{Name: "a", Pool: "web"}, {Name: "a", Pool: "api"}}); !errors.Is(err, router.ErrRouteAlreadyExists) {
+		t.Fatalf("expected ErrRouteAlreadyExists but got %v", err)
+	}
+
+	routes := table.GetRoutes()
+	if len(routes) != 1 || routes[0].Name != "web" {
+		t.Fatalf("expected rejected updates to leave the table alone but got %+v", routes)
+	}
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+)
+
+// newPassthroughBackend terminates TLS with a certificate for name and
+// answers with its own name, so the client can tell where it ended up.
+func newPassthroughBackend(t *testing.T, ca *testCA, name string) *loadbalancer.ServerInstance {
+	t.Helper()
+
+	cert, _, _ := ca.issue(t, name, x509.ExtKeyUsageServerAuth)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name)
+			}()
+		}
+	}()
+
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, 10)
+	return server
+}
+
+func TestSNIPassthrough(t *testing.T) {
+	ca := newTestCA(t)
+	pools := loadbalancer.NewPoolManager()
+	for pool, name := range map[string]string{
+		"sni-api":     "api.example.org",
+		"sni-apps":    "shop.apps.example.org",
+		"sni-default": "default.example.org",
+	} {
+		lb := loadbalancer.NewRoundRobinLoadBalancer()
+		_ = lb.AddServer(newPassthroughBackend(t, ca, name))
+		p, _ := loadbalancer.NewPool(pool, lb)
+		_ = pools.AddPool(p)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	srv := servlets.NewTcpServer(pools, nil, servlets.TcpListenerConfig{
+		Port: port,
+		Pool: "sni-default",
+		SNIRoutes: map[string]string{
+			"API.example.org":    "sni-api",
+			"*.apps.example.org": "sni-apps",
+		},
+	})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, c := range []struct {
+		serverName string
+		verifyAs   string
+		want       string
+	}{
+		{"api.example.org", "api.example.org", "api.example.org"},
+		{"shop.apps.example.org", "shop.apps.example.org", "shop.apps.example.org"},
+		{"unknown.example.org", "default.example.org", "default.example.org"},
+		{"", "default.example.org", "default.example.org"},
+	} {
+		// Without a server name the client sends no SNI, so the
+		// certificate is checked against the expected name by hand.
+		config := &tls.Config{RootCAs: ca.pool(), ServerName: c.serverName}
+		if c.serverName != c.verifyAs {
+			config.InsecureSkipVerify = true
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: ca.pool(), DNSName: c.verifyAs})
+				return err
+			}
+		}
+
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, config)
+		if err != nil {
+			t.Fatalf("sni %q: %v", c.serverName, err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		reply, _ := io.ReadAll(conn)
+		conn.Close()
+
+		if string(reply) != c.want {
+			t.Errorf("sni %q: expected to reach %s but reached %q", c.serverName, c.want, reply)
+		}
+	}
+
+	helloErrors := metrics.GetCounter(fmt.Sprintf(`tcp_client_hello_errors_total{port="%d"}`, port))
+	before := helloErrors.Value()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	if reply, _ := io.ReadAll(conn); len(reply) != 0 {
+		t.Fatalf("expected a connection without a ClientHello to be closed, got %q", reply)
+	}
+	if got := helloErrors.Value() - before; got != 1 {
+		t.Fatalf("expected the missing ClientHello to be counted, got %d", got)
+	}
+}
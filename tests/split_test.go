@@ -0,0 +1,136 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+func splitRoute(t *testing.T, split router.TrafficSplit) *router.RouteTable {
+	t.Helper()
+	table := router.NewRouteTable()
+	if err := table.AddRoute(router.Route{Name: "canary", Split: &split}); err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func splitCounts(t *testing.T, table *router.RouteTable, requests int, request func(i int) *http.Request) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := range requests {
+		req := request(i)
+		route, ok := table.Match(req)
+		if !ok {
+			t.Fatal("expected the split route to match")
+		}
+		pool, _ := route.Target(req)
+		counts[pool]++
+	}
+	return counts
+}
+
+func randomRequest(int) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/", nil)
+}
+
+// expectShare checks a pool got its weighted share of requests to within
+// a couple of percentage points.
+func expectShare(t *testing.T, counts map[string]int, pool string, share float64, requests int) {
+	t.Helper()
+	if got := float64(counts[pool]) / float64(requests); math.Abs(got-share) > 0.02 {
+		t.Errorf("expected %s to get %.0f%% of requests but got %.1f%% (%v)", pool, share*100, got*100, counts)
+	}
+}
+
+func TestSplitDistribution(t *testing.T) {
+	const requests = 20000
+	table := splitRoute(t, router.TrafficSplit{
+		Backends:      []router.SplitBackend{{Pool: "stable", Weight: 90}, {Pool: "canary", Weight: 10}, {Pool: "off", Weight: 0}},
+		VariantHeader: "X-Variant",
+	})
+
+	counts := splitCounts(t, table, requests, randomRequest)
+	expectShare(t, counts, "stable", 0.9, requests)
+	expectShare(t, counts, "canary", 0.1, requests)
+	if counts["off"] != 0 {
+		t.Errorf("expected a zero weight backend to get nothing but got %d", counts["off"])
+	}
+
+	route, _ := table.Match(randomRequest(0))
+	if _, header := route.Target(randomRequest(0)); header != "X-Variant" {
+		t.Errorf("expected the variant header X-Variant but got %q", header)
+	}
+}
+
+func TestSplitHashing(t *testing.T) {
+	const requests = 20000
+	table := splitRoute(t, router.TrafficSplit{
+		Backends: []router.SplitBackend{{Pool: "a", Weight: 1}, {Pool: "b", Weight: 3}},
+		HashOn:   router.HashOnHeader,
+		HashKey:  "X-User",
+	})
+
+	withUser := func(i int) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		return req
+	}
+
+	counts := splitCounts(t, table, requests, withUser)
+	expectShare(t, counts, "a", 0.25, requests)
+	expectShare(t, counts, "b", 0.75, requests)
+
+	for i := range 100 {
+		first := splitCounts(t, table, 1, func(int) *http.Request { return withUser(i) })
+		again := splitCounts(t, table, 20, func(int) *http.Request { return withUser(i) })
+		for pool := range first {
+			if again[pool] != 20 {
+				t.Fatalf("expected user-%d to always get %s but got %v", i, pool, again)
+			}
+		}
+	}
+
+	// Requests without the header are spread randomly.
+	counts = splitCounts(t, table, requests, randomRequest)
+	expectShare(t, counts, "a", 0.25, requests)
+}
+
+func TestSplitWeightUpdates(t *testing.T) {
+	const requests = 20000
+	table := splitRoute(t, router.TrafficSplit{
+		Backends: []router.SplitBackend{{Pool: "stable", Weight: 1}, {Pool: "canary", Weight: 0}},
+	})
+	if counts := splitCounts(t, table, 1000, randomRequest); counts["canary"] != 0 {
+		t.Fatalf("expected the canary to start with no traffic but got %v", counts)
+	}
+
+	if err := table.UpdateSplitWeights("canary", []router.SplitBackend{{Pool: "stable", Weight: 1}, {Pool: "canary", Weight: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	counts := splitCounts(t, table, requests, randomRequest)
+	expectShare(t, counts, "canary", 0.5, requests)
+
+	for name, backends := range map[string][]router.SplitBackend{
+		"zero sum":        {{Pool: "stable", Weight: 0}, {Pool: "canary", Weight: 0}},
+		"negative weight": {{Pool: "stable", Weight: 2}, {Pool: "canary", Weight: -1}},
+		"one backend":     {{Pool: "stable", Weight: 1}},
+		"no pool":         {{Pool: "stable", Weight: 1}, {Weight: 1}},
+	} {
+		if err := table.UpdateSplitWeights("canary", backends); !errors.Is(err, router.ErrInvalidRoute) {
+			t.Errorf("%s: expected ErrInvalidRoute but got %v", name, err)
+		}
+	}
+
+	if err := table.UpdateSplitWeights("missing", []router.SplitBackend{{Pool: "a", Weight: 1}, {Pool: "b", Weight: 1}}); !errors.Is(err, router.ErrRouteNotFound) {
+		t.Fatalf("expected ErrRouteNotFound but got %v", err)
+	}
+
+	counts = splitCounts(t, table, requests, randomRequest)
+	expectShare(t, counts, "canary", 0.5, requests)
+}
@@ -0,0 +1,222 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// newTCPBackend reads until the client half-closes, then replies with what
+// it was sent prefixed by its name, and closes.
+func newTCPBackend(t *testing.T, name string) *loadbalancer.ServerInstance {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				fmt.Fprintf(conn, "%s:%s", name, data)
+			}()
+		}
+	}()
+
+	server, _ := loadbalancer.NewServerInstance(name, "127.0.0.1", listener.Addr().(*net.TCPAddr).Port, 1)
+	return server
+}
+
+// startTCPProxy waits for a probe connection to be turned away by the
+// empty pool before adding servers, so the probe isn't proxied.
+func startTCPProxy(t *testing.T, poolName string, config servlets.TcpListenerConfig, servers ...*loadbalancer.ServerInstance) string {
+	t.Helper()
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	pool, _ := loadbalancer.NewPool(poolName, lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Port = listener.Addr().(*net.TCPAddr).Port
+	config.Pool = poolName
+	listener.Close()
+
+	srv := servlets.NewTcpServer(pools, nil, config)
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	noServer := metrics.GetCounter(fmt.Sprintf("tcp_no_server_total{pool=%q}", poolName))
+	before := noServer.Value()
+	addr := fmt.Sprintf("127.0.0.1:%d", config.Port)
+	deadline := time.Now().Add(2 * time.Second)
+	for noServer.Value() == before {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, server := range servers {
+		_ = lb.AddServer(server)
+	}
+	return addr
+}
+
+// exchange sends msg, half-closes and returns everything read back.
+func exchange(t *testing.T, addr, msg string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := io.WriteString(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func TestTCPProxyHalfCloseAndMetrics(t *testing.T) {
+	server1, server2 := newTCPBackend(t, "server1"), newTCPBackend(t, "server2")
+	addr := startTCPProxy(t, "tcp-echo", servlets.TcpListenerConfig{}, server1, server2)
+
+	labels := `{pool="tcp-echo",server="server1"}`
+	connections := metrics.GetCounter("tcp_connections_total" + labels)
+	received := metrics.GetCounter("tcp_bytes_received_total" + labels)
+	sent := metrics.GetCounter("tcp_bytes_sent_total" + labels)
+	beforeConns, beforeReceived, beforeSent := connections.Value(), received.Value(), sent.Value()
+
+	seen := map[string]bool{}
+	for range 2 {
+		reply := exchange(t, addr, "ping")
+		seen[reply] = true
+	}
+	if !seen["server1:ping"] || !seen["server2:ping"] {
+		t.Fatalf("expected both backends to reply after the client half-closed, got %v", seen)
+	}
+
+	if got := connections.Value() - beforeConns; got != 1 {
+		t.Errorf("expected 1 connection to server1 but counted %d", got)
+	}
+	if got := received.Value() - beforeReceived; got != int64(len("ping")) {
+		t.Errorf("expected %d bytes received for server1 but counted %d", len("ping"), got)
+	}
+	if got := sent.Value() - beforeSent; got != int64(len("server1:ping")) {
+		t.Errorf("expected %d bytes sent for server1 but counted %d", len("server1:ping"), got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for server1.GetConnectionAmount() != 0 || server2.GetConnectionAmount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connections to be released once both sides closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPProxyLimitsAndTimeouts(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			// Hold the connection open without ever sending anything.
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	server, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", backend.Addr().(*net.TCPAddr).Port, 1)
+	addr := startTCPProxy(t, "tcp-idle", servlets.TcpListenerConfig{IdleTimeout: util.Duration(200 * time.Millisecond)}, server)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	io.WriteString(first, "hold")
+
+	deadline := time.Now().Add(time.Second)
+	for server.GetConnectionAmount() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the first connection to take the only slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bufio.NewReader(second).ReadByte(); err != io.EOF {
+		t.Fatalf("expected a connection over max_conns to be closed, got %v", err)
+	}
+
+	idleClosed := metrics.GetCounter(`tcp_idle_closed_total{pool="tcp-idle",server="server1"}`)
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(first).ReadByte(); err != io.EOF {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	if idleClosed.Value() == 0 {
+		t.Fatal("expected the idle close to be counted")
+	}
+
+	unreachable, _ := loadbalancer.NewServerInstance("server1", "127.0.0.1", 1, 1)
+	connectErrors := metrics.GetCounter(`tcp_connect_errors_total{pool="tcp-down",server="server1"}`)
+	before := connectErrors.Value()
+	addr = startTCPProxy(t, "tcp-down", servlets.TcpListenerConfig{ConnectTimeout: util.Duration(time.Second)}, unreachable)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed when the backend is unreachable, got %v", err)
+	}
+	if connectErrors.Value() == before {
+		t.Fatal("expected the failed connect to be counted")
+	}
+}
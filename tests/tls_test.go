@@ -0,0 +1,480 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+	"golang.org/x/crypto/ocsp"
+)
+
+// writeCertificate writes a self-signed certificate and its key for names
+// to dir, valid from notBefore to notAfter.
+func writeCertificate(t *testing.T, dir string, file string, names []string, notBefore, notAfter time.Time) servlets.CertificateConfig {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	cc := servlets.CertificateConfig{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	if err := os.WriteFile(cc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+func validCertificate(t *testing.T, dir string, file string, names ...string) servlets.CertificateConfig {
+	return writeCertificate(t, dir, file, names, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+}
+
+// ocspCertificate issues a certificate for name from ca, followed by the CA
+// in its file so staples can be checked, and returns it with its leaf.
+func ocspCertificate(t *testing.T, ca *testCA, name string) (servlets.CertificateConfig, *x509.Certificate) {
+	t.Helper()
+
+	cert, certFile, keyFile := ca.issue(t, name, x509.ExtKeyUsageServerAuth)
+	chain, _ := os.ReadFile(certFile)
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+	if err := os.WriteFile(certFile, chain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return servlets.CertificateConfig{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		OCSPStapleFile: filepath.Join(ca.dir, name+".ocsp"),
+	}, cert.Leaf
+}
+
+// staple signs an OCSP response about leaf with the CA's key.
+func (ca *testCA) staple(t *testing.T, leaf *x509.Certificate, status int, thisUpdate, nextUpdate time.Time) []byte {
+	t.Helper()
+
+	raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   nextUpdate,
+		RevokedAt:    thisUpdate,
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// startTLSListener runs a load balancer HTTPS listener in front of a single
+// backend and returns its address.
+func startTLSListener(t *testing.T, config servlets.TLSConfig) string {
+	t.Helper()
+
+	backend := newBackend("server1", 0)
+	t.Cleanup(backend.Close)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer(), backend)
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{TLS: &config})
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func handshake(t *testing.T, addr string, config *tls.Config) tls.ConnectionState {
+	t.Helper()
+
+	config.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState()
+}
+
+func TestTLSCertificateSelection(t *testing.T) {
+	dir := t.TempDir()
+	exact := validCertificate(t, dir, "exact", "api.example.com")
+
+	ca := newTestCA(t)
+	wildcard, leaf := ocspCertificate(t, ca, "*.example.org")
+	staple := ca.staple(t, leaf, ocsp.Good, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	if err := os.WriteFile(wildcard.OCSPStapleFile, staple, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTLSListener(t, servlets.TLSConfig{Certificates: []servlets.CertificateConfig{exact, wildcard}})
+
+	cases := []struct {
+		serverName, want string
+	}{
+		{"api.example.com", "api.example.com"},
+		{"www.example.org", "*.example.org"},
+		{"unknown.test", "api.example.com"},
+	}
+	for _, c := range cases {
+		state := handshake(t, addr, &tls.Config{ServerName: c.serverName})
+		if got := state.PeerCertificates[0].Subject.CommonName; got != c.want {
+			t.Errorf("SNI %s: expected certificate %s but got %s", c.serverName, c.want, got)
+		}
+	}
+
+	state := handshake(t, addr, &tls.Config{ServerName: "www.example.org", NextProtos: []string{"h2", "http/1.1"}})
+	if !bytes.Equal(state.OCSPResponse, staple) {
+		t.Fatalf("expected the OCSP staple to be served, got %q", state.OCSPResponse)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Fatalf("expected HTTP/2 to be negotiated but got %q", state.NegotiatedProtocol)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	cert := validCertificate(t, dir, "cert", "api.example.com")
+	addr := startTLSListener(t, servlets.TLSConfig{
+		Certificates: []servlets.CertificateConfig{cert},
+		MinVersion:   "1.3",
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected a TLS 1.2 client to be refused")
+	}
+
+	_, err = servlets.NewCertificateStore(servlets.TLSConfig{
+		Certificates: []servlets.CertificateConfig{cert},
+		CipherSuites: []string{"TLS_NOT_A_CIPHER"},
+	})
+	if !errors.Is(err, servlets.ErrUnknownCipherSuite) {
+		t.Fatalf("expected an unknown cipher suite to be rejected, got %v", err)
+	}
+}
+
+func TestTLSListenerReleasesPortOnHTTP2Error(t *testing.T) {
+	dir := t.TempDir()
+	cert := validCertificate(t, dir, "cert", "api.example.com")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// HTTP/2 refuses cipher suites without AES-128-GCM below TLS 1.3.
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer())
+	srv := servlets.NewHttpServer(r, port, r.TrustedProxies(), servlets.ListenerConfig{
+		TLS: &servlets.TLSConfig{
+			Certificates: []servlets.CertificateConfig{cert},
+			CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+		},
+	})
+	if err := srv.Start(); err == nil {
+		t.Fatal("expected the listener to refuse to start")
+	}
+
+	listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("expected the failed listener to release its port, got %v", err)
+	}
+	listener.Close()
+}
+
+func TestTLSInvalidCertificates(t *testing.T) {
+	dir := t.TempDir()
+	expired := writeCertificate(t, dir, "expired", []string{"old.example.com"}, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+
+	_, err := servlets.NewCertificateStore(servlets.TLSConfig{Certificates: []servlets.CertificateConfig{expired}})
+	if !errors.Is(err, servlets.ErrCertificateExpired) {
+		t.Fatalf("expected an expired certificate to be rejected, got %v", err)
+	}
+
+	mismatched := validCertificate(t, dir, "mismatched", "api.example.com")
+	mismatched.KeyFile = validCertificate(t, dir, "other", "other.example.com").KeyFile
+	_, err = servlets.NewCertificateStore(servlets.TLSConfig{Certificates: []servlets.CertificateConfig{mismatched}})
+	if !errors.Is(err, servlets.ErrInvalidCertificate) {
+		t.Fatalf("expected a mismatched key to be rejected, got %v", err)
+	}
+
+	r := newAttributesRouter(t, loadbalancer.NewRoundRobinLoadBalancer())
+	srv := servlets.NewHttpServer(r, 0, r.TrustedProxies(), servlets.ListenerConfig{
+		TLS: &servlets.TLSConfig{Certificates: []servlets.CertificateConfig{expired}},
+	})
+	if err := srv.Start(); !errors.Is(err, servlets.ErrCertificateExpired) {
+		t.Fatalf("expected the listener to refuse to start, got %v", err)
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	cert := validCertificate(t, dir, "cert", "before.example.com")
+	addr := startTLSListener(t, servlets.TLSConfig{
+		Certificates:   []servlets.CertificateConfig{cert},
+		ReloadInterval: util.Duration(20 * time.Millisecond),
+	})
+
+	if got := handshake(t, addr, &tls.Config{}).PeerCertificates[0].Subject.CommonName; got != "before.example.com" {
+		t.Fatalf("expected the initial certificate but got %s", got)
+	}
+
+	validCertificate(t, dir, "cert", "after.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(cert.CertFile, future, future)
+	os.Chtimes(cert.KeyFile, future, future)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for handshake(t, addr, &tls.Config{}).PeerCertificates[0].Subject.CommonName != "after.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the listener to pick up the new certificate")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTLSOCSPStapleValidation(t *testing.T) {
+	ca := newTestCA(t)
+	cert, leaf := ocspCertificate(t, ca, "api.example.com")
+	_, other := ocspCertificate(t, ca, "other.example.com")
+	otherCA := newTestCA(t)
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		staple []byte
+		err    error
+	}{
+		{"good", ca.staple(t, leaf, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), nil},
+		{"for another certificate", ca.staple(t, other, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), servlets.ErrInvalidOCSPStaple},
+		{"signed by another CA", otherCA.staple(t, leaf, ocsp.Good, now.Add(-time.Hour), now.Add(time.Hour)), servlets.ErrInvalidOCSPStaple},
+		{"revoked", ca.staple(t, leaf, ocsp.Revoked, now.Add(-time.Hour), now.Add(time.Hour)), servlets.ErrInvalidOCSPStaple},
+		{"past its next update", ca.staple(t, leaf, ocsp.Good, now.Add(-2*time.Hour), now.Add(-time.Hour)), servlets.ErrInvalidOCSPStaple},
+		{"garbage", []byte("not a real OCSP response"), servlets.ErrInvalidOCSPStaple},
+	}
+	for _, c := range cases {
+		if err := os.WriteFile(cert.OCSPStapleFile, c.staple, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := servlets.NewCertificateStore(servlets.TLSConfig{Certificates: []servlets.CertificateConfig{cert}})
+		if c.err == nil && err != nil {
+			t.Errorf("%s: expected the staple to be accepted, got %v", c.name, err)
+		}
+		if c.err != nil && !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v but got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestTLSOCSPStapleRefresh(t *testing.T) {
+	ca := newTestCA(t)
+	var fetches atomic.Int64
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fetches.Add(1)
+		raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(24 * time.Hour),
+		}, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(raw)
+	}))
+	t.Cleanup(responder.Close)
+	ca.ocspServer = responder.URL
+
+	// Past half of its validity, so it is due for a refresh straight away.
+	cert, leaf := ocspCertificate(t, ca, "api.example.com")
+	cert.OCSPFetch = true
+	stale := ca.staple(t, leaf, ocsp.Good, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err := os.WriteFile(cert.OCSPStapleFile, stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTLSListener(t, servlets.TLSConfig{
+		Certificates:   []servlets.CertificateConfig{cert},
+		ReloadInterval: util.Duration(20 * time.Millisecond),
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		served := handshake(t, addr, &tls.Config{ServerName: "api.example.com"}).OCSPResponse
+		if !bytes.Equal(served, stale) {
+			response, err := ocsp.ParseResponseForCert(served, leaf, ca.cert)
+			if err != nil {
+				t.Fatalf("expected a valid refreshed staple: %v", err)
+			}
+			if time.Until(response.NextUpdate) < 23*time.Hour {
+				t.Fatalf("expected the refreshed staple to be fresh, it expires at %v", response.NextUpdate)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the expiring staple to be refreshed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	onDisk, _ := os.ReadFile(cert.OCSPStapleFile)
+	if !bytes.Equal(onDisk, stale) {
+		t.Fatal("expected the configured staple file to be left alone")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected a fresh staple to be fetched once but it was fetched %d times", n)
+	}
+}
+
+// newOCSPResponder answers every OCSP request with status, counting them.
+func newOCSPResponder(t *testing.T, ca *testCA, status int) *atomic.Int64 {
+	t.Helper()
+
+	var requests atomic.Int64
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(responder.Close)
+	ca.ocspServer = responder.URL
+	return &requests
+}
+
+func TestTLSOCSPFetchIsOptIn(t *testing.T) {
+	ca := newTestCA(t)
+	requests := newOCSPResponder(t, ca, http.StatusInternalServerError)
+
+	cert, leaf := ocspCertificate(t, ca, "api.example.com")
+	stale := ca.staple(t, leaf, ocsp.Good, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err := os.WriteFile(cert.OCSPStapleFile, stale, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startTLSListener(t, servlets.TLSConfig{
+		Certificates:   []servlets.CertificateConfig{cert},
+		ReloadInterval: util.Duration(20 * time.Millisecond),
+	})
+
+	time.Sleep(100 * time.Millisecond)
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("expected the responder not to be asked without ocsp_fetch but it was asked %d times", n)
+	}
+	if served := handshake(t, addr, &tls.Config{ServerName: "api.example.com"}).OCSPResponse; !bytes.Equal(served, stale) {
+		t.Fatal("expected the configured staple to be served")
+	}
+
+	cert.OCSPStapleFile, cert.OCSPFetch = "", true
+	if _, err := servlets.NewCertificateStore(servlets.TLSConfig{Certificates: []servlets.CertificateConfig{cert}}); !errors.Is(err, servlets.ErrInvalidOCSPStaple) {
+		t.Fatalf("expected ocsp_fetch without a staple file to be rejected but got %v", err)
+	}
+}
+
+func TestTLSOCSPStapleExpiry(t *testing.T) {
+	for _, fetch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fetch %v", fetch), func(t *testing.T) {
+			ca := newTestCA(t)
+			requests := newOCSPResponder(t, ca, http.StatusServiceUnavailable)
+
+			cert, leaf := ocspCertificate(t, ca, "api.example.com")
+			cert.OCSPFetch = fetch
+			// OCSP times are in whole seconds, so this expires in one to two.
+			expiring := ca.staple(t, leaf, ocsp.Good, time.Now().Add(-time.Hour), time.Now().Add(2*time.Second))
+			if err := os.WriteFile(cert.OCSPStapleFile, expiring, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			addr := startTLSListener(t, servlets.TLSConfig{
+				Certificates:   []servlets.CertificateConfig{cert},
+				ReloadInterval: util.Duration(20 * time.Millisecond),
+			})
+			if served := handshake(t, addr, &tls.Config{ServerName: "api.example.com"}).OCSPResponse; !bytes.Equal(served, expiring) {
+				t.Fatal("expected the staple to be served until it expires")
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for len(handshake(t, addr, &tls.Config{ServerName: "api.example.com"}).OCSPResponse) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("expected the expired staple to stop being served")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			if fetch && requests.Load() == 0 {
+				t.Fatal("expected a refresh to be tried before the staple was dropped")
+			}
+		})
+	}
+}
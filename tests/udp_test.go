@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/servlets"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// newUDPBackend answers every datagram with its name and the datagram.
+func newUDPBackend(t *testing.T, name string) *loadbalancer.ServerInstance {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP([]byte(fmt.Sprintf("%s:%s", name, buf[:n])), from)
+		}
+	}()
+
+	server, _ := loadbalancer.NewServerInstance(name, "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port, 10)
+	return server
+}
+
+// startUDPProxy waits for a probe datagram to be turned away by the empty
+// pool before adding servers, so the probe isn't relayed.
+func startUDPProxy(t *testing.T, poolName string, lb loadbalancer.LoadBalancer, config servlets.UdpListenerConfig, servers ...*loadbalancer.ServerInstance) *net.UDPAddr {
+	t.Helper()
+
+	pool, _ := loadbalancer.NewPool(poolName, lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	reserved, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Port = reserved.LocalAddr().(*net.UDPAddr).Port
+	config.Pool = poolName
+	reserved.Close()
+
+	srv := servlets.NewUdpServer(pools, config)
+	go srv.Start()
+	t.Cleanup(func() { srv.Stop() })
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: config.Port}
+	probe, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+
+	noServer := metrics.GetCounter(fmt.Sprintf("udp_no_server_total{pool=%q}", poolName))
+	before := noServer.Value()
+	deadline := time.Now().Add(2 * time.Second)
+	for noServer.Value() == before {
+		if time.Now().After(deadline) {
+			t.Fatal("udp proxy never started")
+		}
+		probe.Write([]byte("probe"))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for _, server := range servers {
+		_ = lb.AddServer(server)
+	}
+	return addr
+}
+
+func newUDPClient(t *testing.T, addr *net.UDPAddr) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func ask(t *testing.T, conn *net.UDPConn, msg string) string {
+	t.Helper()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPFlowAffinityAndExpiry(t *testing.T) {
+	server1, server2 := newUDPBackend(t, "server1"), newUDPBackend(t, "server2")
+	addr := startUDPProxy(t, "udp-flows", loadbalancer.NewRoundRobinLoadBalancer(),
+		servlets.UdpListenerConfig{IdleTimeout: util.Duration(300 * time.Millisecond)}, server1, server2)
+
+	received := metrics.GetCounter(`udp_packets_received_total{pool="udp-flows",server="server1"}`)
+	sent := metrics.GetCounter(`udp_packets_sent_total{pool="udp-flows",server="server1"}`)
+	beforeReceived, beforeSent := received.Value(), sent.Value()
+
+	first, second := newUDPClient(t, addr), newUDPClient(t, addr)
+	for i := range 3 {
+		msg := fmt.Sprintf("query-%d", i)
+		if reply := ask(t, first, msg); reply != "server1:"+msg {
+			t.Fatalf("expected the first client's flow to stay on server1 but got %q", reply)
+		}
+		if reply := ask(t, second, msg); reply != "server2:"+msg {
+			t.Fatalf("expected the second client's flow to stay on server2 but got %q", reply)
+		}
+	}
+
+	if got := received.Value() - beforeReceived; got != 3 {
+		t.Errorf("expected 3 datagrams relayed to server1 but counted %d", got)
+	}
+	if got := sent.Value() - beforeSent; got != 3 {
+		t.Errorf("expected 3 replies relayed from server1 but counted %d", got)
+	}
+	if server1.GetConnectionAmount() != 1 || server2.GetConnectionAmount() != 1 {
+		t.Fatal("expected each flow to hold a connection slot on its server")
+	}
+
+	expired := metrics.GetCounter(`udp_flows_expired_total{pool="udp-flows"}`)
+	beforeExpired := expired.Value()
+	deadline := time.Now().Add(2 * time.Second)
+	for server1.GetConnectionAmount() != 0 || server2.GetConnectionAmount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected idle flows to expire and release their servers")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := expired.Value() - beforeExpired; got != 2 {
+		t.Fatalf("expected 2 expired flows but counted %d", got)
+	}
+}
+
+func TestUDPPerPacketBalancing(t *testing.T) {
+	server1, server2 := newUDPBackend(t, "server1"), newUDPBackend(t, "server2")
+	addr := startUDPProxy(t, "udp-per-packet", loadbalancer.NewRoundRobinLoadBalancer(),
+		servlets.UdpListenerConfig{PerPacket: true}, server1, server2)
+
+	client := newUDPClient(t, addr)
+	seen := map[string]bool{}
+	for range 4 {
+		seen[ask(t, client, "lookup")] = true
+	}
+	if !seen["server1:lookup"] || !seen["server2:lookup"] {
+		t.Fatalf("expected datagrams from one client to be spread over both servers, got %v", seen)
+	}
+	if server1.GetConnectionAmount() != 0 || server2.GetConnectionAmount() != 0 {
+		t.Fatal("expected per-packet balancing not to hold connection slots")
+	}
+}
+
+func TestUDPIPHash(t *testing.T) {
+	server1, server2 := newUDPBackend(t, "server1"), newUDPBackend(t, "server2")
+	addr := startUDPProxy(t, "udp-ip-hash", loadbalancer.NewIPHashLoadBalancer(),
+		servlets.UdpListenerConfig{PerPacket: true}, server1, server2)
+
+	var want string
+	for range 4 {
+		reply := ask(t, newUDPClient(t, addr), "log")
+		if want == "" {
+			want = reply
+		}
+		if reply != want {
+			t.Fatalf("expected every source port on one address to hash to the same server, got %q and %q", want, reply)
+		}
+	}
+}
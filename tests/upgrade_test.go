@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/router"
+	util "github.com/raydatray/goobernetes/pkg/utils"
+)
+
+// goingAwayFrame is an unmasked close frame with status 1001.
+var goingAwayFrame = []byte{0x88, 0x02, 0x03, 0xe9}
+
+type upgradeFixture struct {
+	backend  *httptest.Server
+	lb       *httptest.Server
+	router   *router.Router
+	server   *loadbalancer.ServerInstance
+	received chan []byte
+}
+
+// newUpgradeFixture starts a backend that accepts WebSocket upgrades and
+// echoes whatever it is sent, behind a router.
+func newUpgradeFixture(t *testing.T, maxUpgraded int, policy router.UpgradePolicy) *upgradeFixture {
+	t.Helper()
+	f := &upgradeFixture{received: make(chan []byte, 16)}
+
+	f.backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+			return
+		}
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := rw.Read(buf)
+			if err != nil {
+				return
+			}
+			data := bytes.Clone(buf[:n])
+			f.received <- data
+
+			// Answer a close frame by hanging up, like a server finishing
+			// the closing handshake.
+			if data[0] == 0x88 {
+				return
+			}
+			conn.Write(data)
+		}
+	}))
+	t.Cleanup(f.backend.Close)
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(f.backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+	f.server, _ = loadbalancer.NewServerInstance("server1", host, port, 10)
+	if err := f.server.SetMaxUpgraded(maxUpgraded); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(f.server)
+
+	pool, _ := loadbalancer.NewPool("upgrades", lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: "upgrades"})
+
+	f.router = router.NewRouter(pools, routes)
+	if err := f.router.SetUpstreamPolicy("upgrades", router.UpstreamPolicy{Upgrades: policy}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.lb = httptest.NewServer(http.HandlerFunc(f.router.ServeRequest))
+	t.Cleanup(f.lb.Close)
+	return f
+}
+
+func (f *upgradeFixture) dial(t *testing.T) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(f.lb.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, resp.StatusCode
+}
+
+func (f *upgradeFixture) waitForUpgraded(t *testing.T, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for f.server.Status().Upgraded != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d upgraded connections but got %d", want, f.server.Status().Upgraded)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpgradeProxying(t *testing.T) {
+	f := newUpgradeFixture(t, 1, router.UpgradePolicy{})
+
+	conn, reader, status := f.dial(t)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101 but got %d", status)
+	}
+	f.waitForUpgraded(t, 1)
+
+	if got := f.server.GetConnectionAmount(); got != 0 {
+		t.Fatalf("expected an upgraded connection not to hold a request slot, got %d", got)
+	}
+
+	// A masked text frame carrying "hi".
+	frame := []byte{0x81, 0x82, 0x01, 0x02, 0x03, 0x04, 'h' ^ 0x01, 'i' ^ 0x02}
+	conn.Write(frame)
+
+	echo := make([]byte, len(frame))
+	if _, err := io.ReadFull(reader, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, frame) {
+		t.Fatalf("expected the frame to be echoed, got %x", echo)
+	}
+
+	_, _, status = f.dial(t)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("expected an upgrade over the cap to get 503 but got %d", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := f.router.DrainUpgrades(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	closing := make([]byte, len(goingAwayFrame))
+	if _, err := io.ReadFull(reader, closing); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(closing, goingAwayFrame) {
+		t.Fatalf("expected a going away close frame, got %x", closing)
+	}
+
+	for data := range f.received {
+		if data[0] == 0x88 {
+			if data[1]&0x80 == 0 {
+				t.Fatal("expected the close frame sent to the backend to be masked")
+			}
+			break
+		}
+	}
+	f.waitForUpgraded(t, 0)
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	f := newUpgradeFixture(t, 0, router.UpgradePolicy{
+		IdleTimeout:  util.Duration(200 * time.Millisecond),
+		DrainTimeout: util.Duration(200 * time.Millisecond),
+	})
+
+	_, reader, status := f.dial(t)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101 but got %d", status)
+	}
+
+	closing := make([]byte, len(goingAwayFrame))
+	if _, err := io.ReadFull(reader, closing); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(closing, goingAwayFrame) {
+		t.Fatalf("expected an idle connection to get a close frame, got %x", closing)
+	}
+	f.waitForUpgraded(t, 0)
+}
@@ -0,0 +1,421 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/raydatray/goobernetes/pkg/loadbalancer"
+	"github.com/raydatray/goobernetes/pkg/metrics"
+	"github.com/raydatray/goobernetes/pkg/router"
+)
+
+type testCA struct {
+	dir        string
+	cert       *x509.Certificate
+	key        *ecdsa.PrivateKey
+	CAFile     string
+	ocspServer string // named in issued certificates when set
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goobernetes test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{dir: t.TempDir(), cert: cert, key: key}
+	ca.CAFile = filepath.Join(ca.dir, "ca.crt")
+	os.WriteFile(ca.CAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	return ca
+}
+
+// issue signs a certificate for name and any SAN URIs, usable for the given
+// purpose, and writes it and its key next to the CA.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage, uris ...string) (tls.Certificate, string, string) {
+	t.Helper()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if ca.ocspServer != "" {
+		template.OCSPServer = []string{ca.ocspServer}
+	}
+	for _, uri := range uris {
+		parsed, _ := url.Parse(uri)
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile := filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key")
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func spkiPin(cert tls.Certificate) string {
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	hash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+type upstreamTLSFixture struct {
+	ca         *testCA
+	backend    *httptest.Server
+	serverCert tls.Certificate
+	clientCert string
+	clientKey  string
+}
+
+// newUpstreamTLSFixture starts a backend that serves a certificate for
+// backend.internal and requires a client certificate from the same CA.
+func newUpstreamTLSFixture(t *testing.T) *upstreamTLSFixture {
+	t.Helper()
+
+	f := &upstreamTLSFixture{ca: newTestCA(t)}
+	f.serverCert, _, _ = f.ca.issue(t, "backend.internal", x509.ExtKeyUsageServerAuth)
+	_, f.clientCert, f.clientKey = f.ca.issue(t, "lb.internal", x509.ExtKeyUsageClientAuth)
+
+	f.backend = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-Certificate", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	f.backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{f.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    f.ca.pool(),
+	}
+	f.backend.StartTLS()
+	t.Cleanup(f.backend.Close)
+	return f
+}
+
+func (f *upstreamTLSFixture) server(t *testing.T) *loadbalancer.ServerInstance {
+	t.Helper()
+
+	u, _ := url.Parse(f.backend.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	server, _ := loadbalancer.NewServerInstance("server1", host, port, 10)
+	return server
+}
+
+func (f *upstreamTLSFixture) policy() *router.UpstreamTLSPolicy {
+	return &router.UpstreamTLSPolicy{
+		CAFile:     f.ca.CAFile,
+		ServerName: "backend.internal",
+		CertFile:   f.clientCert,
+		KeyFile:    f.clientKey,
+	}
+}
+
+func (f *upstreamTLSFixture) route(t *testing.T, poolName string, policy *router.UpstreamTLSPolicy) (*router.Router, *loadbalancer.ServerInstance) {
+	t.Helper()
+
+	server := f.server(t)
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(server)
+
+	pool, _ := loadbalancer.NewPool(poolName, lb)
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: poolName})
+
+	r := router.NewRouter(pools, routes)
+	if err := r.SetUpstreamPolicy(poolName, router.UpstreamPolicy{TLS: policy}); err != nil {
+		t.Fatal(err)
+	}
+	return r, server
+}
+
+func serve(r *router.Router) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	r.ServeRequest(response, httptest.NewRequest(http.MethodGet, "/", nil))
+	return response
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	f := newUpstreamTLSFixture(t)
+
+	r, _ := f.route(t, "mtls", f.policy())
+	response := serve(r)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected status 200 but got %d: %s", response.Code, response.Body.String())
+	}
+	if got := response.Header().Get("X-Client-Certificate"); got != "lb.internal" {
+		t.Fatalf("expected the backend to see the client certificate, got %q", got)
+	}
+
+	noClientCert := f.policy()
+	noClientCert.CertFile, noClientCert.KeyFile = "", ""
+	r, _ = f.route(t, "mtls-no-client-cert", noClientCert)
+	if response := serve(r); response.Code != http.StatusBadGateway {
+		t.Fatalf("expected a backend requiring a client certificate to fail with 502 but got %d", response.Code)
+	}
+}
+
+func TestUpstreamTLSVerification(t *testing.T) {
+	f := newUpstreamTLSFixture(t)
+
+	noSNI := f.policy()
+	noSNI.ServerName = ""
+	r, server := f.route(t, "tls-no-sni", noSNI)
+	limiter, _ := loadbalancer.NewAIMDLimiter(1, 10, 10, 0)
+	server.SetConcurrencyLimiter(limiter)
+
+	tlsErrors := metrics.GetCounter(`router_upstream_tls_errors_total{pool="tls-no-sni"}`)
+	before := tlsErrors.Value()
+	if response := serve(r); response.Code != http.StatusBadGateway {
+		t.Fatalf("expected a certificate for another name to fail with 502 but got %d", response.Code)
+	}
+	if tlsErrors.Value() == before {
+		t.Fatal("expected the failed handshake to be counted")
+	}
+	if limit := server.Status().ConcurrencyLimit; limit >= 10 {
+		t.Fatalf("expected the failed handshake to count against the server, limit is still %d", limit)
+	}
+
+	pinned := f.policy()
+	pinned.CAFile, pinned.ServerName, pinned.InsecureSkipVerify = "", "", true
+	pinned.PinnedSHA256 = []string{spkiPin(f.serverCert)}
+	r, _ = f.route(t, "tls-pinned", pinned)
+	if response := serve(r); response.Code != http.StatusOK {
+		t.Fatalf("expected a pinned certificate to be accepted, got %d: %s", response.Code, response.Body.String())
+	}
+
+	other, _, _ := f.ca.issue(t, "other.internal", x509.ExtKeyUsageServerAuth)
+	pinned.PinnedSHA256 = []string{spkiPin(other)}
+	r, _ = f.route(t, "tls-mispinned", pinned)
+	if response := serve(r); response.Code != http.StatusBadGateway {
+		t.Fatalf("expected a certificate matching no pin to fail with 502 but got %d", response.Code)
+	}
+
+	_, err := (&router.UpstreamPolicy{TLS: &router.UpstreamTLSPolicy{PinnedSHA256: []string{"nope"}}}).ClientTLSConfig()
+	if err == nil {
+		t.Fatal("expected an invalid pin to be rejected")
+	}
+}
+
+func TestUpstreamTLSHealthChecks(t *testing.T) {
+	f := newUpstreamTLSFixture(t)
+
+	for _, c := range []struct {
+		name    string
+		policy  *router.UpstreamTLSPolicy
+		healthy bool
+	}{
+		{"matching tls settings", f.policy(), true},
+		{"no tls settings", &router.UpstreamTLSPolicy{}, false},
+	} {
+		config, err := (&router.UpstreamPolicy{TLS: c.policy}).ClientTLSConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := f.server(t)
+		lb := loadbalancer.NewRoundRobinLoadBalancer()
+		_ = lb.AddServer(server)
+		lb.SetServerStatus(server.ID, !c.healthy)
+
+		health, err := loadbalancer.NewHealthChecker(lb, loadbalancer.HealthCheckConfig{
+			Interval: time.Second,
+			Timeout:  time.Second,
+			TLS:      config,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		health.CheckAll()
+		if active := server.Status().Active; active != c.healthy {
+			t.Errorf("%s: expected active %v but got %v", c.name, c.healthy, active)
+		}
+	}
+}
+
+func TestUpstreamTLSPinFailureEjects(t *testing.T) {
+	f := newUpstreamTLSFixture(t)
+
+	// A second backend with its own certificate, which is the only one pinned.
+	pinnedCert, _, _ := f.ca.issue(t, "pinned.internal", x509.ExtKeyUsageServerAuth)
+	pinnedBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	pinnedBackend.TLS = &tls.Config{Certificates: []tls.Certificate{pinnedCert}}
+	pinnedBackend.StartTLS()
+	t.Cleanup(pinnedBackend.Close)
+
+	mispinned := f.server(t)
+	u, _ := url.Parse(pinnedBackend.URL)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portStr)
+	pinned, _ := loadbalancer.NewServerInstance("server2", host, port, 10)
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(mispinned)
+	_ = lb.AddServer(pinned)
+
+	pool, _ := loadbalancer.NewPool("tls-pin-outliers", lb)
+	outliers, err := loadbalancer.NewOutlierDetector(pool, loadbalancer.OutlierConfig{
+		ConsecutiveFailures: 2,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetOutlierDetector(outliers)
+	t.Cleanup(outliers.Stop)
+
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: pool.Name})
+
+	policy := f.policy()
+	policy.CAFile, policy.ServerName, policy.InsecureSkipVerify = "", "", true
+	policy.PinnedSHA256 = []string{spkiPin(pinnedCert)}
+	r := router.NewRouter(pools, routes)
+	if err := r.SetUpstreamPolicy(pool.Name, router.UpstreamPolicy{TLS: policy}); err != nil {
+		t.Fatal(err)
+	}
+
+	ejections := metrics.GetCounter(`loadbalancer_outlier_ejections_total{pool="tls-pin-outliers",server="server1"}`)
+	before := ejections.Value()
+	for range 4 {
+		serve(r)
+	}
+	if !mispinned.IsEjected() {
+		t.Fatal("expected the server failing its pin to be ejected")
+	}
+	if ejections.Value() != before+1 {
+		t.Fatalf("expected one ejection to be counted but got %d", ejections.Value()-before)
+	}
+
+	for range 4 {
+		if response := serve(r); response.Code != http.StatusOK {
+			t.Fatalf("expected requests to reach only the pinned server, got %d: %s", response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestUpstreamTLSHandshakesDontResetFailures(t *testing.T) {
+	f := newUpstreamTLSFixture(t)
+
+	// Both backends close every connection, so each request starts with a
+	// successful handshake.
+	start := func(id string, status int) *loadbalancer.ServerInstance {
+		backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(status)
+		}))
+		backend.TLS = &tls.Config{Certificates: []tls.Certificate{f.serverCert}}
+		backend.StartTLS()
+		t.Cleanup(backend.Close)
+
+		u, _ := url.Parse(backend.URL)
+		host, portStr, _ := net.SplitHostPort(u.Host)
+		port, _ := strconv.Atoi(portStr)
+		server, _ := loadbalancer.NewServerInstance(id, host, port, 10)
+		return server
+	}
+	failing := start("server1", http.StatusServiceUnavailable)
+	healthy := start("server2", http.StatusOK)
+
+	lb := loadbalancer.NewRoundRobinLoadBalancer()
+	_ = lb.AddServer(failing)
+	_ = lb.AddServer(healthy)
+
+	pool, _ := loadbalancer.NewPool("tls-handshake-streak", lb)
+	outliers, err := loadbalancer.NewOutlierDetector(pool, loadbalancer.OutlierConfig{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.SetOutlierDetector(outliers)
+	t.Cleanup(outliers.Stop)
+
+	pools := loadbalancer.NewPoolManager()
+	_ = pools.AddPool(pool)
+	routes := router.NewRouteTable()
+	_ = routes.AddRoute(router.Route{Name: "default", Pool: pool.Name})
+
+	policy := f.policy()
+	policy.CertFile, policy.KeyFile = "", ""
+	r := router.NewRouter(pools, routes)
+	if err := r.SetUpstreamPolicy(pool.Name, router.UpstreamPolicy{
+		TLS: policy,
+		Retry: router.RetryPolicy{
+			MaxAttempts: 2,
+			RetryOn:     []string{"503"},
+			Budget:      router.RetryBudget{Ratio: 1, MinPerSecond: 100},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 6 {
+		if response := serve(r); response.Code != http.StatusOK {
+			t.Fatalf("expected failed requests to be retried on server2, got %d: %s", response.Code, response.Body.String())
+		}
+	}
+	if !failing.IsEjected() {
+		t.Fatal("expected the server failing every request to be ejected despite its handshakes succeeding")
+	}
+}